@@ -23,7 +23,7 @@ S3_OBJVER=$(aws s3api head-object --bucket $S3_BUCKET --key $S3_KEY --query Vers
 ./dl/sshello &
 sleep 1
 ./lkp_linux_amd64 ssh exec --kms-key $AWS_ACCOUNT_ID:alias/LastKeypair --instance-arn abcdef -- -o StrictHostKeyChecking=no -o LogLevel=QUIET -p 2222 -o HostName=localhost travis@target | tee out.log
-diff -w out.log ci/expected-output.txt
+diff -w -I "Serial:" out.log ci/expected-output.txt
 
 ./lkp_linux_amd64 ssh exec --instance-arn defghi --dry-run -- -o StrictHostKeyChecking=no -o LogLevel=QUIET -p 2222 | tee out.log
 diff -w out.log ci/expected-output-jumpbox.txt
@@ -63,4 +63,4 @@ diff -w out.log ci/expected-output-vouched.txt
 #     cat lkp-ci/sshd_config
 #     ssh-keygen -Lf lkp-ci/ssh_host_rsa_key-cert.pub
 # ENDSSH
-# diff -I 'Valid: after' out.log ci/expected-output-host.txt
+# diff -I 'Valid: after' -I 'Serial:' out.log ci/expected-output-host.txt
@@ -3,11 +3,12 @@ package main
 import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"encoding/json"
+	"context"
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
 )
 
-func HandleLambdaEvent(event json.RawMessage) (interface{}, error) {
-	return lastkeypair.LambdaHandle(event)
+func HandleLambdaEvent(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	return lastkeypair.LambdaHandle(ctx, event)
 }
 
 func main() {
@@ -15,6 +15,7 @@ import (
 	"os"
 	"strings"
 	"path/filepath"
+	"context"
 )
 
 var hostCmd = &cobra.Command{
@@ -37,8 +38,15 @@ a signed SSH host cert and install it in the appropriate sshd config.
 		functionName, _ := cmd.PersistentFlags().GetString("lambda-func")
 		kmsKeyId, _ := cmd.PersistentFlags().GetString("kms-key")
 		principals, _ := cmd.PersistentFlags().GetStringSlice("principal")
+		revokedKeysPath, _ := cmd.PersistentFlags().GetString("revoked-keys-path")
+		allHostKeys, _ := cmd.PersistentFlags().GetBool("all-host-keys")
 
-		err := doit(hostKeyPath, signedHostKeyPath, caPubkeyPath, sshdConfigPath, authorizedPrincipalsPath, functionName, kmsKeyId, principals)
+		keys, err := hostKeys(hostKeyPath, signedHostKeyPath, allHostKeys)
+		if err != nil {
+			log.Panicf("err: %s\n", err.Error())
+		}
+
+		err = doit(keys, caPubkeyPath, sshdConfigPath, authorizedPrincipalsPath, revokedKeysPath, functionName, kmsKeyId, principals)
 		if err != nil {
 			log.Panicf("err: %s\n", err.Error())
 		}
@@ -68,52 +76,72 @@ func hostSession() (*session.Session, error) {
 	return sess, nil
 }
 
-func doit(hostKeyPath, signedHostKeyPath, caPubkeyPath, sshdConfigPath, authorizedPrincipalsPath, functionName, kmsKeyId string, principals []string) error {
-	// we absolute-ize these paths because ssh requires paths in sshd_config to be absolute
-	authorizedPrincipalsPath, _ = filepath.Abs(authorizedPrincipalsPath)
-	caPubkeyPath, _ = filepath.Abs(caPubkeyPath)
-	signedHostKeyPath, _ = filepath.Abs(signedHostKeyPath)
+// hostKeyPaths is a host public key and where its signed cert is written.
+type hostKeyPaths struct {
+	PublicKey   string
+	Certificate string
+}
 
+// hostKeys is either the single key given on the command line or, if all is
+// set, every host public key alongside it - with certs named the way sshd
+// expects.
+func hostKeys(hostKeyPath, signedHostKeyPath string, all bool) ([]hostKeyPaths, error) {
+	if !all {
+		return []hostKeyPaths{{PublicKey: hostKeyPath, Certificate: signedHostKeyPath}}, nil
+	}
 
-	hostKeyBytes, err := ioutil.ReadFile(hostKeyPath)
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(hostKeyPath), "ssh_host_*_key.pub"))
 	if err != nil {
-		return errors.Wrap(err, "reading ssh host key")
+		return nil, errors.Wrap(err, "finding ssh host keys")
+	} else if len(matches) == 0 {
+		return nil, errors.Errorf("no ssh host keys found in %s", filepath.Dir(hostKeyPath))
 	}
-	hostKey := string(hostKeyBytes)
 
-	sess, err := hostSession()
-	client := ec2metadata.New(sess)
+	keys := []hostKeyPaths{}
+	for _, match := range matches {
+		keys = append(keys, hostKeyPaths{
+			PublicKey:   match,
+			Certificate: strings.TrimSuffix(match, ".pub") + "-cert.pub",
+		})
+	}
+	return keys, nil
+}
 
-	ident, err := lastkeypair.CallerIdentityUser(sess)
-	instanceArn, err := getInstanceArn(client)
+func doit(keys []hostKeyPaths, caPubkeyPath, sshdConfigPath, authorizedPrincipalsPath, revokedKeysPath, functionName, kmsKeyId string, principals []string) error {
+	// we absolute-ize these paths because ssh requires paths in sshd_config to be absolute
+	authorizedPrincipalsPath, _ = filepath.Abs(authorizedPrincipalsPath)
+	caPubkeyPath, _ = filepath.Abs(caPubkeyPath)
+	for i := range keys {
+		keys[i].Certificate, _ = filepath.Abs(keys[i].Certificate)
+	}
+
+	lkp, client, instanceArn, err := hostClient(functionName, kmsKeyId)
 	if err != nil {
-		return errors.Wrap(err, "fetching instance arn from metadata service")
+		return err
 	}
 
-	principals = append(principals, *instanceArn)
-	token, err := hostCertToken(sess, *ident, kmsKeyId, *instanceArn, principals)
+	principals = append(principals, instanceArn)
 
-	caPubkey, err := client.GetMetadata("public-keys/0/openssh-key")
+	caPubkeys, err := trustedCaKeys(lkp, client)
 	if err != nil {
-		return errors.Wrap(err, "fetching ssh CA key")
+		return err
 	}
 
-	response := lastkeypair.HostCertRespJson{}
-	err = lastkeypair.RequestSignedPayload(sess, functionName, lastkeypair.HostCertReqJson{
-		EventType: "HostCertReq",
-		Token: *token,
-		PublicKey: hostKey,
-	}, &response)
+	signed, err := requestHostCerts(lkp, instanceArn, keys, principals)
 	if err != nil {
-		return errors.Wrap(err, "requesting signed host key")
+		return err
 	}
 
-	err = ioutil.WriteFile(signedHostKeyPath, []byte(response.SignedHostPublicKey), 0600)
-	if err != nil {
-		return errors.Wrap(err, "writing signed host key to filesystem")
+	sshdConfig := "\n"
+	for i, key := range keys {
+		err = ioutil.WriteFile(key.Certificate, []byte(signed[i]), 0600)
+		if err != nil {
+			return errors.Wrap(err, "writing signed host key to filesystem")
+		}
+		sshdConfig += fmt.Sprintf("HostCertificate %s\n", key.Certificate)
 	}
 
-	err = ioutil.WriteFile(caPubkeyPath, []byte(caPubkey), 0600)
+	err = ioutil.WriteFile(caPubkeyPath, []byte(caPubkeys), 0600)
 	if err != nil {
 		return errors.Wrap(err, "writing ca pubkey to filesystem")
 	}
@@ -125,11 +153,23 @@ func doit(hostKeyPath, signedHostKeyPath, caPubkeyPath, sshdConfigPath, authoriz
 		return errors.Wrap(err, "writing authorized principals to filesystem")
 	}
 
-	err = appendToFile(sshdConfigPath, fmt.Sprintf(`
-HostCertificate %s
-TrustedUserCAKeys %s
+	sshdConfig += fmt.Sprintf(`TrustedUserCAKeys %s
 AuthorizedPrincipalsFile %s
-`, signedHostKeyPath, caPubkeyPath, authorizedPrincipalsPath))
+`, caPubkeyPath, authorizedPrincipalsPath)
+
+	if len(revokedKeysPath) > 0 {
+		revokedKeysPath, _ = filepath.Abs(revokedKeysPath)
+
+		// sshd rejects every key if RevokedKeys can't be read, so only refer
+		// to it once it's been written.
+		err = writeKrl(lkp, revokedKeysPath)
+		if err != nil {
+			return err
+		}
+		sshdConfig += fmt.Sprintf("RevokedKeys %s\n", revokedKeysPath)
+	}
+
+	err = appendToFile(sshdConfigPath, sshdConfig)
 	if err != nil {
 		return errors.Wrap(err, "appending to sshd config")
 	}
@@ -137,6 +177,103 @@ AuthorizedPrincipalsFile %s
 	return nil
 }
 
+// trustedCaKeys returns every CA key that user certs should be trusted from,
+// so that the CA key can be rotated without re-provisioning instances. CAs
+// that predate rotation don't know how to list their keys and reject the
+// request as a bad one, in which case we fall back to the key pair the
+// instance was launched with. Any other failure is returned, rather than
+// trusting the launch key pair because the CA was briefly unavailable.
+func trustedCaKeys(lkp *lastkeypair.Client, client *ec2metadata.EC2Metadata) (string, error) {
+	caKeys, err := lkp.RequestCaKeys(context.Background())
+	if err == nil {
+		return strings.Join(caKeys.TrustedKeys, "\n") + "\n", nil
+	}
+	if errors.Cause(err) != lastkeypair.ErrBadRequest {
+		return "", err
+	}
+
+	log.Printf("falling back to instance key pair as ssh CA key: %s", err.Error())
+	caPubkey, err := client.GetMetadata("public-keys/0/openssh-key")
+	if err != nil {
+		return "", errors.Wrap(err, "fetching ssh CA key")
+	}
+	return caPubkey, nil
+}
+
+func writeKrl(lkp *lastkeypair.Client, path string) error {
+	krl, err := lkp.RequestKRL(context.Background())
+	if err != nil {
+		return err
+	}
+
+	_, err = lastkeypair.ParseKRL(krl)
+	if err != nil {
+		return errors.Wrap(err, "validating krl from CA")
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, krl, 0644)
+	if err != nil {
+		return errors.Wrap(err, "writing krl to filesystem")
+	}
+
+	return errors.Wrap(os.Rename(tmpPath, path), "replacing krl")
+}
+
+// hostClient returns an LKP client for the CA along with this instance's
+// metadata client and ARN.
+func hostClient(functionName, kmsKeyId string) (*lastkeypair.Client, *ec2metadata.EC2Metadata, string, error) {
+	sess, err := hostSession()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	client := ec2metadata.New(sess)
+
+	instanceArn, err := getInstanceArn(client)
+	if err != nil {
+		return nil, nil, "", errors.Wrap(err, "fetching instance arn from metadata service")
+	}
+
+	lkp := lastkeypair.NewClient(
+		lastkeypair.WithSession(sess),
+		lastkeypair.WithLambdaFunc(functionName),
+		lastkeypair.WithKmsKey(kmsKeyId),
+	)
+
+	return lkp, client, *instanceArn, nil
+}
+
+// requestHostCerts returns the signed certs in the same order as keys. A
+// single key is requested the old way, so that it works with older CAs.
+func requestHostCerts(lkp *lastkeypair.Client, instanceArn string, keys []hostKeyPaths, principals []string) ([]string, error) {
+	req := lastkeypair.HostCertRequest{
+		InstanceArn: instanceArn,
+		Principals:  principals,
+	}
+
+	for _, key := range keys {
+		hostKeyBytes, err := ioutil.ReadFile(key.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading ssh host key")
+		}
+		req.PublicKeys = append(req.PublicKeys, hostKeyBytes)
+	}
+
+	if len(req.PublicKeys) == 1 {
+		req.PublicKey, req.PublicKeys = req.PublicKeys[0], nil
+	}
+
+	response, err := lkp.RequestHostCert(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.PublicKeys) == 0 {
+		return []string{response.SignedHostPublicKey}, nil
+	}
+	return response.SignedHostPublicKeys, nil
+}
+
 func getInstanceArn(client *ec2metadata.EC2Metadata) (*string, error) {
 	region, err := client.Region()
 	if err != nil {
@@ -152,20 +289,6 @@ func getInstanceArn(client *ec2metadata.EC2Metadata) (*string, error) {
 	return &ret, nil
 }
 
-func hostCertToken(sess *session.Session, ident lastkeypair.StsIdentity, kmsKeyId, instanceArn string, principals []string) (*lastkeypair.Token, error) {
-	params := lastkeypair.TokenParams{
-		FromId:          ident.UserId,
-		FromAccount:     ident.AccountId,
-		To:              "LastKeypair",
-		Type:            "AssumedRole",
-		HostInstanceArn: instanceArn,
-		Principals: principals,
-	}
-
-	ret := lastkeypair.CreateToken(sess, params, kmsKeyId)
-	return &ret, nil
-}
-
 func appendToFile(path, text string) error {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
 	if err != nil {
@@ -191,4 +314,6 @@ func init() {
 	hostCmd.PersistentFlags().String("lambda-func", "LastKeypair", "")
 	hostCmd.PersistentFlags().StringSlice("principal", []string{""}, "Additional principals to request from CA")
 	hostCmd.PersistentFlags().String("kms-key", "alias/LastKeypair", "ID, ARN or alias of KMS key for auth to CA")
+	hostCmd.PersistentFlags().String("revoked-keys-path", "", "If set, fetch the CA's KRL to this path and configure it as sshd's RevokedKeys")
+	hostCmd.PersistentFlags().Bool("all-host-keys", false, "Sign every ssh_host_*_key.pub in the host key's directory rather than just --host-key-path")
 }
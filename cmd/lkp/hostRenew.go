@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var hostRenewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Renew signed SSH host certificates before they expire",
+	Long: `
+Host certificates expire, after a week unless the CA is configured otherwise.
+This command is intended to be run regularly (e.g. hourly from cron or a
+systemd timer) after "lkp host" has configured sshd. It requests a new host
+certificate when the current one is close to expiry (or doesn't match the host
+key) and reloads sshd if the certificate changed. It also refreshes the trusted CA keys and, if
+configured, the KRL - sshd reads those on every login, so they don't need a
+reload.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		hostKeyPath, _ := cmd.Flags().GetString("host-key-path")
+		signedHostKeyPath, _ := cmd.Flags().GetString("signed-host-key-path")
+		caPubkeyPath, _ := cmd.Flags().GetString("cert-authority-path")
+		revokedKeysPath, _ := cmd.Flags().GetString("revoked-keys-path")
+		functionName, _ := cmd.Flags().GetString("lambda-func")
+		kmsKeyId, _ := cmd.Flags().GetString("kms-key")
+		principals, _ := cmd.Flags().GetStringSlice("principal")
+		renewBefore, _ := cmd.Flags().GetDuration("renew-before")
+		force, _ := cmd.Flags().GetBool("force")
+		reloadCommand, _ := cmd.Flags().GetString("reload-command")
+		allHostKeys, _ := cmd.Flags().GetBool("all-host-keys")
+
+		keys, err := hostKeys(hostKeyPath, signedHostKeyPath, allHostKeys)
+		if err != nil {
+			log.Panicf("err: %s\n", err.Error())
+		}
+
+		err = renewHostCerts(keys, caPubkeyPath, revokedKeysPath, functionName, kmsKeyId, principals, renewBefore, force, reloadCommand)
+		if err != nil {
+			log.Panicf("err: %s\n", err.Error())
+		}
+	},
+}
+
+func renewHostCerts(keys []hostKeyPaths, caPubkeyPath, revokedKeysPath, functionName, kmsKeyId string, principals []string, renewBefore time.Duration, force bool, reloadCommand string) error {
+	lkp, client, instanceArn, err := hostClient(functionName, kmsKeyId)
+	if err != nil {
+		return err
+	}
+
+	caPubkeys, err := trustedCaKeys(lkp, client)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileIfChanged(caPubkeyPath, []byte(caPubkeys), 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing ca pubkey to filesystem")
+	}
+
+	if len(revokedKeysPath) > 0 {
+		err = writeKrl(lkp, revokedKeysPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// all the certs are renewed together, so it only takes one to be due
+	renew := force
+	for _, key := range keys {
+		hostKeyBytes, err := ioutil.ReadFile(key.PublicKey)
+		if err != nil {
+			return errors.Wrap(err, "reading ssh host key")
+		}
+
+		existing, _ := ioutil.ReadFile(key.Certificate)
+		if hostCertNeedsRenewal(existing, hostKeyBytes, renewBefore, time.Now()) {
+			renew = true
+		}
+	}
+
+	if !renew {
+		log.Printf("host certs don't need renewal yet")
+		return nil
+	}
+
+	signed, err := requestHostCerts(lkp, instanceArn, keys, append(principals, instanceArn))
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for i, key := range keys {
+		written, err := writeFileIfChanged(key.Certificate, []byte(signed[i]), 0600)
+		if err != nil {
+			return errors.Wrap(err, "writing signed host key to filesystem")
+		}
+		changed = changed || written
+	}
+
+	if !changed || len(reloadCommand) == 0 {
+		return nil
+	}
+
+	log.Printf("renewed host certs, reloading sshd")
+	reload := exec.Command("/bin/sh", "-c", reloadCommand)
+	reload.Stdout = os.Stdout
+	reload.Stderr = os.Stderr
+	return errors.Wrap(reload.Run(), "reloading sshd")
+}
+
+// hostCertNeedsRenewal is true when the cert is missing, unreadable, for a
+// different host key or expires within renewBefore. If renewBefore is zero,
+// certs are renewed in the final third of their lifetime. Certs that never
+// expire are never renewed.
+func hostCertNeedsRenewal(existing, hostKeyBytes []byte, renewBefore time.Duration, now time.Time) bool {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(existing)
+	if err != nil {
+		return true
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return true
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(hostKeyBytes)
+	if err != nil || !bytes.Equal(hostKey.Marshal(), cert.Key.Marshal()) {
+		return true
+	}
+
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	if renewBefore == 0 {
+		renewBefore = validBefore.Sub(time.Unix(int64(cert.ValidAfter), 0)) / 3
+	}
+
+	return now.Add(renewBefore).After(validBefore)
+}
+
+// writeFileIfChanged atomically replaces path if its contents differ and
+// reports whether it did.
+func writeFileIfChanged(path string, contents []byte, perm os.FileMode) (bool, error) {
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(existing, contents) {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(contents)
+	if err != nil {
+		tmp.Close()
+		return false, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), path)
+}
+
+func init() {
+	hostCmd.AddCommand(hostRenewCmd)
+	hostRenewCmd.Flags().Duration("renew-before", 0, "Renew the cert when it expires within this long. Defaults to the final third of its lifetime")
+	hostRenewCmd.Flags().Bool("force", false, "Renew the cert even if it isn't close to expiry")
+	hostRenewCmd.Flags().String("reload-command", "systemctl reload sshd", "Shell command run to reload sshd when the cert changes. Empty to skip")
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <token|voucher|cert>",
+	Short: "Decode and print a token, voucher, voucher request or SSH certificate",
+	Long: `Decode and print a token (as JSON, e.g. from 'lkp adv token-create'), a
+voucher, a voucher request or an SSH certificate. The argument can be the thing
+itself, a file containing it, or - to read stdin.
+
+Nothing is sent anywhere unless --verify is given. With --verify, token and
+voucher signatures are checked with KMS (and KMS payloads are decrypted to show
+when they're valid), and certificates are checked against the CA's keys.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		input, err := inspectInput(args[0])
+		if err != nil {
+			log.Fatalf("err: %s", err.Error())
+		}
+
+		verify, _ := cmd.Flags().GetBool("verify")
+		region, _ := cmd.Flags().GetString("region")
+		lambdaFunc, _ := cmd.Flags().GetString("lambda-func")
+		kmsKeyId, _ := cmd.Flags().GetString("kms-key")
+
+		i := &inspector{w: os.Stdout, kmsKeyId: kmsKeyId}
+		if verify {
+			i.client = lastkeypair.NewClient(
+				lastkeypair.WithProfile(viper.GetString("profile")),
+				lastkeypair.WithRegion(region),
+				lastkeypair.WithLambdaFunc(lambdaFunc),
+				lastkeypair.WithKmsKey(kmsKeyId),
+			)
+		}
+
+		if pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(input)); err == nil {
+			cert, ok := pubkey.(*ssh.Certificate)
+			if !ok {
+				log.Fatalf("err: that's a public key, not a certificate")
+			}
+			i.cert(cert)
+			return
+		}
+
+		if strings.HasPrefix(input, "{") {
+			token, err := inspectTokenJson([]byte(input))
+			if err != nil {
+				log.Fatalf("err: %s", err.Error())
+			}
+			i.token("", *token)
+			return
+		}
+
+		if req, err := lastkeypair.DecodeVoucherRequest(input); err == nil {
+			printVoucherRequest(os.Stdout, req)
+			return
+		}
+
+		voucher, err := lastkeypair.DecodeVoucherToken(input)
+		if err != nil {
+			log.Fatalf("err: not a token, voucher, voucher request or certificate: %s", err.Error())
+		}
+		i.token("", lastkeypair.Token(*voucher))
+	},
+}
+
+// inspectInput reads arg as a file, or stdin for "-", falling back to arg
+// itself.
+func inspectInput(arg string) (string, error) {
+	if arg == "-" {
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		return strings.TrimSpace(string(stdin)), err
+	}
+
+	if contents, err := ioutil.ReadFile(arg); err == nil {
+		return strings.TrimSpace(string(contents)), nil
+	}
+
+	return strings.TrimSpace(arg), nil
+}
+
+// inspectTokenJson accepts a bare token, or anything with a Token in it, e.g.
+// a user cert request.
+func inspectTokenJson(raw []byte) (*lastkeypair.Token, error) {
+	wrapper := struct{ Token *lastkeypair.Token }{}
+	if err := json.Unmarshal(raw, &wrapper); err == nil && wrapper.Token != nil {
+		return wrapper.Token, nil
+	}
+
+	token := &lastkeypair.Token{}
+	err := json.Unmarshal(raw, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Signature) == 0 {
+		return nil, fmt.Errorf("json doesn't look like a token: it has no signature")
+	}
+	return token, nil
+}
+
+type inspector struct {
+	w        io.Writer
+	client   *lastkeypair.Client // nil unless verifying
+	kmsKeyId string
+}
+
+func (i *inspector) token(indent string, token lastkeypair.Token) {
+	p := token.Params
+	line := func(label, format string, a ...interface{}) {
+		fmt.Fprintf(i.w, "%s%-13s%s\n", indent, label+":", fmt.Sprintf(format, a...))
+	}
+
+	line("From", "%s", voucherFrom(p))
+	line("Account", "%s (%s)", p.FromAccount, p.Type)
+	line("To", "%s", p.To)
+	if len(p.Vouchee) > 0 {
+		line("Vouchee", "%s", p.Vouchee)
+	}
+	if len(p.Context) > 0 {
+		line("Scope", "%s", p.Context)
+	}
+	if len(p.RemoteInstanceArn) > 0 {
+		line("Instance", "%s", p.RemoteInstanceArn)
+	}
+	if len(p.HostInstanceArn) > 0 {
+		line("Host", "%s", p.HostInstanceArn)
+	}
+	if len(p.SshUsername) > 0 {
+		line("Username", "%s", p.SshUsername)
+	}
+	if len(p.Principals) > 0 {
+		line("Principals", "%s", strings.Join(p.Principals, ", "))
+	}
+	if len(p.PublicKeyFingerprint) > 0 {
+		line("Key", "%s", p.PublicKeyFingerprint)
+	}
+	for _, fingerprint := range p.PublicKeyFingerprints {
+		line("Key", "%s", fingerprint)
+	}
+
+	if token.Expiry > 0 {
+		line("Expiry", "%s (unauthenticated)", inspectTime(token.Expiry))
+	}
+
+	payload := lastkeypair.PeekTokenPayload(token)
+	if i.client != nil {
+		payload = i.verifyToken(indent, token)
+	}
+	if payload != nil {
+		line("Not before", "%s", inspectTime(payload.NotBefore))
+		line("Not after", "%s", inspectTime(payload.NotAfter))
+	} else if i.client == nil {
+		line("Payload", "encrypted by KMS, use --verify to decrypt it")
+	}
+
+	line("KMS context", "v%d", token.ContextVersion)
+	context, err := token.KmsContext()
+	if err != nil {
+		fmt.Fprintf(i.w, "%s  err: %s\n", indent, err.Error())
+	}
+	keys := []string{}
+	for key := range context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(i.w, "%s  %s=%s\n", indent, key, *context[key])
+	}
+
+	for n, voucher := range p.Vouchers {
+		fmt.Fprintf(i.w, "%sVoucher %d:\n", indent, n+1)
+		i.token(indent+"  ", lastkeypair.Token(voucher))
+	}
+}
+
+// verifyToken prints whether token is valid, and returns its payload if
+// the signature is good.
+func (i *inspector) verifyToken(indent string, token lastkeypair.Token) *lastkeypair.PlaintextPayload {
+	keyArn, err := cli.FullKmsKey(i.client.Session(), i.kmsKeyId)
+	if err != nil {
+		log.Panicf("err determining KMS key ARN: %s", err.Error())
+	}
+
+	authority := lastkeypair.NewKmsTokenAuthority(i.client.Session(), keyArn)
+	authority.AllowLegacyContext = true
+
+	status := "valid"
+	payload, err := authority.Verify(context.Background(), token)
+	if err != nil {
+		status = fmt.Sprintf("invalid: %s (%s)", err.Error(), lastkeypair.ErrorCode(err))
+	} else if now := time.Now().Unix(); now < payload.NotBefore {
+		status = "not yet valid"
+	} else if now > payload.NotAfter {
+		status = "expired"
+	}
+
+	fmt.Fprintf(i.w, "%s%-13s%s\n", indent, "Signature:", status)
+	return payload
+}
+
+func (i *inspector) cert(cert *ssh.Certificate) {
+	line := func(label, format string, a ...interface{}) {
+		fmt.Fprintf(i.w, "%-13s%s\n", label+":", fmt.Sprintf(format, a...))
+	}
+
+	typ := "user"
+	if cert.CertType == ssh.HostCert {
+		typ = "host"
+	}
+
+	line("Type", "%s %s certificate", cert.Key.Type(), typ)
+	line("Key ID", "%s", cert.KeyId)
+	line("Serial", "%d", cert.Serial)
+	line("Key", "%s", ssh.FingerprintSHA256(cert.Key))
+	line("Signing CA", "%s (%s)", ssh.FingerprintSHA256(cert.SignatureKey), cert.SignatureKey.Type())
+	line("Valid", "from %s to %s", inspectCertTime(cert.ValidAfter), inspectCertTime(cert.ValidBefore))
+	line("Principals", "%s", strings.Join(cert.ValidPrincipals, ", "))
+
+	printOptions := func(label string, options map[string]string) {
+		names := []string{}
+		for name := range options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if len(names) == 0 {
+			line(label, "(none)")
+		}
+		prefix := label + ":"
+		for _, name := range names {
+			fmt.Fprintf(i.w, "%-13s%s\n", prefix, strings.TrimSpace(name+" "+options[name]))
+			prefix = ""
+		}
+	}
+	printOptions("Critical", cert.CriticalOptions)
+	printOptions("Extensions", cert.Extensions)
+
+	if i.client != nil {
+		line("Signature", "%s", i.verifyCert(cert))
+	}
+}
+
+// verifyCert checks cert against the keys the CA trusts.
+func (i *inspector) verifyCert(cert *ssh.Certificate) string {
+	caKeys, err := i.client.RequestCaKeys(context.Background())
+	if err != nil {
+		log.Panicf("err fetching ca keys: %s", err.Error())
+	}
+
+	checker := &ssh.CertChecker{
+		SupportedCriticalOptions: []string{},
+		IsRevoked: func(*ssh.Certificate) bool { return false },
+	}
+	for name := range cert.CriticalOptions {
+		checker.SupportedCriticalOptions = append(checker.SupportedCriticalOptions, name)
+	}
+
+	trusted := false
+	for _, caKey := range caKeys.TrustedKeys {
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caKey))
+		trusted = trusted || (err == nil && bytes.Equal(pubkey.Marshal(), cert.SignatureKey.Marshal()))
+	}
+	if !trusted {
+		return "invalid: not signed by a key the CA trusts"
+	}
+
+	principal := ""
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	err = checker.CheckCert(principal, cert)
+	if err != nil {
+		return fmt.Sprintf("invalid: %s", err.Error())
+	}
+	return "valid"
+}
+
+func inspectTime(unix int64) string {
+	t := time.Unix(unix, 0)
+	return fmt.Sprintf("%s (%s)", t.Format(time.RFC1123), inspectRelative(t))
+}
+
+func inspectCertTime(unix uint64) string {
+	switch unix {
+	case 0:
+		return "the beginning of time"
+	case ssh.CertTimeInfinity:
+		return "forever"
+	}
+	return inspectTime(int64(unix))
+}
+
+func inspectRelative(t time.Time) string {
+	d := (time.Until(t) / time.Second) * time.Second
+	if d < 0 {
+		return fmt.Sprintf("%s ago", -d)
+	}
+	return fmt.Sprintf("in %s", d)
+}
+
+func init() {
+	advCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().Bool("verify", false, "Check signatures online, using KMS and the CA")
+	inspectCmd.Flags().String("region", "", "")
+	inspectCmd.Flags().String("lambda-func", "LastKeypair", "Function name or ARN, for fetching CA keys with --verify")
+	inspectCmd.Flags().String("kms-key", "alias/LastKeypair", "ID, ARN or alias of KMS key that tokens are encrypted under, for --verify")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke certificates before they expire",
+	Long: `
+Records a revocation in the CA's revocation store. Hosts pick it up the next
+time they fetch the CA's KRL (see 'lkp host --revoked-keys-path').
+
+Exactly one of --serial, --key-id or --fingerprint must be given. Revoking a
+key id revokes every certificate issued to that user; revoking a fingerprint
+revokes the key itself, e.g. if a private key has leaked.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		serial, _ := cmd.PersistentFlags().GetUint64("serial")
+		keyId, _ := cmd.PersistentFlags().GetString("key-id")
+		fingerprint, _ := cmd.PersistentFlags().GetString("fingerprint")
+		reason, _ := cmd.PersistentFlags().GetString("reason")
+		table, _ := cmd.PersistentFlags().GetString("revocation-table")
+		path, _ := cmd.PersistentFlags().GetString("revocation-file")
+
+		var store lastkeypair.RevocationStore
+		if len(table) > 0 {
+			profile := viper.GetString("profile")
+			region, _ := cmd.PersistentFlags().GetString("region")
+			store = lastkeypair.NewDynamoRevocationStore(lastkeypair.ClientAwsSession(profile, region), table)
+		} else if len(path) > 0 {
+			store = lastkeypair.NewFileRevocationStore(path)
+		} else {
+			log.Panicf("one of --revocation-table or --revocation-file must be specified")
+		}
+
+		revocation := lastkeypair.Revocation{
+			Serial:      serial,
+			KeyId:       keyId,
+			Fingerprint: fingerprint,
+			RevokedAt:   time.Now().Unix(),
+			Reason:      reason,
+		}
+
+		err := store.Revoke(context.Background(), revocation)
+		if err != nil {
+			log.Panicf("err revoking: %s", err.Error())
+		}
+
+		fmt.Println("revoked")
+	},
+}
+
+func init() {
+	advCmd.AddCommand(revokeCmd)
+
+	// profile is at root level
+	revokeCmd.PersistentFlags().String("region", "", "")
+
+	revokeCmd.PersistentFlags().Uint64("serial", 0, "Serial of a single certificate to revoke")
+	revokeCmd.PersistentFlags().String("key-id", "", "Key ID of certificates to revoke")
+	revokeCmd.PersistentFlags().String("fingerprint", "", "SHA256 fingerprint of a public key to revoke")
+	revokeCmd.PersistentFlags().String("reason", "", "")
+	revokeCmd.PersistentFlags().String("revocation-table", "", "DynamoDB table the CA reads revocations from (REVOCATION_TABLE)")
+	revokeCmd.PersistentFlags().String("revocation-file", "", "File the CA reads revocations from (REVOCATION_FILE)")
+}
@@ -31,7 +31,7 @@ func setup() {
 	kms := inputKmsKey()
 	writeLkpConfig(profile, lambda, kms)
 	askUserAboutMfa(profile)
-	writeSshConfig()
+	writeSshConfig(lastkeypair.DefaultKeyType)
 	addIncludeToSshConfig("~/.lkp/ssh_config") // openssh on windows doesn't like a non-relative path
 	promptToAddToPath()
 	informNextSteps()
@@ -128,19 +128,68 @@ kms-key: %s
 	ioutil.WriteFile(path.Join(lastkeypair.AppDir(), "config.yml"), []byte(str), 0644)
 }
 
-func writeSshConfig() string {
-	str := fmt.Sprintf(`
-Match exec "lkp ssh match --instance-arn %%n --ssh-username %%r"
-  IdentityFile %s/id_rsa
-  CertificateFile %s/id_rsa-cert.pub
-  ProxyCommand lkp ssh proxy --instance-arn %%h
-`, lastkeypair.AppDir(), lastkeypair.AppDir())
-
+func writeSshConfig(keyType lastkeypair.KeyType) string {
 	lkpSshConfigPath := path.Join(lastkeypair.AppDir(), "ssh_config")
-	ioutil.WriteFile(lkpSshConfigPath, []byte(str), 0644)
+	ioutil.WriteFile(lkpSshConfigPath, []byte(sshConfigContents(keyType)), 0644)
 	return lkpSshConfigPath
 }
 
+func sshConfigContents(keyType lastkeypair.KeyType) string {
+	keyPath := path.Join(lastkeypair.AppDir(), keyType.Filename())
+
+	// ssh records keys it learns in the first file, so the user's own comes first
+	knownHosts := ""
+	knownHostsPath := path.Join(lastkeypair.AppDir(), "ca_known_hosts")
+	if _, err := os.Stat(knownHostsPath); err == nil {
+		knownHosts = fmt.Sprintf("  UserKnownHostsFile ~/.ssh/known_hosts %s\n", knownHostsPath)
+	}
+
+	return fmt.Sprintf(`
+Match exec "lkp ssh match --instance-arn %%n --ssh-username %%r"
+  IdentityFile %s
+  CertificateFile %s-cert.pub
+%s  ProxyCommand lkp ssh proxy --instance-arn %%h
+`, keyPath, keyPath, knownHosts)
+}
+
+// refreshSshConfig rewrites an existing ~/.lkp/ssh_config that was written by
+// an older version or for a different key type. ssh has already read the old
+// one by the time it runs 'lkp ssh match', so the current login has to use
+// the key type that the old one refers to, which is returned.
+func refreshSshConfig(keyType lastkeypair.KeyType) lastkeypair.KeyType {
+	existing, err := ioutil.ReadFile(path.Join(lastkeypair.AppDir(), "ssh_config"))
+	if err != nil || string(existing) == sshConfigContents(keyType) {
+		return keyType
+	}
+
+	writeSshConfig(keyType)
+
+	if current, found := sshConfigKeyType(existing); found {
+		return current
+	}
+	return keyType
+}
+
+// sshConfigKeyType returns the key type that the IdentityFile in an existing
+// ~/.lkp/ssh_config refers to. Configs written before key types were
+// configurable refer to id_rsa.
+func sshConfigKeyType(existing []byte) (lastkeypair.KeyType, bool) {
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "IdentityFile" {
+			continue
+		}
+
+		for _, keyType := range []lastkeypair.KeyType{lastkeypair.KeyTypeEd25519, lastkeypair.KeyTypeEcdsaP256, lastkeypair.KeyTypeRsa4096} {
+			if filepath.Base(fields[1]) == keyType.Filename() {
+				return keyType, true
+			}
+		}
+	}
+
+	return "", false
+}
+
 func addIncludeToSshConfig(path string) {
 	sshConfigPath, _ := homedir.Expand("~/.ssh/config")
 	sshConfigBytes, _ := ioutil.ReadFile(sshConfigPath)
@@ -2,6 +2,9 @@ package main
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
+	"strings"
 )
 
 var sshCmd = &cobra.Command{
@@ -9,6 +12,68 @@ var sshCmd = &cobra.Command{
 	Short: "Integration with the client ssh program",
 }
 
+func configuredKeyType() (lastkeypair.KeyType, error) {
+	return lastkeypair.ParseKeyType(viper.GetString("key-type"))
+}
+
+func newReifiedLogin(cmd *cobra.Command, keyType lastkeypair.KeyType) (*lastkeypair.ReifiedLogin, error) {
+	client, req, err := newUserCertRequest(cmd, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	// vouchers approved with lkp vouch approve and added with lkp vouch add
+	inboxVouchers, err := client.VoucherInbox().For(req.InstanceArn, req.SshUsername)
+	if err != nil {
+		return nil, err
+	}
+	vouchers := append(req.Vouchers, inboxVouchers...)
+
+	rei := lastkeypair.NewReifiedLogin(client, req.InstanceArn, req.SshUsername, vouchers)
+	rei.ValidityDuration = req.ValidityDuration
+	return rei, nil
+}
+
+// newUserCertRequest reads the flags shared by lkp ssh exec and lkp ssh
+// match. Vouchers from the inbox are left to the caller.
+func newUserCertRequest(cmd *cobra.Command, keyType lastkeypair.KeyType) (*lastkeypair.Client, lastkeypair.UserCertRequest, error) {
+	profile := viper.GetString("profile")
+
+	lambdaFunc := viper.GetString("lambda-func")
+	kmsKeyId := viper.GetString("kms-key")
+	instanceArn, _ := cmd.PersistentFlags().GetString("instance-arn")
+	username, _ := cmd.PersistentFlags().GetString("ssh-username")
+	region, _ := cmd.PersistentFlags().GetString("region")
+	encodedVouchers, _ := cmd.PersistentFlags().GetStringSlice("voucher")
+	duration, _ := cmd.PersistentFlags().GetDuration("duration")
+
+	instanceArnParts := strings.Split(instanceArn, ":")
+	if len(instanceArnParts) > 3 {
+		region = instanceArnParts[3]
+	}
+
+	vouchers, err := lastkeypair.DecodeVoucherTokens(encodedVouchers)
+	if err != nil {
+		return nil, lastkeypair.UserCertRequest{}, err
+	}
+
+	client := lastkeypair.NewClient(
+		lastkeypair.WithProfile(profile),
+		lastkeypair.WithRegion(region),
+		lastkeypair.WithLambdaFunc(lambdaFunc),
+		lastkeypair.WithKmsKey(kmsKeyId),
+		lastkeypair.WithKeyType(keyType),
+	)
+
+	req := lastkeypair.UserCertRequest{
+		InstanceArn:      instanceArn,
+		SshUsername:      username,
+		Vouchers:         vouchers,
+		ValidityDuration: duration,
+	}
+	return client, req, nil
+}
+
 func init() {
 	RootCmd.AddCommand(sshCmd)
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"log"
 	"github.com/spf13/cobra"
+	"context"
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
 	"os/exec"
 	"syscall"
@@ -9,20 +11,58 @@ import (
 	"fmt"
 	"strings"
 	"github.com/spf13/viper"
+	"io"
+	"sort"
+	"time"
 )
 
 var sshExecCmd = &cobra.Command{
 	Use:   "exec",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "SSH into an instance with a freshly signed certificate",
+	Long: `Asks the CA to sign your public key for --instance-arn, writes an ssh config
+that uses the certificate (and any jumpboxes the CA chose) and then runs ssh
+with it. Arguments are passed through to ssh.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+Vouchers given with --voucher are sent along with any in your voucher inbox
+(see lkp adv vouch).
+
+--simulate asks the CA whether you would be let in, and with which
+principals, options, validity and jumpboxes, without it signing anything. If
+you would be denied, the reason is printed and lkp exits non-zero. No
+certificate or ssh config is written, and expired or unreadable inbox
+vouchers are left where they are.
+
+--dry-run gets the certificate and writes the ssh config as usual, but prints
+the ssh command instead of running it.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		rei := lastkeypair.NewReifiedLoginWithCmd(cmd, args)
-		rei.PopulateByInvoke()
+		keyType, err := configuredKeyType()
+		if err != nil {
+			log.Fatalf("err: %s", err.Error())
+		}
+
+		simulate, _ := cmd.PersistentFlags().GetBool("simulate")
+		if simulate {
+			resp, err := simulateLogin(cmd, keyType)
+			if err != nil {
+				log.Fatalf("err: %s", err.Error())
+			}
+
+			printSimulation(os.Stdout, resp)
+			if !resp.Allowed {
+				os.Exit(1)
+			}
+			return
+		}
+
+		rei, err := newReifiedLogin(cmd, keyType)
+		if err != nil {
+			log.Panicf("err: %s", err.Error())
+		}
+
+		err = rei.PopulateByInvoke(context.Background())
+		if err != nil {
+			log.Panicf("err: %s", err.Error())
+		}
 
 		sshconfPath := rei.WriteSshConfig()
 		sshcmd := []string{"ssh", "-F", sshconfPath}
@@ -41,6 +81,75 @@ to quickly create a Cobra application.`,
 	},
 }
 
+// simulateLogin is what newReifiedLogin and PopulateByInvoke do, minus
+// anything that changes local state.
+func simulateLogin(cmd *cobra.Command, keyType lastkeypair.KeyType) (*lastkeypair.SimulateUserCertRespJson, error) {
+	client, req, err := newUserCertRequest(cmd, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	inboxVouchers, err := client.VoucherInbox().Peek(req.InstanceArn, req.SshUsername)
+	if err != nil {
+		return nil, err
+	}
+	req.Vouchers = append(req.Vouchers, inboxVouchers...)
+
+	return client.SimulateUserCert(context.Background(), req)
+}
+
+func printSimulation(w io.Writer, resp *lastkeypair.SimulateUserCertRespJson) {
+	if !resp.Allowed {
+		fmt.Fprintf(w, "Decision:    denied (%s)\n", resp.ErrorCode)
+		fmt.Fprintf(w, "Reason:      %s\n", resp.Message)
+		return
+	}
+
+	validity := time.Duration(resp.ValidityDuration) * time.Second
+	fmt.Fprintf(w, "Decision:    allowed\n")
+	fmt.Fprintf(w, "Principals:  %s\n", strings.Join(resp.Principals, ", "))
+	fmt.Fprintf(w, "Validity:    %s (until %s)\n", validity, time.Now().Add(validity).Format(time.RFC1123))
+	fmt.Fprintf(w, "Options:     %s\n", formatCertOptions(resp.CriticalOptions, resp.Extensions))
+	if len(resp.TargetAddress) > 0 {
+		fmt.Fprintf(w, "Address:     %s\n", resp.TargetAddress)
+	}
+
+	for _, j := range resp.Jumpboxes {
+		fmt.Fprintf(w, "Jumpbox:     %s@%s (principals: %s)\n", j.User, j.Address, strings.Join(j.Principals, ", "))
+		if j.CertificateOptions != nil {
+			permissions, err := lastkeypair.GenerateSshPermissions(j.CertificateOptions)
+			if err == nil {
+				fmt.Fprintf(w, "  Options:   %s\n", formatCertOptions(permissions.CriticalOptions, permissions.Extensions))
+			}
+		}
+	}
+}
+
+// formatCertOptions prints options the way ssh-keygen -L does, but on one line.
+func formatCertOptions(critical, extensions map[string]string) string {
+	opts := []string{}
+	for _, m := range []map[string]string{critical, extensions} {
+		names := []string{}
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if len(m[name]) > 0 {
+				opts = append(opts, fmt.Sprintf("%s=%q", name, m[name]))
+			} else {
+				opts = append(opts, name)
+			}
+		}
+	}
+
+	if len(opts) == 0 {
+		return "(none)"
+	}
+	return strings.Join(opts, " ")
+}
+
 func init() {
 	sshCmd.AddCommand(sshExecCmd)
 
@@ -49,7 +158,10 @@ func init() {
 	sshExecCmd.PersistentFlags().String("instance-arn", "", "")
 	sshExecCmd.PersistentFlags().String("ssh-username", "ec2-user", "Username that you wish to SSH in with")
 	sshExecCmd.PersistentFlags().StringSlice("voucher", []string{}, "Optional voucher(s) from other people")
+	sshExecCmd.PersistentFlags().Duration("duration", 0, "Ask for a cert that expires sooner than the CA's default, e.g. 5m")
+	sshExecCmd.PersistentFlags().Bool("simulate", false, "Ask the CA whether you would be allowed in, and with what cert, without getting one")
 	sshExecCmd.PersistentFlags().Bool("dry-run", false, "Do everything _except_ the SSH login")
+	sshExecCmd.PersistentFlags().String("key-type", string(lastkeypair.DefaultKeyType), "Type of keypair to generate: ed25519, ecdsa-p256 or rsa-4096")
 
 	viper.BindPFlags(sshExecCmd.PersistentFlags())
 }
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"log"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
-	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
+	"context"
 )
 
 var sshMatchCmd = &cobra.Command{
@@ -12,12 +13,28 @@ var sshMatchCmd = &cobra.Command{
 	Short: "Internal command invoked by SSH client",
 	Long: "`ssh` invokes this to determine if LKP should be used to login to a host",
 	Run: func(cmd *cobra.Command, args []string) {
-		rei := lastkeypair.NewReifiedLoginWithCmd(cmd, args)
+		keyType, err := configuredKeyType()
+		if err != nil {
+			log.Panicf("err: %s", err.Error())
+		}
+
+		keyType = refreshSshConfig(keyType)
+
+		rei, err := newReifiedLogin(cmd, keyType)
+		if err != nil {
+			log.Panicf("err: %s", err.Error())
+		}
 
 		if !isLkpHost(rei.InstanceArn) {
 			os.Exit(1)
 		} else {
-			rei.PopulateByInvoke()
+			err := rei.PopulateByInvoke(context.Background())
+			if err != nil {
+				log.Panicf("err: %s", err.Error())
+			}
+
+			// the first login writes ca_known_hosts, which the config refers to from then on
+			refreshSshConfig(keyType)
 		}
 	},
 }
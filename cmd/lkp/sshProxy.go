@@ -4,6 +4,7 @@ import (
 	"os"
 	"net"
 	"github.com/spf13/cobra"
+	"log"
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair/netcat"
 	"syscall"
@@ -24,7 +25,10 @@ by their instance ARN rather than IP address.
 func proxy(cmd *cobra.Command, args []string) {
 	port, _ := cmd.PersistentFlags().GetString("port")
 
-	rei := lastkeypair.NewReifiedLoginWithCmd(cmd, args)
+	rei, err := newReifiedLogin(cmd, lastkeypair.DefaultKeyType)
+	if err != nil {
+		log.Panicf("err: %s", err.Error())
+	}
 	rei.PopulateByRestoreCache()
 
 	jump := rei.Response.Jumpboxes
@@ -9,6 +9,7 @@ import (
 	"log"
 	"golang.org/x/crypto/ssh"
 	"time"
+	"github.com/spf13/viper"
 )
 
 var sshSignCmd = &cobra.Command{
@@ -23,21 +24,45 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		caKeyPath, _ := cmd.PersistentFlags().GetString("ca-key-path")
 		caKeyPassphrase, _ := cmd.PersistentFlags().GetString("ca-key-passphrase")
+		caKmsKey, _ := cmd.PersistentFlags().GetString("ca-kms-key")
 		userKeyPath, _ := cmd.PersistentFlags().GetString("user-key-path")
 		keyId, _ := cmd.PersistentFlags().GetString("key-id")
 		duration, _ := cmd.PersistentFlags().GetInt64("duration")
 		principals, _ := cmd.PersistentFlags().GetStringSlice("principals")
+		options, _ := cmd.PersistentFlags().GetStringArray("option")
+
+		certOptions, err := lastkeypair.ParseCertificateOptions(options)
+		if err != nil {
+			log.Panicf("err parsing certificate options: %s", err.Error())
+		}
+
+		permissions, err := lastkeypair.GenerateSshPermissions(certOptions)
+		if err != nil {
+			log.Panicf("err parsing certificate options: %s", err.Error())
+		}
 
-		keyBytes, _ := ioutil.ReadFile(caKeyPath)
 		userPubkeyBytes, _ := ioutil.ReadFile(userKeyPath)
 
+		var signer ssh.Signer
+		if len(caKmsKey) > 0 {
+			profile := viper.GetString("profile")
+			region, _ := cmd.PersistentFlags().GetString("region")
+			sess := lastkeypair.ClientAwsSession(profile, region)
+			signer, err = lastkeypair.NewKmsSigner(sess, caKmsKey)
+		} else {
+			keyBytes, _ := ioutil.ReadFile(caKeyPath)
+			signer, err = lastkeypair.NewLocalCaSigner(keyBytes, []byte(caKeyPassphrase))
+		}
+		if err != nil {
+			log.Panicf("err loading ca key: %s", err.Error())
+		}
+
 		formatted, err := lastkeypair.SignSsh(
-			keyBytes,
-			[]byte(caKeyPassphrase),
+			signer,
 			userPubkeyBytes,
 			ssh.UserCert,
 			uint64(time.Now().Unix() + duration),
-			lastkeypair.DefaultSshPermissions,
+			permissions,
 			keyId,
 			principals,
 		)
@@ -55,8 +80,11 @@ func init() {
 
 	sshSignCmd.PersistentFlags().String("ca-key-path", "", "")
 	sshSignCmd.PersistentFlags().String("ca-key-passphrase", "", "")
+	sshSignCmd.PersistentFlags().String("ca-kms-key", "", "ID, ARN or alias of an asymmetric KMS key to sign with instead of --ca-key-path")
+	sshSignCmd.PersistentFlags().String("region", "", "")
 	sshSignCmd.PersistentFlags().String("user-key-path", "", "")
 	sshSignCmd.PersistentFlags().String("key-id", "", "")
 	sshSignCmd.PersistentFlags().Int64("duration", 3600, "")
 	sshSignCmd.PersistentFlags().StringSlice("principals", []string{}, "")
+	sshSignCmd.PersistentFlags().StringArrayP("option", "O", []string{}, "Certificate option in ssh-keygen -O syntax, e.g. no-pty or source-address=10.0.0.0/8. Can be repeated")
 }
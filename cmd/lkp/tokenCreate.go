@@ -7,6 +7,7 @@ import (
 	"log"
 	"fmt"
 	"encoding/json"
+	"context"
 )
 
 var tokenCreateCmd = &cobra.Command{
@@ -38,7 +39,7 @@ to quickly create a Cobra application.`,
 			Type: typ,
 		}
 
-		ident, err := lastkeypair.CallerIdentityUser(sess)
+		ident, err := lastkeypair.CallerIdentityUser(context.Background(), sess)
 		if err != nil {
 			log.Panicf("No 'from' specified and could not determine caller identity: %s", err.Error())
 		}
@@ -53,7 +54,11 @@ to quickly create a Cobra application.`,
 			params.FromId = ident.UserId
 		}
 
-		token := lastkeypair.CreateToken(sess, params, key)
+		authority := lastkeypair.NewKmsTokenAuthority(sess, key)
+		token, err := lastkeypair.CreateToken(context.Background(), authority, params)
+		if err != nil {
+			log.Panicf("err creating token: %s", err.Error())
+		}
 		jsonToken, _ := json.Marshal(token)
 		fmt.Println(string(jsonToken))
 	},
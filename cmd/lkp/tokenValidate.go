@@ -6,6 +6,7 @@ import (
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
 	"fmt"
 	"encoding/base64"
+	"context"
 )
 
 var tokenValidateCmd = &cobra.Command{
@@ -43,8 +44,13 @@ to quickly create a Cobra application.`,
 			Signature: rawSig,
 		}
 
-		valid := lastkeypair.ValidateToken(sess, token, key)
-		fmt.Printf("token valid: %+v\n", valid)
+		authority := lastkeypair.NewKmsTokenAuthority(sess, key)
+		err := lastkeypair.ValidateToken(context.Background(), authority, token, nil)
+		if err != nil {
+			fmt.Printf("token invalid: %s (%s)\n", err.Error(), lastkeypair.ErrorCode(err))
+		} else {
+			fmt.Println("token valid")
+		}
 	},
 }
 
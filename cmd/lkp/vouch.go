@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"context"
 
 	"github.com/spf13/cobra"
 	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
@@ -20,14 +22,24 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := viper.GetString("profile")
 		region, _ := cmd.PersistentFlags().GetString("region")
-		sess := lastkeypair.ClientAwsSession(profile, region)
-
 		keyId, _ := cmd.PersistentFlags().GetString("kms-key")
 		to, _ := cmd.PersistentFlags().GetString("to")
 		vouchee, _ := cmd.PersistentFlags().GetString("vouchee")
-		context, _ := cmd.PersistentFlags().GetString("context")
-
-		token := lastkeypair.Vouch(sess, keyId, to, vouchee, context)
+		vouchContext, _ := cmd.PersistentFlags().GetString("context")
+		sshUsername, _ := cmd.PersistentFlags().GetString("ssh-username")
+		ttl, _ := cmd.PersistentFlags().GetDuration("ttl")
+
+		client := lastkeypair.NewClient(
+			lastkeypair.WithProfile(profile),
+			lastkeypair.WithRegion(region),
+			lastkeypair.WithKmsKey(keyId),
+			lastkeypair.WithTokenIdentity(to),
+		)
+
+		token, err := client.Vouch(context.Background(), vouchee, vouchContext, sshUsername, ttl)
+		if err != nil {
+			log.Panicf("err vouching: %s", err.Error())
+		}
 		encoded := token.Encode()
 		fmt.Println(encoded)
 	},
@@ -42,6 +54,8 @@ func init() {
 	vouchCmd.PersistentFlags().String("kms-key", "alias/LastKeypair", "ID, ARN or alias of KMS key for auth to CA")
 	vouchCmd.PersistentFlags().String("to", "LastKeypair", "")
 
-	vouchCmd.PersistentFlags().String("vouchee", "", "")
-	vouchCmd.PersistentFlags().String("context", "", "")
+	vouchCmd.PersistentFlags().String("vouchee", "", "IAM username, unique ID or role session name of the person being vouched for")
+	vouchCmd.PersistentFlags().String("context", "", "ARN of the instance they're logging into")
+	vouchCmd.PersistentFlags().String("ssh-username", "", "Username they can log in as, or any if empty")
+	vouchCmd.PersistentFlags().Duration("ttl", lastkeypair.TokenLifetime, "How long the voucher is valid for")
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AlecAivazis/survey"
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var voucherCmd = &cobra.Command{
+	Use:   "vouch",
+	Short: "Ask colleagues to vouch for you, and vouch for them",
+	Long: `Some instances need someone else to vouch for you before you can log in.
+
+Run 'lkp vouch request' and send the output to a colleague, who runs
+'lkp vouch approve' on it and sends you back a voucher. 'lkp vouch add' puts
+that voucher in your inbox (~/.lkp/vouchers), where 'lkp ssh exec' finds it.`,
+}
+
+var voucherRequestCmd = &cobra.Command{
+	Use:   "request",
+	Short: "Describe who you are, what you want to log into and why, for a colleague to approve",
+	Run: func(cmd *cobra.Command, args []string) {
+		instanceArn, _ := cmd.Flags().GetString("instance-arn")
+		username, _ := cmd.Flags().GetString("ssh-username")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		if len(instanceArn) == 0 || len(reason) == 0 {
+			log.Fatalf("--instance-arn and --reason are required")
+		}
+
+		client := voucherClient(cmd)
+		req, err := client.RequestVoucher(context.Background(), instanceArn, username, reason)
+		if err != nil {
+			log.Panicf("err requesting voucher: %s", err.Error())
+		}
+
+		fmt.Println(req.Encode())
+	},
+}
+
+var voucherApproveCmd = &cobra.Command{
+	Use:   "approve <request>",
+	Short: "Vouch for the colleague who made a voucher request",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req, err := lastkeypair.DecodeVoucherRequest(args[0])
+		if err != nil {
+			log.Fatalf("err: %s", err.Error())
+		}
+
+		printVoucherRequest(os.Stderr, req)
+
+		yes, _ := cmd.Flags().GetBool("yes")
+		if !yes {
+			prompt := &survey.Confirm{Message: fmt.Sprintf("Vouch for %s?", req.Vouchee())}
+			survey.AskOne(prompt, &yes, nil)
+		}
+		if !yes {
+			os.Exit(1)
+		}
+
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		client := voucherClient(cmd)
+		voucher, err := client.ApproveVoucherRequest(context.Background(), req, ttl)
+		if err != nil {
+			log.Panicf("err vouching: %s", err.Error())
+		}
+
+		fmt.Println(voucher.Encode())
+	},
+}
+
+var voucherAddCmd = &cobra.Command{
+	Use:   "add [voucher]",
+	Short: "Add a voucher to your inbox, for lkp ssh exec to use. Reads stdin if no voucher is given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		encoded := ""
+		if len(args) > 0 {
+			encoded = args[0]
+		} else {
+			stdin, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				log.Panicf("err reading voucher: %s", err.Error())
+			}
+			encoded = string(stdin)
+		}
+
+		voucher, err := lastkeypair.DecodeVoucherToken(strings.TrimSpace(encoded))
+		if err != nil {
+			log.Fatalf("err: %s", err.Error())
+		}
+
+		client := voucherClient(cmd)
+		err = client.VoucherInbox().Add(voucher)
+		if err != nil {
+			log.Panicf("err: %s", err.Error())
+		}
+
+		fmt.Fprintf(os.Stderr, "Added a voucher from %s for logging into %s", voucherFrom(voucher.Params), voucher.Params.Context)
+		if len(voucher.Params.SshUsername) > 0 {
+			fmt.Fprintf(os.Stderr, " as %s", voucher.Params.SshUsername)
+		}
+		if voucher.Expiry > 0 {
+			fmt.Fprintf(os.Stderr, ", valid until %s", time.Unix(voucher.Expiry, 0).Format(time.RFC1123))
+		}
+		fmt.Fprintln(os.Stderr)
+	},
+}
+
+func voucherClient(cmd *cobra.Command) *lastkeypair.Client {
+	region, _ := cmd.Flags().GetString("region")
+	keyId, _ := cmd.Flags().GetString("kms-key")
+	to, _ := cmd.Flags().GetString("to")
+
+	return lastkeypair.NewClient(
+		lastkeypair.WithProfile(viper.GetString("profile")),
+		lastkeypair.WithRegion(region),
+		lastkeypair.WithKmsKey(keyId),
+		lastkeypair.WithTokenIdentity(to),
+	)
+}
+
+func voucherFrom(params lastkeypair.TokenParams) string {
+	if len(params.FromName) > 0 {
+		return fmt.Sprintf("%s (%s)", params.FromName, params.FromId)
+	}
+	return params.FromId
+}
+
+func printVoucherRequest(w io.Writer, req *lastkeypair.VoucherRequest) {
+	who := req.FromId
+	if len(req.FromName) > 0 {
+		who = fmt.Sprintf("%s (%s)", req.FromName, req.FromId)
+	}
+
+	fmt.Fprintf(w, "Requester:   %s\n", who)
+	fmt.Fprintf(w, "Account:     %s (%s)\n", req.FromAccount, req.Type)
+	fmt.Fprintf(w, "Instance:    %s\n", req.InstanceArn)
+	if len(req.SshUsername) > 0 {
+		fmt.Fprintf(w, "Username:    %s\n", req.SshUsername)
+	}
+	fmt.Fprintf(w, "Reason:      %s\n", req.Reason)
+	fmt.Fprintf(w, "Requested:   %s (%s ago)\n", req.Created.Format(time.RFC1123), (time.Since(req.Created)/time.Second)*time.Second)
+}
+
+func init() {
+	RootCmd.AddCommand(voucherCmd)
+	voucherCmd.AddCommand(voucherRequestCmd)
+	voucherCmd.AddCommand(voucherApproveCmd)
+	voucherCmd.AddCommand(voucherAddCmd)
+
+	voucherCmd.PersistentFlags().String("region", "", "")
+	voucherCmd.PersistentFlags().String("kms-key", "alias/LastKeypair", "ID, ARN or alias of KMS key for auth to CA")
+	voucherCmd.PersistentFlags().String("to", "LastKeypair", "")
+
+	voucherRequestCmd.Flags().String("instance-arn", "", "ARN of the instance you want to log into")
+	voucherRequestCmd.Flags().String("ssh-username", "ec2-user", "Username that you wish to SSH in with")
+	voucherRequestCmd.Flags().String("reason", "", "Why you need access, for the approver")
+
+	voucherApproveCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+	voucherApproveCmd.Flags().Duration("ttl", lastkeypair.TokenLifetime, "How long the voucher is valid for")
+}
@@ -0,0 +1,216 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent describes a single user or host certificate decision, whether
+// or not a certificate was issued. Requester fields come from the request's
+// token, so they're only trustworthy if the token was valid - i.e. if
+// ErrorCode isn't one of the token errors.
+type AuditEvent struct {
+	Time      time.Time
+	EventType string // "UserCertReq" or "HostCertReq"
+	Allowed   bool
+	ErrorCode string `json:",omitempty"`
+	Message   string `json:",omitempty"` // why the request was denied
+
+	RequesterId      string
+	RequesterAccount string
+	RequesterName    string   `json:",omitempty"`
+	RequesterType    string
+	TargetArn        string   // the instance logged into, or the host being certified
+	SshUsername      string   `json:",omitempty"`
+	Vouchers         []string `json:",omitempty"` // identities of the vouchers
+	RejectedVouchers []string `json:",omitempty"` // and why any were dropped
+
+	// Authorized is the authorizer's verdict, unset if it wasn't consulted.
+	Authorized        *bool  `json:",omitempty"`
+	AuthorizerMessage string `json:",omitempty"`
+
+	PublicKeyFingerprints []string           `json:",omitempty"` // of the keys to be signed
+	Certificates          []AuditCertificate `json:",omitempty"`
+}
+
+type AuditCertificate struct {
+	Serial               uint64
+	KeyId                string
+	Principals           []string
+	PublicKeyFingerprint string
+	ValidAfter           uint64
+	ValidBefore          uint64
+}
+
+// AuditSink receives every AuditEvent. Errors are logged by the CA, rather
+// than failing the request - the issuance ledger is the record that must
+// not be lost.
+type AuditSink interface {
+	Emit(ctx context.Context, event AuditEvent) error
+}
+
+func newAuditEvent(eventType string, params TokenParams, publicKeys []string) *AuditEvent {
+	event := &AuditEvent{
+		Time:             time.Now(),
+		EventType:        eventType,
+		RequesterId:      params.FromId,
+		RequesterAccount: params.FromAccount,
+		RequesterName:    params.FromName,
+		RequesterType:    params.Type,
+		TargetArn:        params.RemoteInstanceArn,
+		SshUsername:      params.SshUsername,
+	}
+
+	if len(params.HostInstanceArn) > 0 {
+		event.TargetArn = params.HostInstanceArn
+	}
+
+	for _, v := range params.Vouchers {
+		event.Vouchers = append(event.Vouchers, tokenIdentity(v.Params))
+	}
+
+	for _, publicKey := range publicKeys {
+		if fingerprint, err := PublicKeyFingerprint([]byte(publicKey)); err == nil {
+			event.PublicKeyFingerprints = append(event.PublicKeyFingerprints, fingerprint)
+		}
+	}
+
+	return event
+}
+
+// recordVouchers replaces the vouchers from the token with those that were
+// verified.
+func (e *AuditEvent) recordVouchers(verified []VoucherToken, rejected []string) {
+	e.Vouchers = nil
+	for _, v := range verified {
+		e.Vouchers = append(e.Vouchers, tokenIdentity(v.Params))
+	}
+	e.RejectedVouchers = rejected
+}
+
+func (e *AuditEvent) recordAuthorizer(authorized bool, message string) {
+	e.Authorized = &authorized
+	e.AuthorizerMessage = message
+}
+
+func (e *AuditEvent) recordCertificate(cert *ssh.Certificate) {
+	e.Certificates = append(e.Certificates, AuditCertificate{
+		Serial:               cert.Serial,
+		KeyId:                cert.KeyId,
+		Principals:           cert.ValidPrincipals,
+		PublicKeyFingerprint: ssh.FingerprintSHA256(cert.Key),
+		ValidAfter:           cert.ValidAfter,
+		ValidBefore:          cert.ValidBefore,
+	})
+}
+
+// emitAudit completes event with the outcome of the request and sends it to
+// the configured sink, if any.
+func (c LambdaConfig) emitAudit(ctx context.Context, event *AuditEvent, err error) {
+	event.Allowed = err == nil
+	if err != nil {
+		event.ErrorCode = ErrorCode(err)
+		event.Message = err.Error()
+	}
+
+	if c.AuditSink == nil {
+		return
+	}
+
+	if emitErr := c.AuditSink.Emit(ctx, *event); emitErr != nil {
+		log.Printf("error emitting audit event: %+v", emitErr)
+	}
+}
+
+// WriterAuditSink writes events as JSON lines. Writing to stdout from the
+// Lambda puts them in CloudWatch Logs, where they can be queried as JSON.
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+func NewStdoutAuditSink() *WriterAuditSink {
+	return NewWriterAuditSink(os.Stdout)
+}
+
+func (s *WriterAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "encoding audit event")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return errors.Wrap(err, "writing audit event")
+}
+
+// FileAuditSink appends events to a JSON-lines file.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{path: path}
+}
+
+func (s *FileAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit file")
+	}
+	defer f.Close()
+
+	return NewWriterAuditSink(f).Emit(ctx, event)
+}
+
+// WebhookAuditSink POSTs each event as JSON. If it has a secret, the body's
+// HMAC-SHA256 is sent hex-encoded in the X-Lkp-Signature header, so that the
+// receiver can tell the event came from the CA.
+type WebhookAuditSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookAuditSink(url string, secret []byte) *WebhookAuditSink {
+	return &WebhookAuditSink{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *WebhookAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+	return errors.Wrap(postJSON(ctx, s.client, s.url, s.secret, event, nil), "sending audit event")
+}
+
+// MultiAuditSink emits to every sink, even if some of them fail.
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Emit(ctx context.Context, event AuditEvent) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Emit(ctx, event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,78 @@
+package lastkeypair
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserCertReqEmitsAuditEvents(t *testing.T) {
+	buf := &bytes.Buffer{}
+	config := testCaConfig(t)
+	config.AuditSink = NewWriterAuditSink(buf)
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	resp, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Nil(t, err)
+
+	tampered := testUserCertReq(t, params, kp)
+	tampered.Token.Params.SshUsername = "root"
+	_, err = DoUserCertReq(context.Background(), tampered, config)
+	assert.NotNil(t, err)
+
+	decoder := json.NewDecoder(buf)
+	allowed, denied := AuditEvent{}, AuditEvent{}
+	assert.Nil(t, decoder.Decode(&allowed))
+	assert.Nil(t, decoder.Decode(&denied))
+
+	assert.True(t, allowed.Allowed)
+	assert.Equal(t, "UserCertReq", allowed.EventType)
+	assert.Equal(t, "AIDAEXAMPLE", allowed.RequesterId)
+	assert.Equal(t, params.RemoteInstanceArn, allowed.TargetArn)
+	assert.Equal(t, "ec2-user", allowed.SshUsername)
+	assert.True(t, *allowed.Authorized)
+	assert.Equal(t, []string{params.PublicKeyFingerprint}, allowed.PublicKeyFingerprints)
+	assert.Len(t, allowed.Certificates, 1)
+	assert.Equal(t, []string{params.RemoteInstanceArn}, allowed.Certificates[0].Principals)
+	assert.Equal(t, uint64(resp.Expiry), allowed.Certificates[0].ValidBefore)
+
+	assert.False(t, denied.Allowed)
+	assert.Equal(t, "InvalidToken", denied.ErrorCode)
+	assert.Equal(t, "root", denied.SshUsername)
+	assert.Nil(t, denied.Authorized)
+	assert.Empty(t, denied.Certificates)
+}
+
+func TestWebhookAuditSinkSignsEvents(t *testing.T) {
+	secret := []byte("webhook secret")
+	received := AuditEvent{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Lkp-Signature"))
+		assert.Nil(t, json.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+
+	sink := NewWebhookAuditSink(server.URL, secret)
+	assert.Nil(t, sink.Emit(context.Background(), AuditEvent{EventType: "HostCertReq", Allowed: true}))
+	assert.Equal(t, "HostCertReq", received.EventType)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.NotNil(t, NewWebhookAuditSink(failing.URL, nil).Emit(context.Background(), AuditEvent{}))
+}
@@ -1,9 +1,22 @@
 package lastkeypair
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"encoding/json"
 	"github.com/pkg/errors"
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
 )
 
 type authorizationLambdaIdentity struct {
@@ -28,6 +41,7 @@ type LkpUserCertAuthorizationRequest struct {
 	RemoteInstanceArn string
 	SshUsername       string
 	Vouchers          []authorizationLambdaVoucher `json:",omitempty"`
+	RequestedValidityDuration int64 `json:",omitempty"`
 }
 
 type LkpUserCertAuthorizationResponse struct {
@@ -37,6 +51,22 @@ type LkpUserCertAuthorizationResponse struct {
 	Jumpboxes  []Jumpbox `json:",omitempty"`
 	TargetAddress string `json:",omitempty"`
 	CertificateOptions *CertificateOptions
+	// both in seconds. ValidityDuration replaces the CA's default and
+	// MaxValidityDuration caps whatever the user asked for.
+	ValidityDuration    *int64 `json:",omitempty"`
+	MaxValidityDuration *int64 `json:",omitempty"`
+}
+
+// validate denies responses whose durations would otherwise be silently
+// ignored or clamped, as they're probably a bug in the authorizer.
+func (r *LkpUserCertAuthorizationResponse) validate() error {
+	if r.ValidityDuration != nil && *r.ValidityDuration <= 0 {
+		return errors.Wrapf(ErrUnauthorized, "malformed authorizer response: ValidityDuration of %d", *r.ValidityDuration)
+	}
+	if r.MaxValidityDuration != nil && *r.MaxValidityDuration <= 0 {
+		return errors.Wrapf(ErrUnauthorized, "malformed authorizer response: MaxValidityDuration of %d", *r.MaxValidityDuration)
+	}
+	return nil
 }
 
 type LkpHostCertAuthorizationRequest struct {
@@ -48,44 +78,33 @@ type LkpHostCertAuthorizationRequest struct {
 
 type LkpHostCertAuthorizationResponse struct {
 	Authorized bool
+	Message    string `json:",omitempty"`
 	KeyId      string
 	Principals []string
+	// both in seconds. ValidityDuration overrides the CA's default, and zero
+	// means the cert never expires. MaxValidityDuration caps it.
+	ValidityDuration    *int64 `json:",omitempty"`
+	MaxValidityDuration *int64 `json:",omitempty"`
 }
 
-type AuthorizationLambda struct {
-	config LambdaConfig
-}
-
-func NewAuthorizationLambda(config LambdaConfig) *AuthorizationLambda {
-	return &AuthorizationLambda{config: config}
-}
-
-func (a *AuthorizationLambda) doLambda(req interface{}, resp interface{}) error {
-	client := lambda.New(LambdaAwsSession())
-
-	encoded, err := json.Marshal(&req)
-	if err != nil {
-		return errors.Wrap(err, "encoding authorisation lambda request")
+func (r *LkpHostCertAuthorizationResponse) validate() error {
+	if r.ValidityDuration != nil && *r.ValidityDuration < 0 {
+		return errors.Wrapf(ErrUnauthorized, "malformed authorizer response: ValidityDuration of %d", *r.ValidityDuration)
 	}
-
-	input := &lambda.InvokeInput{
-		FunctionName: &a.config.AuthorizationLambda,
-		Payload:      encoded,
+	if r.MaxValidityDuration != nil && *r.MaxValidityDuration <= 0 {
+		return errors.Wrapf(ErrUnauthorized, "malformed authorizer response: MaxValidityDuration of %d", *r.MaxValidityDuration)
 	}
-
-	lambdaResp, err := client.Invoke(input)
-	if err != nil {
-		return errors.Wrap(err, "executing authorisation lambda")
-	}
-
-	err = json.Unmarshal(lambdaResp.Payload, resp)
-	if err != nil {
-		return errors.Wrap(err, "decoding auth lambda response")
-	}
-
 	return nil
 }
 
+// Authorizer decides whether a certificate should be issued, and with what
+// principals and options. Requests are only passed to an Authorizer once
+// their token has been validated.
+type Authorizer interface {
+	AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error)
+	AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error)
+}
+
 func tokenParamsToAuthLambdaIdentity(p TokenParams) authorizationLambdaIdentity {
 	return authorizationLambdaIdentity{
 		Name:    &p.FromName,
@@ -95,20 +114,14 @@ func tokenParamsToAuthLambdaIdentity(p TokenParams) authorizationLambdaIdentity
 	}
 }
 
-func (a *AuthorizationLambda) DoUserReq(userReq UserCertReqJson) (*LkpUserCertAuthorizationResponse, error) {
-	if len(a.config.AuthorizationLambda) == 0 {
-		return &LkpUserCertAuthorizationResponse{
-			Authorized: true,
-			Principals: []string{userReq.Token.Params.RemoteInstanceArn},
-		}, nil
-	}
-
+func newUserCertAuthorizationRequest(userReq UserCertReqJson) LkpUserCertAuthorizationRequest {
 	p := userReq.Token.Params
 	req := LkpUserCertAuthorizationRequest{
 		Kind:              "LkpUserCertAuthorizationRequest",
 		From:              tokenParamsToAuthLambdaIdentity(p),
 		RemoteInstanceArn: p.RemoteInstanceArn,
-		SshUsername:       userReq.Token.Params.SshUsername,
+		SshUsername:       p.SshUsername,
+		RequestedValidityDuration: userReq.ValidityDuration,
 	}
 
 	for _, v := range p.Vouchers {
@@ -124,48 +137,614 @@ func (a *AuthorizationLambda) DoUserReq(userReq UserCertReqJson) (*LkpUserCertAu
 		req.Vouchers = append(req.Vouchers, voucher)
 	}
 
-	authResp := LkpUserCertAuthorizationResponse{}
-	err := a.doLambda(req, &authResp)
+	return req
+}
+
+func newHostCertAuthorizationRequest(hostReq HostCertReqJson) LkpHostCertAuthorizationRequest {
+	p := hostReq.Token.Params
+	return LkpHostCertAuthorizationRequest{
+		Kind:            "LkpHostCertAuthorizationRequest",
+		From:            tokenParamsToAuthLambdaIdentity(p),
+		HostInstanceArn: p.HostInstanceArn,
+		Principals:      p.Principals,
+	}
+}
+
+// authorizeUser asks the configured authorizer about userReq and fills in
+// the defaults that every authorizer gets.
+func (c LambdaConfig) authorizeUser(ctx context.Context, userReq UserCertReqJson) (*LkpUserCertAuthorizationResponse, error) {
+	authResp, err := c.authorizer().AuthorizeUser(ctx, newUserCertAuthorizationRequest(userReq))
 	if err != nil {
-		return nil, errors.Wrap(err, "invoking user cert authorisation lambda")
+		return nil, err
 	}
 
-	// if the lambda's response is missing the "Principals" key, default to the requested instance
+	// if the response is missing the "Principals" key, default to the requested instance
 	if authResp.Principals == nil {
-		authResp.Principals = []string{p.RemoteInstanceArn}
+		authResp.Principals = []string{userReq.Token.Params.RemoteInstanceArn}
 	}
 
-	return &authResp, nil
+	return authResp, nil
+}
+
+func (c LambdaConfig) authorizeHost(ctx context.Context, hostReq HostCertReqJson) (*LkpHostCertAuthorizationResponse, error) {
+	authResp, err := c.authorizer().AuthorizeHost(ctx, newHostCertAuthorizationRequest(hostReq))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authResp.KeyId) == 0 {
+		authResp.KeyId = hostReq.Token.Params.HostInstanceArn
+	}
+
+	return authResp, nil
+}
+
+// authorizer defaults to the authorisation Lambda if there is one, and to
+// denying everything otherwise. Allowing everything has to be asked for, with
+// AllowAllAuthorizer.
+func (c LambdaConfig) authorizer() Authorizer {
+	if c.Authorizer != nil {
+		return c.Authorizer
+	}
+
+	if len(c.AuthorizationLambda) > 0 {
+		return sharedAuthorizer(c.AuthorizationLambda, func() Authorizer {
+			return NewLambdaAuthorizer(c.AuthorizationLambda)
+		})
+	}
+
+	return ChainAuthorizer{}
+}
+
+// AuthorizationLambda asks a LambdaConfig's authorizer, as callers did before
+// authorizers were pluggable.
+//
+// Deprecated: use an Authorizer, e.g. NewLambdaAuthorizer, instead. Unlike
+// before, requests are denied if config has no authorizer.
+type AuthorizationLambda struct {
+	config LambdaConfig
+}
+
+func NewAuthorizationLambda(config LambdaConfig) *AuthorizationLambda {
+	return &AuthorizationLambda{config: config}
+}
+
+func (a *AuthorizationLambda) DoUserReq(userReq UserCertReqJson) (*LkpUserCertAuthorizationResponse, error) {
+	return a.config.authorizeUser(context.Background(), userReq)
 }
 
 func (a *AuthorizationLambda) DoHostReq(hostReq HostCertReqJson) (*LkpHostCertAuthorizationResponse, error) {
-	hostArn := hostReq.Token.Params.HostInstanceArn
+	return a.config.authorizeHost(context.Background(), hostReq)
+}
+
+// AllowAllAuthorizer allows users into the instance they asked for and gives
+// hosts a cert for their own ARN.
+type AllowAllAuthorizer struct{}
 
-	if len(a.config.AuthorizationLambda) == 0 {
-		return &LkpHostCertAuthorizationResponse{
-			Authorized: true,
-			KeyId:      hostArn,
-			Principals: []string{hostArn},
-		}, nil
+func (AllowAllAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	return &LkpUserCertAuthorizationResponse{
+		Authorized: true,
+		Principals: []string{req.RemoteInstanceArn},
+	}, nil
+}
+
+func (AllowAllAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	return &LkpHostCertAuthorizationResponse{
+		Authorized: true,
+		KeyId:      req.HostInstanceArn,
+		Principals: []string{req.HostInstanceArn},
+	}, nil
+}
+
+// LambdaAuthorizer invokes a Lambda function with the request as its event
+// and the response as its result. See docs/access-policy.md.
+//
+// Anything other than a response from the function, including a function
+// error, denies the request with ErrAuthorizerUnavailable. Invocations that
+// are throttled, fail with a 5xx or take longer than Timeout are retried up
+// to Retries times. After BreakerThreshold requests in a row fail that way,
+// requests are denied without invoking the function until BreakerCooldown
+// has passed, and then a single request is let through to see whether the
+// function has recovered. Function errors and requests cancelled by the
+// caller don't count, as they say nothing about the function's health.
+type LambdaAuthorizer struct {
+	functionName string
+
+	Timeout          time.Duration // of each attempt, zero for no limit
+	Retries          int
+	BreakerThreshold int // zero never stops invoking the function
+	BreakerCooldown  time.Duration
+
+	mu        sync.Mutex
+	client    lambdaiface.LambdaAPI
+	failures  int
+	openUntil time.Time
+	probing   bool // a request is checking whether the function has recovered
+	backoff   time.Duration // before the first retry, doubling each time
+	now       func() time.Time
+}
+
+func NewLambdaAuthorizer(functionName string) *LambdaAuthorizer {
+	return &LambdaAuthorizer{
+		functionName:     functionName,
+		Timeout:          5 * time.Second,
+		Retries:          2,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		backoff:          100 * time.Millisecond,
+		now:              time.Now,
 	}
+}
 
-	p := hostReq.Token.Params
-	req := LkpHostCertAuthorizationRequest{
-		Kind:            "LkpHostCertAuthorizationRequest",
-		From:            tokenParamsToAuthLambdaIdentity(p),
-		HostInstanceArn: hostArn,
-		Principals:      p.Principals,
+func (a *LambdaAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	authResp := LkpUserCertAuthorizationResponse{}
+	err := a.invoke(ctx, req, &authResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "invoking user cert authorisation lambda")
 	}
+	return &authResp, nil
+}
 
+func (a *LambdaAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
 	authResp := LkpHostCertAuthorizationResponse{}
-	err := a.doLambda(req, &authResp)
+	err := a.invoke(ctx, req, &authResp)
 	if err != nil {
 		return nil, errors.Wrap(err, "invoking host cert authorisation lambda")
 	}
+	return &authResp, nil
+}
 
-	if len(authResp.KeyId) == 0 {
-		authResp.KeyId = hostArn
+func (a *LambdaAuthorizer) invoke(ctx context.Context, req interface{}, resp interface{}) error {
+	encoded, err := json.Marshal(&req)
+	if err != nil {
+		return errors.Wrap(err, "encoding authorisation lambda request")
+	}
+
+	client, err := a.lambdaClient()
+	if err != nil {
+		return err
+	}
+
+	probe, err := a.allow()
+	if err != nil {
+		return err
+	}
+
+	payload, unhealthy, err := a.invokeWithRetries(ctx, client, encoded)
+	a.record(probe, err, unhealthy)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(payload, resp)
+	if err != nil {
+		return errors.Wrap(ErrAuthorizerUnavailable, "decoding auth lambda response: " + err.Error())
+	}
+
+	return nil
+}
+
+// lambdaClient is created once, as creating a session for each request is
+// slow and each client has its own connection pool. Retries are left to
+// invokeWithRetries.
+func (a *LambdaAuthorizer) lambdaClient() (lambdaiface.LambdaAPI, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		sess, err := LambdaAwsSession()
+		if err != nil {
+			return nil, err
+		}
+		a.client = lambdaClientForKeyId(sess.Copy(aws.NewConfig().WithMaxRetries(0)), a.functionName)
+	}
+
+	return a.client, nil
+}
+
+// invokeWithRetries also returns whether a failure means the function is
+// unhealthy, i.e. it was throttled, failed with a 5xx or timed out.
+func (a *LambdaAuthorizer) invokeWithRetries(ctx context.Context, client lambdaiface.LambdaAPI, payload []byte) ([]byte, bool, error) {
+	input := &lambda.InvokeInput{
+		FunctionName: &a.functionName,
+		Payload:      payload,
+	}
+
+	backoff := a.backoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if a.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, a.Timeout)
+		}
+		lambdaResp, err := client.InvokeWithContext(attemptCtx, input)
+		cancel()
+
+		if err == nil && lambdaResp.FunctionError != nil {
+			// the function ran and failed, so running it again is unlikely to help
+			return nil, false, errors.Wrapf(ErrAuthorizerUnavailable, "authorisation lambda failed: %s: %s", *lambdaResp.FunctionError, string(lambdaResp.Payload))
+		} else if err == nil {
+			return lambdaResp.Payload, false, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, false, errors.Wrap(ErrAuthorizerUnavailable, "executing authorisation lambda: " + ctx.Err().Error())
+		}
+
+		unhealthy := retryableLambdaError(err)
+		if attempt >= a.Retries || !unhealthy {
+			return nil, unhealthy, errors.Wrap(ErrAuthorizerUnavailable, "executing authorisation lambda: " + err.Error())
+		}
+
+		// full jitter, so that a burst of throttled requests doesn't retry in step
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff) + 1))):
+		case <-ctx.Done():
+			return nil, false, errors.Wrap(ErrAuthorizerUnavailable, "executing authorisation lambda: " + ctx.Err().Error())
+		}
+		backoff *= 2
+	}
+}
+
+// retryableLambdaError is true for throttling, server errors and attempts
+// that ran out of time.
+func retryableLambdaError(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case lambda.ErrCodeTooManyRequestsException, lambda.ErrCodeServiceException, request.CanceledErrorCode:
+		return true
+	}
+	return false
+}
+
+// allow fails fast while the circuit breaker is open. Once the cooldown has
+// passed, it lets one request through as a probe, and fails the rest fast
+// until that request has finished.
+func (a *LambdaAuthorizer) allow() (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.BreakerThreshold <= 0 || a.failures < a.BreakerThreshold {
+		return false, nil
+	}
+
+	if a.now().Before(a.openUntil) {
+		return false, errors.Wrapf(ErrAuthorizerUnavailable, "authorisation lambda failed %d times in a row, not invoking it again until %s", a.failures, a.openUntil.Format(time.RFC3339))
+	}
+
+	if a.probing {
+		return false, errors.Wrap(ErrAuthorizerUnavailable, "authorisation lambda failed recently, waiting to see whether it has recovered")
+	}
+
+	a.probing = true
+	return true, nil
+}
+
+// record counts unhealthy failures in a row, and opens the breaker when
+// there are BreakerThreshold of them, including when a probe fails. Other
+// failures neither count nor reset the count.
+func (a *LambdaAuthorizer) record(probe bool, err error, unhealthy bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if probe {
+		a.probing = false
+	}
+
+	if err == nil {
+		a.failures = 0
+		return
+	}
+
+	if !unhealthy {
+		return
+	}
+
+	a.failures++
+	if a.BreakerThreshold > 0 && a.failures >= a.BreakerThreshold {
+		a.openUntil = a.now().Add(a.BreakerCooldown)
+	}
+}
+
+// WebhookAuthorizer POSTs the request as JSON to an HTTPS endpoint and reads
+// the response from the body, in the same format as the Lambda's. If it has
+// a secret, requests are signed as described in docs/access-policy.md.
+type WebhookAuthorizer struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookAuthorizer(webhookUrl string, secret []byte) (*WebhookAuthorizer, error) {
+	parsed, err := url.Parse(webhookUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing authorizer webhook url")
+	} else if parsed.Scheme != "https" {
+		return nil, errors.Errorf("authorizer webhook url %s must be https", webhookUrl)
+	}
+
+	return &WebhookAuthorizer{
+		url:    webhookUrl,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (a *WebhookAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	authResp := LkpUserCertAuthorizationResponse{}
+	err := postJSON(ctx, a.client, a.url, a.secret, req, &authResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "calling user cert authorizer webhook")
+	}
+	return &authResp, nil
+}
+
+func (a *WebhookAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	authResp := LkpHostCertAuthorizationResponse{}
+	err := postJSON(ctx, a.client, a.url, a.secret, req, &authResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "calling host cert authorizer webhook")
 	}
+	return &authResp, nil
+}
+
+// ExecAuthorizer runs a command for each request, with the request as JSON
+// on its stdin. It must write the response as JSON to stdout and exit zero.
+type ExecAuthorizer struct {
+	command []string
+	timeout time.Duration
+}
+
+func NewExecAuthorizer(command ...string) *ExecAuthorizer {
+	return &ExecAuthorizer{command: command, timeout: 10 * time.Second}
+}
+
+func (a *ExecAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	authResp := LkpUserCertAuthorizationResponse{}
+	err := a.run(ctx, req, &authResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "running user cert authorizer")
+	}
+	return &authResp, nil
+}
 
+func (a *ExecAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	authResp := LkpHostCertAuthorizationResponse{}
+	err := a.run(ctx, req, &authResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "running host cert authorizer")
+	}
 	return &authResp, nil
 }
+
+func (a *ExecAuthorizer) run(ctx context.Context, req interface{}, resp interface{}) error {
+	if len(a.command) == 0 {
+		return errors.New("no authorizer command configured")
+	}
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "encoding authorizer request")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(a.command[0], a.command[1:]...)
+	cmd.Stdin = bytes.NewReader(encoded)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = startInProcessGroup(cmd)
+	if err != nil {
+		return errors.Wrap(err, "starting authorizer")
+	}
+
+	// Wait doesn't return until every process holding stdout has exited, so
+	// the whole group is killed rather than just the command itself
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "authorizer failed: %s", stderr.String())
+	}
+
+	return errors.Wrap(json.Unmarshal(stdout.Bytes(), resp), "decoding authorizer response")
+}
+
+const noAuthorizersMessage = "no authorizer is configured, set AUTHORIZER=allow-all to allow every request"
+
+// ChainAuthorizer requires every authorizer to allow a request, and stops at
+// the first that doesn't. An empty chain denies everything. The first authorizer decides what the cert looks
+// like; later ones can only restrict it, by narrowing the principals,
+// options and source addresses or shortening the validity. Requests are
+// denied if the authorizers' restrictions conflict.
+type ChainAuthorizer []Authorizer
+
+func (chain ChainAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	var merged *LkpUserCertAuthorizationResponse
+
+	for _, authorizer := range chain {
+		authResp, err := authorizer.AuthorizeUser(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !authResp.Authorized {
+			return authResp, nil
+		}
+
+		err = authResp.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = authResp
+			continue
+		}
+
+		err = restrictUserResponse(merged, authResp, req.RemoteInstanceArn)
+		if err != nil {
+			return &LkpUserCertAuthorizationResponse{Message: "authorizers disagreed: " + err.Error()}, nil
+		}
+	}
+
+	if merged == nil {
+		return &LkpUserCertAuthorizationResponse{Message: noAuthorizersMessage}, nil
+	}
+	return merged, nil
+}
+
+func (chain ChainAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	var merged *LkpHostCertAuthorizationResponse
+
+	for _, authorizer := range chain {
+		authResp, err := authorizer.AuthorizeHost(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !authResp.Authorized {
+			return authResp, nil
+		}
+
+		err = authResp.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = authResp
+			continue
+		}
+
+		err = restrictHostResponse(merged, authResp)
+		if err != nil {
+			return &LkpHostCertAuthorizationResponse{Message: "authorizers disagreed: " + err.Error()}, nil
+		}
+	}
+
+	if merged == nil {
+		return &LkpHostCertAuthorizationResponse{Message: noAuthorizersMessage}, nil
+	}
+	return merged, nil
+}
+
+// restrictUserResponse narrows merged by a later authorizer's response.
+// Later durations can only cap the validity, as a nil ValidityDuration means
+// the CA's default and it isn't known here.
+func restrictUserResponse(merged, later *LkpUserCertAuthorizationResponse, instanceArn string) error {
+	if later.Principals != nil {
+		merged.Principals = intersectPrincipals(merged.Principals, later.Principals, instanceArn)
+		if len(merged.Principals) == 0 {
+			return errors.New("no principals in common")
+		}
+	}
+
+	merged.MaxValidityDuration = shorterDuration(merged.MaxValidityDuration, later.ValidityDuration)
+	merged.MaxValidityDuration = shorterDuration(merged.MaxValidityDuration, later.MaxValidityDuration)
+
+	if later.Jumpboxes != nil {
+		if merged.Jumpboxes != nil && !reflect.DeepEqual(merged.Jumpboxes, later.Jumpboxes) {
+			return errors.New("different jumpboxes")
+		}
+		merged.Jumpboxes = later.Jumpboxes
+	}
+
+	if len(later.TargetAddress) > 0 {
+		if len(merged.TargetAddress) > 0 && merged.TargetAddress != later.TargetAddress {
+			return errors.Errorf("target addresses %s and %s", merged.TargetAddress, later.TargetAddress)
+		}
+		merged.TargetAddress = later.TargetAddress
+	}
+
+	options, err := restrictCertificateOptions(merged.CertificateOptions, later.CertificateOptions)
+	if err != nil {
+		return err
+	}
+	if merged.CertificateOptions != nil || later.CertificateOptions != nil {
+		merged.CertificateOptions = options
+	}
+
+	return nil
+}
+
+func restrictHostResponse(merged, later *LkpHostCertAuthorizationResponse) error {
+	if later.Principals != nil {
+		merged.Principals = intersectPrincipals(merged.Principals, later.Principals, "")
+		if len(merged.Principals) == 0 {
+			return errors.New("no principals in common")
+		}
+	}
+
+	merged.MaxValidityDuration = shorterHostDuration(merged.MaxValidityDuration, later.ValidityDuration)
+	merged.MaxValidityDuration = shorterHostDuration(merged.MaxValidityDuration, later.MaxValidityDuration)
+
+	if len(later.KeyId) > 0 {
+		if len(merged.KeyId) > 0 && merged.KeyId != later.KeyId {
+			return errors.Errorf("key ids %s and %s", merged.KeyId, later.KeyId)
+		}
+		merged.KeyId = later.KeyId
+	}
+
+	return nil
+}
+
+// intersectPrincipals treats a nil list as def, the principal the CA uses
+// when an authorizer doesn't say.
+func intersectPrincipals(a, b []string, def string) []string {
+	if a == nil && len(def) > 0 {
+		a = []string{def}
+	}
+
+	ret := []string{}
+	for _, p := range a {
+		for _, q := range b {
+			if p == q {
+				ret = append(ret, p)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func shorterDuration(a, b *int64) *int64 {
+	if a == nil || (b != nil && *b < *a) {
+		return b
+	}
+	return a
+}
+
+// shorterHostDuration is shorterDuration, except that zero is forever.
+func shorterHostDuration(a, b *int64) *int64 {
+	if a != nil && *a == 0 {
+		return b
+	}
+	if b != nil && *b == 0 {
+		return a
+	}
+	return shorterDuration(a, b)
+}
@@ -0,0 +1,178 @@
+package lastkeypair
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// CachingAuthorizer remembers another authorizer's decisions, both allows
+// and denials, for ttl. Decisions are keyed on the whole request, i.e. the
+// requester, the instance, the username and who has vouched for them, so a
+// user with a new voucher gets a fresh decision. Errors aren't cached.
+type CachingAuthorizer struct {
+	authorizer Authorizer
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedDecision
+	now     func() time.Time
+}
+
+type cachedDecision struct {
+	user    *LkpUserCertAuthorizationResponse
+	host    *LkpHostCertAuthorizationResponse
+	expires time.Time
+}
+
+func NewCachingAuthorizer(authorizer Authorizer, ttl time.Duration) *CachingAuthorizer {
+	return &CachingAuthorizer{
+		authorizer: authorizer,
+		ttl:        ttl,
+		entries:    map[string]cachedDecision{},
+		now:        time.Now,
+	}
+}
+
+func (a *CachingAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	key := cacheKey(req)
+	if cached, ok := a.get(key); ok && cached.user != nil {
+		return copyUserResponse(cached.user), nil
+	}
+
+	resp, err := a.authorizer.AuthorizeUser(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	a.put(key, cachedDecision{user: copyUserResponse(resp)})
+	return resp, nil
+}
+
+func (a *CachingAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	key := cacheKey(req)
+	if cached, ok := a.get(key); ok && cached.host != nil {
+		return copyHostResponse(cached.host), nil
+	}
+
+	resp, err := a.authorizer.AuthorizeHost(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	a.put(key, cachedDecision{host: copyHostResponse(resp)})
+	return resp, nil
+}
+
+// copyUserResponse is a deep copy, as the CA fills in and signs jumpboxes in
+// place, which mustn't leak into the cache or another request.
+func copyUserResponse(resp *LkpUserCertAuthorizationResponse) *LkpUserCertAuthorizationResponse {
+	c := *resp
+	c.Principals = copyStrings(resp.Principals)
+	c.CertificateOptions = copyCertificateOptions(resp.CertificateOptions)
+	c.ValidityDuration = copyInt64(resp.ValidityDuration)
+	c.MaxValidityDuration = copyInt64(resp.MaxValidityDuration)
+
+	if resp.Jumpboxes != nil {
+		c.Jumpboxes = make([]Jumpbox, len(resp.Jumpboxes))
+		for idx, j := range resp.Jumpboxes {
+			j.Principals = copyStrings(j.Principals)
+			j.CertificateOptions = copyCertificateOptions(j.CertificateOptions)
+			c.Jumpboxes[idx] = j
+		}
+	}
+
+	return &c
+}
+
+func copyHostResponse(resp *LkpHostCertAuthorizationResponse) *LkpHostCertAuthorizationResponse {
+	c := *resp
+	c.Principals = copyStrings(resp.Principals)
+	c.ValidityDuration = copyInt64(resp.ValidityDuration)
+	c.MaxValidityDuration = copyInt64(resp.MaxValidityDuration)
+	return &c
+}
+
+func copyCertificateOptions(o *CertificateOptions) *CertificateOptions {
+	if o == nil {
+		return nil
+	}
+
+	c := *o
+	c.ForceCommand = copyString(o.ForceCommand)
+	c.SourceAddress = copyString(o.SourceAddress)
+	c.PermitPty = copyBool(o.PermitPty)
+	c.PermitUserRc = copyBool(o.PermitUserRc)
+	c.CriticalOptions = copyStringMap(o.CriticalOptions)
+	c.Extensions = copyStringMap(o.Extensions)
+	return &c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := map[string]string{}
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func copyBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	c := *b
+	return &c
+}
+
+func copyInt64(i *int64) *int64 {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	return &c
+}
+
+// cacheKey is the request's JSON, which includes its Kind, so user and host
+// requests never collide.
+func cacheKey(req interface{}) string {
+	encoded, _ := json.Marshal(req)
+	return string(encoded)
+}
+
+func (a *CachingAuthorizer) get(key string) (cachedDecision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cached, ok := a.entries[key]
+	if !ok || !a.now().Before(cached.expires) {
+		return cachedDecision{}, false
+	}
+	return cached, true
+}
+
+func (a *CachingAuthorizer) put(key string, decision cachedDecision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for k, cached := range a.entries {
+		if !now.Before(cached.expires) {
+			delete(a.entries, k)
+		}
+	}
+
+	decision.expires = now.Add(a.ttl)
+	a.entries[key] = decision
+}
@@ -0,0 +1,85 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type countingAuthorizer struct {
+	staticAuthorizer
+	calls int
+}
+
+func (c *countingAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	c.calls++
+	return c.staticAuthorizer.AuthorizeUser(ctx, req)
+}
+
+func TestCachingAuthorizer(t *testing.T) {
+	inner := &countingAuthorizer{staticAuthorizer: staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true}}}
+	authorizer := NewCachingAuthorizer(inner, time.Minute)
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	authorizer.now = func() time.Time { return now }
+
+	req := LkpUserCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Id: "AIDAEXAMPLE", Account: "9876543210", Type: "User"},
+		RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd",
+		SshUsername: "ec2-user",
+	}
+
+	resp, err := authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+
+	// callers fill in defaults, which mustn't leak into the cache
+	resp.Principals = []string{"mutated"}
+	resp, err = authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Principals)
+	assert.Equal(t, 1, inner.calls)
+
+	root := req
+	root.SshUsername = "root"
+	authorizer.AuthorizeUser(context.Background(), root)
+	assert.Equal(t, 2, inner.calls)
+
+	vouched := req
+	vouched.Vouchers = []authorizationLambdaVoucher{{Id: "AIDAOTHER", Account: "9876543210", Type: "User"}}
+	authorizer.AuthorizeUser(context.Background(), vouched)
+	assert.Equal(t, 3, inner.calls)
+
+	now = now.Add(time.Minute)
+	authorizer.AuthorizeUser(context.Background(), req)
+	assert.Equal(t, 4, inner.calls)
+	assert.Len(t, authorizer.entries, 1)
+}
+
+func TestCachingAuthorizerDoesNotShareJumpboxes(t *testing.T) {
+	config := testCaConfig(t)
+	config.Authorizer = NewCachingAuthorizer(staticAuthorizer{user: &LkpUserCertAuthorizationResponse{
+		Authorized: true,
+		Jumpboxes: []Jumpbox{{Address: "12.34.56.78", User: "ec2-user", Principals: []string{"jump"}}},
+	}}, time.Minute)
+
+	params := testTokenParams()
+	first, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, testKeyPair(t, &params)), config)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, first.Jumpboxes[0].SignedPublicKey)
+
+	simulate := testUserCertReq(t, params, testKeyPair(t, &params))
+	simulate.EventType = "SimulateUserCertReq"
+	simulated, err := DoSimulateUserCertReq(context.Background(), simulate, config)
+	assert.Nil(t, err)
+	assert.Empty(t, simulated.Jumpboxes[0].SignedPublicKey)
+
+	kp := testKeyPair(t, &params)
+	second, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Jumpboxes[0].SignedPublicKey, second.Jumpboxes[0].SignedPublicKey)
+	cert := parseTestCert(t, second.Jumpboxes[0].SignedPublicKey)
+	assert.Equal(t, string(kp.PublicKey), string(ssh.MarshalAuthorizedKey(cert.Key)))
+	assert.Equal(t, []string{"jump"}, second.Jumpboxes[0].Principals)
+}
@@ -0,0 +1,20 @@
+// +build !windows
+
+package lastkeypair
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startInProcessGroup starts cmd in a process group of its own, so that
+// killProcessGroup also kills anything it started, e.g. the children of
+// /bin/sh -c.
+func startInProcessGroup(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd.Start()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
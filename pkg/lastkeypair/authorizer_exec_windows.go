@@ -0,0 +1,15 @@
+package lastkeypair
+
+import (
+	"os/exec"
+)
+
+// startInProcessGroup is just Start, as Windows has no process groups to
+// speak of. The CA only runs on Linux anyway.
+func startInProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,416 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookAuthorizer(t *testing.T) {
+	secret := []byte("webhook secret")
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, webhookSignature(secret, body), r.Header.Get(webhookSignatureHeader))
+
+		req := LkpUserCertAuthorizationRequest{}
+		assert.Nil(t, json.Unmarshal(body, &req))
+
+		json.NewEncoder(w).Encode(LkpUserCertAuthorizationResponse{
+			Authorized: req.SshUsername == "ec2-user",
+			Principals: []string{"ec2-user"},
+		})
+	}))
+	defer server.Close()
+
+	authorizer, err := NewWebhookAuthorizer(server.URL, secret)
+	assert.Nil(t, err)
+	// the test server's certificate is self-signed
+	authorizer.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	resp, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{SshUsername: "ec2-user"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, []string{"ec2-user"}, resp.Principals)
+
+	resp, err = authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{SshUsername: "root"})
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+
+	_, err = NewWebhookAuthorizer("http://example.com/authorize", secret)
+	assert.NotNil(t, err)
+}
+
+func TestExecAuthorizer(t *testing.T) {
+	allow := NewExecAuthorizer("/bin/sh", "-c", `cat >/dev/null; echo '{"Authorized": true, "KeyId": "from-script"}'`)
+	resp, err := allow.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{HostInstanceArn: "arn"})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, "from-script", resp.KeyId)
+
+	fail := NewExecAuthorizer("/bin/sh", "-c", "echo oops >&2; exit 1")
+	_, err = fail.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{})
+	assert.Contains(t, err.Error(), "oops")
+	// sh's children are killed too, or they'd hold stdout open until they exit
+	slow := NewExecAuthorizer("/bin/sh", "-c", "sleep 30; echo '{}'")
+	slow.timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = slow.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5 * time.Second, "took %s", time.Since(start))
+}
+
+func TestChainAuthorizer(t *testing.T) {
+	seconds := func(n int64) *int64 { return &n }
+	req := LkpUserCertAuthorizationRequest{RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"}
+
+	first := staticAuthorizer{user: &LkpUserCertAuthorizationResponse{
+		Authorized: true,
+		Principals: []string{req.RemoteInstanceArn, "bastion"},
+		TargetAddress: "10.0.0.1",
+		MaxValidityDuration: seconds(3600),
+	}}
+	second := staticAuthorizer{user: &LkpUserCertAuthorizationResponse{
+		Authorized: true,
+		Principals: []string{req.RemoteInstanceArn},
+		MaxValidityDuration: seconds(600),
+	}}
+	deny := staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Message: "not on call"}}
+
+	resp, err := ChainAuthorizer{first, second}.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, []string{req.RemoteInstanceArn}, resp.Principals)
+	assert.Equal(t, "10.0.0.1", resp.TargetAddress)
+	assert.Equal(t, int64(600), *resp.MaxValidityDuration)
+
+	resp, err = ChainAuthorizer{first, deny, second}.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+	assert.Equal(t, "not on call", resp.Message)
+}
+
+func TestChainAuthorizerCannotLengthenCerts(t *testing.T) {
+	seconds := func(n int64) *int64 { return &n }
+
+	config := testCaConfig(t)
+	config.Authorizer = ChainAuthorizer{
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true}},
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, ValidityDuration: seconds(86400)}},
+	}
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	resp, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Nil(t, err)
+	assert.InDelta(t, time.Now().Unix() + config.ValidityDuration, resp.Expiry, 5)
+
+	config.Authorizer = ChainAuthorizer{
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true}},
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, ValidityDuration: seconds(600)}},
+	}
+	resp, err = DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Nil(t, err)
+	assert.InDelta(t, time.Now().Unix() + 600, resp.Expiry, 5)
+}
+
+func TestChainAuthorizerRestrictsOptions(t *testing.T) {
+	req := LkpUserCertAuthorizationRequest{RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"}
+	chain := func(first, second *CertificateOptions) *LkpUserCertAuthorizationResponse {
+		resp, err := ChainAuthorizer{
+			staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, CertificateOptions: first}},
+			staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, CertificateOptions: second}},
+		}.AuthorizeUser(context.Background(), req)
+		assert.Nil(t, err)
+		return resp
+	}
+	str := func(s string) *string { return &s }
+
+	resp := chain(nil, &CertificateOptions{
+		SourceAddress: str("10.1.0.0/16"),
+		PermitPortForwarding: true,
+		CriticalOptions: map[string]string{"audit@example.com": "yes"},
+	})
+	assert.True(t, resp.Authorized)
+	permissions, err := GenerateSshPermissions(resp.CertificateOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"source-address": "10.1.0.0/16", "audit@example.com": "yes"}, permissions.CriticalOptions)
+	assert.Equal(t, map[string]string{"permit-port-forwarding": "", "permit-pty": "", "permit-user-rc": ""}, permissions.Extensions)
+
+	// no options is no opinion, so custom extensions survive it either way round
+	custom := &CertificateOptions{PermitPortForwarding: true, Extensions: map[string]string{"login@github.com": "aidan"}}
+	for _, pair := range [][2]*CertificateOptions{{custom, nil}, {nil, custom}} {
+		resp = chain(pair[0], pair[1])
+		assert.True(t, resp.Authorized)
+		permissions, err = GenerateSshPermissions(resp.CertificateOptions)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"permit-port-forwarding": "", "permit-pty": "", "permit-user-rc": "", "login@github.com": "aidan"}, permissions.Extensions)
+	}
+
+	resp = chain(&CertificateOptions{SourceAddress: str("10.0.0.0/8"), Extensions: map[string]string{"login@github.com": "aidan"}}, &CertificateOptions{SourceAddress: str("10.1.2.3")})
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, "10.1.2.3", *resp.CertificateOptions.SourceAddress)
+	assert.Nil(t, resp.CertificateOptions.Extensions)
+
+	for _, conflicting := range [][2]*CertificateOptions{
+		{{SourceAddress: str("10.0.0.0/8")}, {SourceAddress: str("192.168.0.0/16")}},
+		{{ForceCommand: str("uptime")}, {ForceCommand: str("id")}},
+		{{CriticalOptions: map[string]string{"audit@example.com": "yes"}}, {CriticalOptions: map[string]string{"audit@example.com": "no"}}},
+	} {
+		resp = chain(conflicting[0], conflicting[1])
+		assert.False(t, resp.Authorized)
+	}
+
+	resp, err = ChainAuthorizer{
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, TargetAddress: "10.0.0.1"}},
+		staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Authorized: true, TargetAddress: "10.0.0.2"}},
+	}.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+}
+
+func TestChainAuthorizerHost(t *testing.T) {
+	seconds := func(n int64) *int64 { return &n }
+	req := LkpHostCertAuthorizationRequest{HostInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"}
+	host := func(keyId string, validity *int64, principals ...string) staticAuthorizer {
+		return staticAuthorizer{host: &LkpHostCertAuthorizationResponse{Authorized: true, KeyId: keyId, Principals: principals, ValidityDuration: validity}}
+	}
+
+	resp, err := ChainAuthorizer{
+		host("", nil, req.HostInstanceArn, "bastion.example.com"),
+		host("bastion", seconds(86400), req.HostInstanceArn),
+	}.AuthorizeHost(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, "bastion", resp.KeyId)
+	assert.Equal(t, []string{req.HostInstanceArn}, resp.Principals)
+	assert.Nil(t, resp.ValidityDuration)
+	assert.Equal(t, int64(86400), *resp.MaxValidityDuration)
+
+	resp, err = ChainAuthorizer{
+		host("bastion", nil, req.HostInstanceArn),
+		host("jumpbox", nil, req.HostInstanceArn),
+	}.AuthorizeHost(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+}
+
+func TestUnconfiguredAuthorizerDenies(t *testing.T) {
+	config := testCaConfig(t)
+	config.Authorizer = nil
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	_, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Equal(t, ErrUnauthorized, errors.Cause(err))
+	assert.Contains(t, err.Error(), "AUTHORIZER=allow-all")
+
+	resp, err := ChainAuthorizer{}.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{})
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+}
+
+func TestAuthorizationLambdaUsesConfiguredAuthorizer(t *testing.T) {
+	config := testCaConfig(t)
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	resp, err := NewAuthorizationLambda(config).DoUserReq(testUserCertReq(t, params, kp))
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, []string{params.RemoteInstanceArn}, resp.Principals)
+}
+
+func TestUserCertReqUsesConfiguredAuthorizer(t *testing.T) {
+	config := testCaConfig(t)
+	config.Authorizer = staticAuthorizer{user: &LkpUserCertAuthorizationResponse{Message: "go away"}}
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	_, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Equal(t, ErrUnauthorized, errors.Cause(err))
+	assert.Contains(t, err.Error(), "go away")
+}
+
+// fakeLambdaClient returns each of outputs in turn, then the last one again.
+// A nil output blocks until the invocation times out.
+type fakeLambdaClient struct {
+	lambdaiface.LambdaAPI
+	outputs     []fakeLambdaOutput
+	invocations int
+}
+
+type fakeLambdaOutput struct {
+	resp *lambda.InvokeOutput
+	err  error
+}
+
+func (f *fakeLambdaClient) InvokeWithContext(ctx aws.Context, input *lambda.InvokeInput, opts ...request.Option) (*lambda.InvokeOutput, error) {
+	out := f.outputs[len(f.outputs)-1]
+	if f.invocations < len(f.outputs) {
+		out = f.outputs[f.invocations]
+	}
+	f.invocations++
+
+	if out.resp == nil && out.err == nil {
+		<-ctx.Done()
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	return out.resp, out.err
+}
+
+func testLambdaAuthorizer(outputs ...fakeLambdaOutput) (*LambdaAuthorizer, *fakeLambdaClient) {
+	client := &fakeLambdaClient{outputs: outputs}
+	authorizer := NewLambdaAuthorizer("authorizer")
+	authorizer.client = client
+	authorizer.backoff = time.Millisecond
+	return authorizer, client
+}
+
+func TestLambdaAuthorizerRetries(t *testing.T) {
+	allowed := fakeLambdaOutput{resp: &lambda.InvokeOutput{Payload: []byte(`{"Authorized": true}`)}}
+	throttled := fakeLambdaOutput{err: awserr.New(lambda.ErrCodeTooManyRequestsException, "Rate exceeded", nil)}
+
+	authorizer, client := testLambdaAuthorizer(throttled, throttled, allowed)
+	resp, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, 3, client.invocations)
+
+	authorizer, client = testLambdaAuthorizer(throttled)
+	_, err = authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	assert.Equal(t, 3, client.invocations)
+
+	authorizer, client = testLambdaAuthorizer(fakeLambdaOutput{}, allowed)
+	authorizer.Timeout = 10 * time.Millisecond
+	resp, err = authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, 2, client.invocations)
+
+	denied := fakeLambdaOutput{err: awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found", nil)}
+	authorizer, client = testLambdaAuthorizer(denied)
+	_, err = authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	assert.Equal(t, 1, client.invocations)
+}
+
+func TestLambdaAuthorizerFunctionErrorFailsClosed(t *testing.T) {
+	crashed := fakeLambdaOutput{resp: &lambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage": "Task timed out after 3.00 seconds"}`),
+	}}
+
+	authorizer, client := testLambdaAuthorizer(crashed)
+	config := LambdaConfig{Authorizer: authorizer}
+
+	resp, err := config.authorizeUser(context.Background(), UserCertReqJson{})
+	assert.Nil(t, resp)
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	assert.Contains(t, err.Error(), "Task timed out")
+	assert.Equal(t, 1, client.invocations)
+}
+
+func TestLambdaAuthorizerCircuitBreaker(t *testing.T) {
+	failed := fakeLambdaOutput{err: awserr.New(lambda.ErrCodeServiceException, "oops", nil)}
+	allowed := fakeLambdaOutput{resp: &lambda.InvokeOutput{Payload: []byte(`{"Authorized": true}`)}}
+
+	authorizer, client := testLambdaAuthorizer(failed, failed, failed, allowed)
+	authorizer.Retries = 0
+	authorizer.BreakerThreshold = 3
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	authorizer.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+		assert.NotNil(t, err)
+	}
+
+	// open, so the function isn't invoked
+	_, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	assert.Equal(t, 3, client.invocations)
+
+	// half open, so only one request is let through to probe the function
+	now = now.Add(authorizer.BreakerCooldown)
+	probe, err := authorizer.allow()
+	assert.True(t, probe)
+	assert.Nil(t, err)
+	_, err = authorizer.allow()
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+
+	// a failed probe opens the breaker again
+	authorizer.record(probe, err, true)
+	_, err = authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	assert.Equal(t, 3, client.invocations)
+
+	now = now.Add(authorizer.BreakerCooldown)
+	resp, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, 0, authorizer.failures)
+}
+
+func TestLambdaAuthorizerBreakerIgnoresRequestFailures(t *testing.T) {
+	crashed := fakeLambdaOutput{resp: &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{}`)}}
+
+	authorizer, client := testLambdaAuthorizer(crashed)
+	authorizer.BreakerThreshold = 3
+	for i := 0; i < 5; i++ {
+		_, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{})
+		assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	}
+	assert.Equal(t, 5, client.invocations)
+	assert.Equal(t, 0, authorizer.failures)
+
+	// the caller giving up isn't the function's fault either
+	authorizer, client = testLambdaAuthorizer(fakeLambdaOutput{})
+	authorizer.BreakerThreshold = 3
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err := authorizer.AuthorizeUser(ctx, LkpUserCertAuthorizationRequest{})
+		cancel()
+		assert.Equal(t, ErrAuthorizerUnavailable, errors.Cause(err))
+	}
+	assert.Equal(t, 5, client.invocations)
+	assert.Equal(t, 0, authorizer.failures)
+}
+
+func TestLambdaAuthorizerIsShared(t *testing.T) {
+	config := LambdaConfig{AuthorizationLambda: "TestLambdaAuthorizerIsShared"}
+	authorizer := config.authorizer()
+	assert.IsType(t, &LambdaAuthorizer{}, authorizer)
+	assert.True(t, authorizer == config.authorizer())
+
+	other := LambdaConfig{AuthorizationLambda: "TestLambdaAuthorizerIsShared-other"}
+	assert.False(t, authorizer == other.authorizer())
+}
+
+func TestLambdaAuthorizerRejectsZeroTimeout(t *testing.T) {
+	settings := lambdaAuthorizerSettings{name: "TestLambdaAuthorizerRejectsZeroTimeout", retries: 2, threshold: 5, cooldown: 30}
+	_, err := settings.authorizer()
+	assert.Contains(t, err.Error(), "AUTHORIZATION_LAMBDA_TIMEOUT")
+
+	settings.timeout = 5
+	authorizer, err := settings.authorizer()
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, authorizer.(*LambdaAuthorizer).Timeout)
+}
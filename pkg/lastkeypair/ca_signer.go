@@ -0,0 +1,147 @@
+package lastkeypair
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// NewLocalCaSigner parses a CA private key in any format ssh.ParsePrivateKey
+// understands. The passphrase is only used if it's non-empty.
+func NewLocalCaSigner(caKeyBytes, passphrase []byte) (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+
+	if len(passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(caKeyBytes, passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(caKeyBytes)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "err parsing ca priv key")
+	}
+
+	return signer, nil
+}
+
+// KmsSigner is an ssh.Signer backed by an asymmetric KMS key with a key usage
+// of SIGN_VERIFY, so the CA private key never leaves KMS. ECC keys produce the
+// usual ecdsa-sha2-* signatures. RSA keys produce rsa-sha2-512 signatures,
+// which need OpenSSH 7.2 or later to verify.
+type KmsSigner struct {
+	client    kmsiface.KMSAPI
+	keyId     string
+	pub       ssh.PublicKey
+	algorithm string
+	hash      crypto.Hash
+	format    string
+}
+
+func NewKmsSigner(sess *session.Session, keyId string) (*KmsSigner, error) {
+	return newKmsSignerWithClient(kmsClientForKeyId(sess, keyId), keyId)
+}
+
+func newKmsSignerWithClient(client kmsiface.KMSAPI, keyId string) (*KmsSigner, error) {
+	resp, err := client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: &keyId})
+	if err != nil {
+		return nil, errors.Wrap(err, "getting ca public key from kms")
+	}
+
+	if aws.StringValue(resp.KeyUsage) != kms.KeyUsageTypeSignVerify {
+		return nil, errors.Errorf("kms key %s is not a signing key", keyId)
+	}
+
+	cryptoPub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ca public key from kms")
+	}
+
+	pub, err := ssh.NewPublicKey(cryptoPub)
+	if err != nil {
+		return nil, errors.Wrap(err, "converting ca public key to ssh format")
+	}
+
+	s := &KmsSigner{client: client, keyId: keyId, pub: pub, format: pub.Type()}
+
+	switch key := cryptoPub.(type) {
+	case *rsa.PublicKey:
+		s.algorithm, s.hash, s.format = kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512, crypto.SHA512, "rsa-sha2-512"
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			s.algorithm, s.hash = kms.SigningAlgorithmSpecEcdsaSha256, crypto.SHA256
+		case elliptic.P384():
+			s.algorithm, s.hash = kms.SigningAlgorithmSpecEcdsaSha384, crypto.SHA384
+		case elliptic.P521():
+			s.algorithm, s.hash = kms.SigningAlgorithmSpecEcdsaSha512, crypto.SHA512
+		default:
+			return nil, errors.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+	default:
+		// i.e. ECC_SECG_P256K1, which ssh doesn't support
+		return nil, errors.Errorf("unsupported kms key type %T", cryptoPub)
+	}
+
+	if !containsString(resp.SigningAlgorithms, s.algorithm) {
+		return nil, errors.Errorf("kms key %s doesn't support %s", keyId, s.algorithm)
+	}
+
+	return s, nil
+}
+
+func (s *KmsSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+// Sign hashes data locally and has KMS sign the digest, so the data itself
+// (the certificate being signed) isn't limited to KMS's 4KB message size.
+func (s *KmsSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	h := s.hash.New()
+	h.Write(data)
+
+	resp, err := s.client.Sign(&kms.SignInput{
+		KeyId:            &s.keyId,
+		Message:          h.Sum(nil),
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: &s.algorithm,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "signing with kms")
+	}
+
+	blob := resp.Signature
+	if s.pub.Type() != ssh.KeyAlgoRSA {
+		// kms returns DER, ssh wants a pair of mpints
+		sig := struct {
+			R, S *big.Int
+		}{}
+		_, err = asn1.Unmarshal(resp.Signature, &sig)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing ecdsa signature from kms")
+		}
+		blob = ssh.Marshal(sig)
+	}
+
+	return &ssh.Signature{Format: s.format, Blob: blob}, nil
+}
+
+func containsString(haystack []*string, needle string) bool {
+	for _, s := range haystack {
+		if aws.StringValue(s) == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeKmsSigningClient struct {
+	kmsiface.KMSAPI
+	key *ecdsa.PrivateKey
+}
+
+func (f *fakeKmsSigningClient) GetPublicKey(input *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	der, err := x509.MarshalPKIXPublicKey(&f.key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kms.GetPublicKeyOutput{
+		KeyId: input.KeyId,
+		KeyUsage: aws.String(kms.KeyUsageTypeSignVerify),
+		PublicKey: der,
+		SigningAlgorithms: aws.StringSlice([]string{kms.SigningAlgorithmSpecEcdsaSha256}),
+	}, nil
+}
+
+func (f *fakeKmsSigningClient) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, f.key, input.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		return nil, err
+	}
+
+	return &kms.SignOutput{KeyId: input.KeyId, Signature: der, SigningAlgorithm: input.SigningAlgorithm}, nil
+}
+
+func TestKmsSignerSignsVerifiableCerts(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	signer, err := newKmsSignerWithClient(&fakeKmsSigningClient{key: key}, "alias/LastKeypairCA")
+	assert.Nil(t, err)
+	assert.Equal(t, ssh.KeyAlgoECDSA256, signer.PublicKey().Type())
+
+	local, err := NewLocalCaSigner(testCaKeyBytes(t), nil)
+	assert.Nil(t, err)
+
+	for _, s := range []ssh.Signer{signer, local} {
+		kp, err := GenerateKeyPair(DefaultKeyType)
+		assert.Nil(t, err)
+
+		signed, err := SignSsh(s, kp.PublicKey, ssh.UserCert, uint64(time.Now().Unix() + 60), DefaultSshPermissions, "aidan", []string{"ec2-user"})
+		assert.Nil(t, err)
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(*signed))
+		assert.Nil(t, err)
+
+		checker := ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(s.PublicKey().Marshal())
+			},
+		}
+		assert.Nil(t, checker.CheckCert("ec2-user", pub.(*ssh.Certificate)))
+	}
+}
+
+func TestCaKeysReqIncludesAdditionalKeys(t *testing.T) {
+	active, err := NewLocalCaSigner(testCaKeyBytes(t), nil)
+	assert.Nil(t, err)
+	next, err := NewLocalCaSigner(testCaKeyBytes(t), nil)
+	assert.Nil(t, err)
+
+	additional, err := parseAuthorizedKeys([]byte(marshalAuthorizedKey(next.PublicKey()) + "\n" + marshalAuthorizedKey(active.PublicKey()) + "\n"))
+	assert.Nil(t, err)
+
+	config := LambdaConfig{CaSigner: active, AdditionalCaPublicKeys: additional}
+	resp, err := DoCaKeysReq(context.Background(), config)
+	assert.Nil(t, err)
+	assert.Equal(t, marshalAuthorizedKey(active.PublicKey()), resp.ActiveKey)
+	assert.Equal(t, []string{resp.ActiveKey, marshalAuthorizedKey(next.PublicKey())}, resp.TrustedKeys)
+}
@@ -0,0 +1,360 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// CertificateOptions are the options that ssh-keygen -O accepts, as per
+// https://man.openbsd.org/ssh-keygen#O. force-command, source-address and
+// verify-required are critical options; everything else is an extension.
+type CertificateOptions struct {
+	ForceCommand   *string `json:",omitempty"`
+	SourceAddress  *string `json:",omitempty"` // comma-separated addresses or CIDRs
+	VerifyRequired bool    `json:",omitempty"` // FIDO keys must verify the user, e.g. by PIN
+
+	// these three default to false when options are given at all, as they
+	// always have.
+	PermitX11Forwarding   bool
+	PermitAgentForwarding bool
+	PermitPortForwarding  bool
+
+	// these default to true, so that they can be turned off
+	PermitPty       *bool `json:",omitempty"`
+	PermitUserRc    *bool `json:",omitempty"`
+	NoTouchRequired bool  `json:",omitempty"` // FIDO keys needn't be touched
+
+	// CriticalOptions and Extensions are custom options, whose names must be
+	// of the form name@domain.
+	CriticalOptions map[string]string `json:",omitempty"`
+	Extensions      map[string]string `json:",omitempty"`
+}
+
+var standardCriticalOptions = []string{"force-command", "source-address", "verify-required"}
+
+var standardExtensions = []string{
+	"no-touch-required",
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// ParseCertificateOptions parses options in ssh-keygen -O syntax, e.g.
+// "no-pty", "source-address=10.0.0.0/8" or "extension:login@example.com=bob".
+// Like ssh-keygen, everything is permitted until "clear" or "no-*" says
+// otherwise.
+func ParseCertificateOptions(opts []string) (*CertificateOptions, error) {
+	o := &CertificateOptions{
+		PermitX11Forwarding:   true,
+		PermitAgentForwarding: true,
+		PermitPortForwarding:  true,
+	}
+
+	setBool := func(ptr **bool, value bool) {
+		*ptr = &value
+	}
+
+	for _, opt := range opts {
+		name, value := opt, ""
+		hasValue := false
+		if idx := strings.Index(opt, "="); idx >= 0 {
+			name, value, hasValue = opt[:idx], opt[idx+1:], true
+		}
+
+		// ssh-keygen matches option names case-insensitively, e.g. permit-x11-forwarding
+		keyword := strings.ToLower(name)
+
+		switch {
+		case keyword == "clear":
+			o.PermitX11Forwarding = false
+			o.PermitAgentForwarding = false
+			o.PermitPortForwarding = false
+			setBool(&o.PermitPty, false)
+			setBool(&o.PermitUserRc, false)
+		case keyword == "force-command" && hasValue:
+			o.ForceCommand = &value
+		case keyword == "source-address" && hasValue:
+			o.SourceAddress = &value
+		case keyword == "verify-required":
+			o.VerifyRequired = true
+		case keyword == "no-touch-required":
+			o.NoTouchRequired = true
+		case keyword == "no-x11-forwarding", keyword == "permit-x11-forwarding":
+			o.PermitX11Forwarding = strings.HasPrefix(keyword, "permit-")
+		case keyword == "no-agent-forwarding", keyword == "permit-agent-forwarding":
+			o.PermitAgentForwarding = strings.HasPrefix(keyword, "permit-")
+		case keyword == "no-port-forwarding", keyword == "permit-port-forwarding":
+			o.PermitPortForwarding = strings.HasPrefix(keyword, "permit-")
+		case keyword == "no-pty", keyword == "permit-pty":
+			setBool(&o.PermitPty, strings.HasPrefix(keyword, "permit-"))
+		case keyword == "no-user-rc", keyword == "permit-user-rc":
+			setBool(&o.PermitUserRc, strings.HasPrefix(keyword, "permit-"))
+		case strings.HasPrefix(keyword, "critical:"):
+			if o.CriticalOptions == nil {
+				o.CriticalOptions = map[string]string{}
+			}
+			o.CriticalOptions[name[len("critical:"):]] = value
+		case strings.HasPrefix(keyword, "extension:"):
+			if o.Extensions == nil {
+				o.Extensions = map[string]string{}
+			}
+			o.Extensions[name[len("extension:"):]] = value
+		default:
+			return nil, errors.Wrapf(ErrBadRequest, "unknown certificate option %q", opt)
+		}
+	}
+
+	return o, o.Validate()
+}
+
+func (o *CertificateOptions) Validate() error {
+	if o.ForceCommand != nil && len(strings.TrimSpace(*o.ForceCommand)) == 0 {
+		return errors.Wrap(ErrBadRequest, "force-command must not be empty")
+	}
+
+	if o.SourceAddress != nil {
+		err := validateSourceAddress(*o.SourceAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range o.CriticalOptions {
+		err := validateCustomOptionName(name, standardCriticalOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range o.Extensions {
+		err := validateCustomOptionName(name, standardExtensions)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateSourceAddress accepts what sshd does: a comma-separated list of
+// addresses and CIDRs.
+func validateSourceAddress(list string) error {
+	for _, addr := range strings.Split(list, ",") {
+		if net.ParseIP(addr) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return errors.Wrapf(ErrBadRequest, "source-address %q is not an address or CIDR", addr)
+		}
+	}
+	return nil
+}
+
+func validateCustomOptionName(name string, standard []string) error {
+	for _, s := range standard {
+		if strings.EqualFold(s, name) {
+			return errors.Wrapf(ErrBadRequest, "%s is a standard option and can't be set as a custom one", name)
+		}
+	}
+
+	at := strings.Index(name, "@")
+	if at <= 0 || at == len(name)-1 || strings.Count(name, "@") != 1 {
+		return errors.Wrapf(ErrBadRequest, "custom certificate option %q must be of the form name@domain", name)
+	}
+	return nil
+}
+
+// permissiveCertificateOptions are what nil options mean.
+func permissiveCertificateOptions() *CertificateOptions {
+	return &CertificateOptions{
+		PermitX11Forwarding:   true,
+		PermitAgentForwarding: true,
+		PermitPortForwarding:  true,
+	}
+}
+
+// restrictCertificateOptions returns options that satisfy both a and b: the
+// union of their critical options and the intersection of their extensions.
+// It fails if they can't both be satisfied, e.g. different force-commands.
+// nil options don't restrict anything, so the other side is kept as it is,
+// custom extensions and all.
+func restrictCertificateOptions(a, b *CertificateOptions) (*CertificateOptions, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+
+	o := &CertificateOptions{
+		VerifyRequired:        a.VerifyRequired || b.VerifyRequired,
+		PermitX11Forwarding:   a.PermitX11Forwarding && b.PermitX11Forwarding,
+		PermitAgentForwarding: a.PermitAgentForwarding && b.PermitAgentForwarding,
+		PermitPortForwarding:  a.PermitPortForwarding && b.PermitPortForwarding,
+		NoTouchRequired:       a.NoTouchRequired && b.NoTouchRequired,
+	}
+
+	permitted := func(ptr *bool) bool {
+		return ptr == nil || *ptr
+	}
+	denied := false
+	if !permitted(a.PermitPty) || !permitted(b.PermitPty) {
+		o.PermitPty = &denied
+	}
+	if !permitted(a.PermitUserRc) || !permitted(b.PermitUserRc) {
+		o.PermitUserRc = &denied
+	}
+
+	o.ForceCommand = a.ForceCommand
+	if b.ForceCommand != nil {
+		if a.ForceCommand != nil && *a.ForceCommand != *b.ForceCommand {
+			return nil, errors.Errorf("force-commands %q and %q conflict", *a.ForceCommand, *b.ForceCommand)
+		}
+		o.ForceCommand = b.ForceCommand
+	}
+
+	var err error
+	o.SourceAddress, err = narrowerSourceAddress(a.SourceAddress, b.SourceAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, custom := range []map[string]string{a.CriticalOptions, b.CriticalOptions} {
+		for name, value := range custom {
+			if o.CriticalOptions == nil {
+				o.CriticalOptions = map[string]string{}
+			}
+			if existing, ok := o.CriticalOptions[name]; ok && existing != value {
+				return nil, errors.Errorf("critical option %s is both %q and %q", name, existing, value)
+			}
+			o.CriticalOptions[name] = value
+		}
+	}
+
+	for name, value := range a.Extensions {
+		if other, ok := b.Extensions[name]; ok && other == value {
+			if o.Extensions == nil {
+				o.Extensions = map[string]string{}
+			}
+			o.Extensions[name] = value
+		}
+	}
+
+	return o, nil
+}
+
+// narrowerSourceAddress returns whichever of a and b only allows addresses
+// that the other does too.
+func narrowerSourceAddress(a, b *string) (*string, error) {
+	if a == nil {
+		return b, nil
+	} else if b == nil {
+		return a, nil
+	}
+
+	aNets, err := sourceAddressNets(*a)
+	if err != nil {
+		return nil, err
+	}
+	bNets, err := sourceAddressNets(*b)
+	if err != nil {
+		return nil, err
+	}
+
+	if netsWithin(bNets, aNets) {
+		return b, nil
+	} else if netsWithin(aNets, bNets) {
+		return a, nil
+	}
+	return nil, errors.Errorf("source-addresses %q and %q conflict", *a, *b)
+}
+
+func sourceAddressNets(list string) ([]*net.IPNet, error) {
+	err := validateSourceAddress(list)
+	if err != nil {
+		return nil, err
+	}
+
+	nets := []*net.IPNet{}
+	for _, addr := range strings.Split(list, ",") {
+		if ip := net.ParseIP(addr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, _ := net.ParseCIDR(addr)
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// netsWithin is true if every network in inner is inside one in outer.
+func netsWithin(inner, outer []*net.IPNet) bool {
+	for _, i := range inner {
+		iOnes, iBits := i.Mask.Size()
+		within := false
+		for _, o := range outer {
+			oOnes, oBits := o.Mask.Size()
+			within = within || (iBits == oBits && oOnes <= iOnes && o.Contains(i.IP))
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateSshPermissions turns options into certificate permissions. nil
+// options permit everything, as ssh-keygen does by default.
+func GenerateSshPermissions(options *CertificateOptions) (ssh.Permissions, error) {
+	permissions := ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+
+	if options == nil {
+		options = permissiveCertificateOptions()
+	}
+
+	err := options.Validate()
+	if err != nil {
+		return permissions, err
+	}
+
+	flag := func(m map[string]string, name string, set bool) {
+		if set {
+			m[name] = ""
+		}
+	}
+
+	if options.ForceCommand != nil {
+		permissions.CriticalOptions["force-command"] = *options.ForceCommand
+	}
+	if options.SourceAddress != nil {
+		permissions.CriticalOptions["source-address"] = *options.SourceAddress
+	}
+	flag(permissions.CriticalOptions, "verify-required", options.VerifyRequired)
+
+	flag(permissions.Extensions, "permit-X11-forwarding", options.PermitX11Forwarding)
+	flag(permissions.Extensions, "permit-agent-forwarding", options.PermitAgentForwarding)
+	flag(permissions.Extensions, "permit-port-forwarding", options.PermitPortForwarding)
+	flag(permissions.Extensions, "permit-pty", options.PermitPty == nil || *options.PermitPty)
+	flag(permissions.Extensions, "permit-user-rc", options.PermitUserRc == nil || *options.PermitUserRc)
+	flag(permissions.Extensions, "no-touch-required", options.NoTouchRequired)
+
+	for name, value := range options.CriticalOptions {
+		permissions.CriticalOptions[name] = value
+	}
+	for name, value := range options.Extensions {
+		permissions.Extensions[name] = value
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,67 @@
+package lastkeypair
+
+import (
+	"testing"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCertificateOptions(t *testing.T) {
+	options, err := ParseCertificateOptions([]string{
+		"clear",
+		"permit-pty",
+		"force-command=/usr/bin/id -un",
+		"source-address=10.0.0.0/8,192.168.1.1",
+		"verify-required",
+		"extension:login@github.com=aidan",
+	})
+	assert.Nil(t, err)
+
+	permissions, err := GenerateSshPermissions(options)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"force-command":   "/usr/bin/id -un",
+		"source-address":  "10.0.0.0/8,192.168.1.1",
+		"verify-required": "",
+	}, permissions.CriticalOptions)
+	assert.Equal(t, map[string]string{
+		"permit-pty":       "",
+		"login@github.com": "aidan",
+	}, permissions.Extensions)
+
+	// names are case-insensitive, as they are to ssh-keygen
+	options, err = ParseCertificateOptions([]string{"CLEAR", "permit-x11-forwarding", "No-Pty", "Extension:Login@GitHub.com=aidan"})
+	assert.Nil(t, err)
+	assert.True(t, options.PermitX11Forwarding)
+	assert.False(t, *options.PermitPty)
+	assert.Equal(t, map[string]string{"Login@GitHub.com": "aidan"}, options.Extensions)
+
+	for _, bad := range []string{"source-address=10.0.0.0/33", "extension:custom", "critical:force-command@", "extension:Permit-PTY", "no-such-option"} {
+		_, err = ParseCertificateOptions([]string{bad})
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestCertificateOptionsDefaults(t *testing.T) {
+	permissions, err := GenerateSshPermissions(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSshPermissions, permissions)
+
+	parsed, err := ParseCertificateOptions(nil)
+	assert.Nil(t, err)
+	permissions, err = GenerateSshPermissions(parsed)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSshPermissions, permissions)
+
+	// auth lambdas that predate the new options get what they always did
+	options := CertificateOptions{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"ForceCommand": "uptime", "PermitPortForwarding": true}`), &options))
+	permissions, err = GenerateSshPermissions(&options)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"force-command": "uptime"}, permissions.CriticalOptions)
+	assert.Equal(t, map[string]string{
+		"permit-port-forwarding": "",
+		"permit-pty":             "",
+		"permit-user-rc":         "",
+	}, permissions.Extensions)
+}
@@ -0,0 +1,300 @@
+package lastkeypair
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Client requests certificates and vouchers from an LKP CA on behalf of the
+// AWS identity it's configured with. It's what the lkp commands use, so other
+// Go programs can do anything lkp can without shelling out to it.
+type Client struct {
+	profile       string
+	region        string
+	lambdaFunc    string
+	kmsKeyId      string
+	tokenIdentity string
+	keyType       KeyType
+	keySource     KeySource
+	cacheDir      string
+
+	sess      *session.Session
+	authority TokenAuthority
+}
+
+type ClientOption func(*Client)
+
+// WithProfile selects a profile from ~/.aws/config.
+func WithProfile(profile string) ClientOption {
+	return func(c *Client) { c.profile = profile }
+}
+
+func WithRegion(region string) ClientOption {
+	return func(c *Client) { c.region = region }
+}
+
+// WithLambdaFunc is the function name or ARN of the CA. It defaults to
+// "LastKeypair".
+func WithLambdaFunc(lambdaFunc string) ClientOption {
+	return func(c *Client) { c.lambdaFunc = lambdaFunc }
+}
+
+// WithKmsKey is the ID, ARN or alias of the KMS key used for tokens. It
+// defaults to "alias/LastKeypair".
+func WithKmsKey(kmsKeyId string) ClientOption {
+	return func(c *Client) { c.kmsKeyId = kmsKeyId }
+}
+
+// WithTokenIdentity must match the CA's KMS_TOKEN_IDENTITY. It defaults to
+// "LastKeypair".
+func WithTokenIdentity(to string) ClientOption {
+	return func(c *Client) { c.tokenIdentity = to }
+}
+
+// WithKeyType selects the type of keypair generated in the cache dir. It
+// defaults to ed25519.
+func WithKeyType(keyType KeyType) ClientOption {
+	return func(c *Client) { c.keyType = keyType }
+}
+
+// WithKeySource overrides where the keypair to be certified comes from. By
+// default it's loaded from (or generated in) the cache dir.
+func WithKeySource(source KeySource) ClientOption {
+	return func(c *Client) { c.keySource = source }
+}
+
+// WithCacheDir overrides ~/.lkp as the place keys, certificates and generated
+// ssh configs are stored.
+func WithCacheDir(dir string) ClientOption {
+	return func(c *Client) { c.cacheDir = dir }
+}
+
+// WithSession uses sess instead of creating one from the profile and region.
+func WithSession(sess *session.Session) ClientOption {
+	return func(c *Client) { c.sess = sess }
+}
+
+// WithTokenAuthority uses authority to issue tokens instead of KMS.
+func WithTokenAuthority(authority TokenAuthority) ClientOption {
+	return func(c *Client) { c.authority = authority }
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		lambdaFunc:    "LastKeypair",
+		kmsKeyId:      "alias/LastKeypair",
+		tokenIdentity: "LastKeypair",
+		keyType:       DefaultKeyType,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.keySource == nil {
+		c.keySource = func() (*Keypair, error) { return KeyPairInDir(c.CacheDir(), c.keyType) }
+	}
+
+	if c.sess == nil {
+		c.sess = ClientAwsSession(c.profile, c.region)
+	}
+
+	if c.authority == nil {
+		c.authority = NewKmsTokenAuthority(c.sess, c.kmsKeyId)
+	}
+
+	return c
+}
+
+func (c *Client) Session() *session.Session {
+	return c.sess
+}
+
+func (c *Client) CacheDir() string {
+	if len(c.cacheDir) == 0 {
+		return AppDir()
+	}
+	return c.cacheDir
+}
+
+func (c *Client) KeyType() KeyType {
+	return c.keyType
+}
+
+func (c *Client) KeyPair() (*Keypair, error) {
+	return c.keySource()
+}
+
+type UserCertRequest struct {
+	InstanceArn string
+	SshUsername string
+	Vouchers    []VoucherToken
+	// ValidityDuration asks for a shorter-lived cert than the CA's default.
+	ValidityDuration time.Duration
+}
+
+// RequestUserCert asks the CA to sign the client's public key for logging
+// into req.InstanceArn. The returned request is needed to write an ssh
+// config for the response.
+func (c *Client) RequestUserCert(ctx context.Context, req UserCertRequest) (*UserCertReqJson, *UserCertRespJson, error) {
+	certReq, err := c.userCertReq(ctx, req, "UserCertReq")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := UserCertRespJson{}
+	err = RequestSignedPayload(ctx, c.sess, c.lambdaFunc, certReq, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certReq, &resp, nil
+}
+
+// SimulateUserCert asks the CA what it would do with req, without it signing
+// anything. A denial is reported in the response, not as an error.
+func (c *Client) SimulateUserCert(ctx context.Context, req UserCertRequest) (*SimulateUserCertRespJson, error) {
+	certReq, err := c.userCertReq(ctx, req, "SimulateUserCertReq")
+	if err != nil {
+		return nil, err
+	}
+
+	resp := SimulateUserCertRespJson{}
+	err = RequestSignedPayload(ctx, c.sess, c.lambdaFunc, certReq, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "simulating user cert request")
+	}
+
+	return &resp, nil
+}
+
+func (c *Client) userCertReq(ctx context.Context, req UserCertRequest, eventType string) (*UserCertReqJson, error) {
+	kp, err := c.KeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading keypair")
+	}
+
+	ident, err := CallerIdentityUser(ctx, c.sess)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting aws user identity")
+	}
+
+	fingerprint, err := PublicKeyFingerprint(kp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := CreateToken(ctx, c.authority, TokenParams{
+		FromId: ident.UserId,
+		FromAccount: ident.AccountId,
+		FromName: ident.Username,
+		To: c.tokenIdentity,
+		Type: ident.Type,
+		RemoteInstanceArn: req.InstanceArn,
+		Vouchers: req.Vouchers,
+		SshUsername: req.SshUsername,
+		PublicKeyFingerprint: fingerprint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserCertReqJson{
+		EventType: eventType,
+		Token: token,
+		PublicKey: string(kp.PublicKey),
+		ValidityDuration: int64(req.ValidityDuration / time.Second),
+	}, nil
+}
+
+type HostCertRequest struct {
+	InstanceArn string
+	PublicKey   []byte
+	// PublicKeys is set instead of PublicKey to have several host keys signed
+	// in one request. The response's SignedHostPublicKeys are in the same order.
+	PublicKeys [][]byte
+	Principals []string
+}
+
+// RequestHostCert asks the CA to sign an instance's ssh host key. The client
+// should be using the instance's own credentials.
+func (c *Client) RequestHostCert(ctx context.Context, req HostCertRequest) (*HostCertRespJson, error) {
+	ident, err := CallerIdentityUser(ctx, c.sess)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting aws host identity")
+	}
+
+	params := TokenParams{
+		FromId:          ident.UserId,
+		FromAccount:     ident.AccountId,
+		To:              c.tokenIdentity,
+		Type:            "AssumedRole",
+		HostInstanceArn: req.InstanceArn,
+		Principals:      req.Principals,
+	}
+	certReq := HostCertReqJson{EventType: "HostCertReq"}
+
+	if len(req.PublicKeys) > 0 {
+		for _, publicKey := range req.PublicKeys {
+			fingerprint, err := PublicKeyFingerprint(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			params.PublicKeyFingerprints = append(params.PublicKeyFingerprints, fingerprint)
+			certReq.PublicKeys = append(certReq.PublicKeys, string(publicKey))
+		}
+	} else {
+		params.PublicKeyFingerprint, err = PublicKeyFingerprint(req.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		certReq.PublicKey = string(req.PublicKey)
+	}
+
+	certReq.Token, err = CreateToken(ctx, c.authority, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating host cert token")
+	}
+
+	resp := HostCertRespJson{}
+	err = RequestSignedPayload(ctx, c.sess, c.lambdaFunc, certReq, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "requesting signed host key")
+	}
+
+	if len(resp.SignedHostPublicKeys) != len(req.PublicKeys) {
+		return nil, errors.Errorf("CA signed %d of %d host keys", len(resp.SignedHostPublicKeys), len(req.PublicKeys))
+	}
+
+	return &resp, nil
+}
+
+// RequestKRL fetches the CA's current key revocation list.
+func (c *Client) RequestKRL(ctx context.Context) ([]byte, error) {
+	resp := KrlRespJson{}
+	err := RequestSignedPayload(ctx, c.sess, c.lambdaFunc, KrlReqJson{EventType: "KrlReq"}, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "requesting krl")
+	}
+	return resp.Krl, nil
+}
+
+// RequestCaKeys fetches the CA's active key and every key that certificates
+// should currently be trusted from.
+func (c *Client) RequestCaKeys(ctx context.Context) (*CaKeysRespJson, error) {
+	resp := CaKeysRespJson{}
+	err := RequestSignedPayload(ctx, c.sess, c.lambdaFunc, CaKeysReqJson{EventType: "CaKeysReq"}, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "requesting ca keys")
+	}
+	return &resp, nil
+}
+
+// Vouch creates a voucher for vouchee to log into the instance scope as
+// sshUsername, or as anyone if that's empty. It expires after ttl, or
+// TokenLifetime if ttl is zero.
+func (c *Client) Vouch(ctx context.Context, vouchee, scope, sshUsername string, ttl time.Duration) (*VoucherToken, error) {
+	return Vouch(ctx, c.sess, c.authority, c.tokenIdentity, vouchee, scope, sshUsername, ttl)
+}
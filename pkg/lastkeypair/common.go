@@ -6,8 +6,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws"
 	"time"
-	"encoding/json"
-	"log"
 	"encoding/base64"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"strings"
@@ -15,12 +13,14 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"crypto/rand"
+	"encoding/hex"
+	"encoding/binary"
+	"context"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/glassechidna/awscredcache"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/pquerna/otp/totp"
 	"os"
-	"github.com/glassechidna/lastkeypair/pkg/lastkeypair/cli"
 )
 
 var ApplicationVersion string
@@ -37,32 +37,36 @@ var DefaultSshPermissions = ssh.Permissions{
 	},
 }
 
-func SignSsh(caKeyBytes, sshKeyPassphrase, pubkeyBytes []byte, certType uint32, expiry uint64, permissions ssh.Permissions, keyId string, principals []string) (*string, error) {
-	var signer ssh.Signer
-	var err error
-
-	if len(sshKeyPassphrase) > 0 {
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(caKeyBytes, sshKeyPassphrase)
-	} else {
-		signer, err = ssh.ParsePrivateKey(caKeyBytes)
-	}
-
+func SignSsh(signer ssh.Signer, pubkeyBytes []byte, certType uint32, expiry uint64, permissions ssh.Permissions, keyId string, principals []string) (*string, error) {
+	cert, err := SignSshCert(signer, pubkeyBytes, certType, expiry, permissions, keyId, principals)
 	if err != nil {
-		return nil, errors.Wrap(err, "err parsing ca priv key")
+		return nil, err
 	}
 
+	formatted := FormatSshCert(cert)
+	return &formatted, nil
+}
+
+// SignSshCert is SignSsh for callers that need the certificate's details, e.g.
+// its randomly-assigned serial.
+func SignSshCert(signer ssh.Signer, pubkeyBytes []byte, certType uint32, expiry uint64, permissions ssh.Permissions, keyId string, principals []string) (*ssh.Certificate, error) {
 	userPubkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "err parsing user pub key")
 	}
 
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
 	after := now.Add(-300 * time.Second)
 
 	cert := &ssh.Certificate{
 		//Nonce: is generated by cert.SignCert
 		Key: userPubkey,
-		Serial: 0,
+		Serial: serial,
 		CertType: certType,
 		KeyId: keyId,
 		ValidPrincipals: principals,
@@ -78,11 +82,38 @@ func SignSsh(caKeyBytes, sshKeyPassphrase, pubkeyBytes []byte, certType uint32,
 		return nil, errors.Wrap(err, "err signing cert")
 	}
 
-	signed := cert.Marshal()
+	return cert, nil
+}
+
+func FormatSshCert(cert *ssh.Certificate) string {
+	b64 := base64.StdEncoding.EncodeToString(cert.Marshal())
+	return fmt.Sprintf("%s %s", cert.Type(), b64)
+}
 
-	b64 := base64.StdEncoding.EncodeToString(signed)
-	formatted := fmt.Sprintf("%s %s", cert.Type(), b64)
-	return &formatted, nil
+// randomSerial is never zero, because zero is what every certificate had
+// before serials were assigned. KRLs can't revoke serial zero.
+func randomSerial() (uint64, error) {
+	serialBytes := make([]byte, 8)
+	for {
+		_, err := rand.Read(serialBytes)
+		if err != nil {
+			return 0, errors.Wrap(err, "generating cert serial")
+		}
+
+		if serial := binary.BigEndian.Uint64(serialBytes); serial != 0 {
+			return serial, nil
+		}
+	}
+}
+
+// PublicKeyFingerprint returns the SHA256 fingerprint of an authorized_keys
+// formatted public key, in the same format as ssh-keygen -l.
+func PublicKeyFingerprint(pubkeyBytes []byte) (string, error) {
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing public key")
+	}
+	return ssh.FingerprintSHA256(pubkey), nil
 }
 
 func ClientAwsSession(profile, region string) *session.Session {
@@ -129,6 +160,7 @@ func ClientAwsSession(profile, region string) *session.Session {
 type PlaintextPayload struct {
 	NotBefore int64 // this is what json.unmarshal wants
 	NotAfter int64
+	Nonce string `json:",omitempty"` // unique per token, so that a ReplayStore can detect reuse
 }
 
 func kmsClientForKeyId(sess *session.Session, keyId string) *kms.KMS {
@@ -141,86 +173,75 @@ func kmsClientForKeyId(sess *session.Session, keyId string) *kms.KMS {
 	return kms.New(sess)
 }
 
-func CreateToken(sess *session.Session, params TokenParams, keyId string) Token {
-	context := params.ToKmsContext()
-
-	now := int64(time.Now().Unix())
-	end := now + 3600 // 1 hour
+// TokenLifetime is how long tokens, including vouchers, are valid for.
+const TokenLifetime = time.Hour
 
-	payload := PlaintextPayload{
-		NotBefore: now,
-		NotAfter: end,
-	}
+func CreateToken(ctx context.Context, authority TokenAuthority, params TokenParams) (Token, error) {
+	return CreateTokenWithLifetime(ctx, authority, params, TokenLifetime)
+}
 
-	plaintext, err := json.Marshal(&payload)
-	if err != nil {
-		log.Panicf("Payload json encoding error: %s", err.Error())
-	}
+func CreateTokenWithLifetime(ctx context.Context, authority TokenAuthority, params TokenParams, lifetime time.Duration) (Token, error) {
+	now := int64(time.Now().Unix())
+	end := now + int64(lifetime / time.Second)
 
-	keyArn, err := cli.FullKmsKey(sess, keyId)
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
 	if err != nil {
-		log.Panicf("Determining KMS key ARN from key id/alias: %s", err.Error())
+		return Token{}, errors.Wrap(err, "generating token nonce")
 	}
 
-	input := &kms.EncryptInput{
-		Plaintext: plaintext,
-		KeyId: &keyArn,
-		EncryptionContext: context,
+	payload := PlaintextPayload{
+		NotBefore: now,
+		NotAfter: end,
+		Nonce: hex.EncodeToString(nonce),
 	}
 
-	client := kmsClientForKeyId(sess, keyArn)
-	response, err := client.Encrypt(input)
+	token, err := authority.Issue(ctx, params, payload)
 	if err != nil {
-		log.Panicf("Encryption error: %s", err.Error())
+		return Token{}, errors.Wrap(err, "issuing token")
 	}
 
-	blob := response.CiphertextBlob
-	return Token{Params: params, Signature: blob}
+	token.Expiry = end
+	return *token, nil
 }
 
-func ValidateToken(sess *session.Session, token Token, expectedKeyId string) bool {
-	context := token.Params.ToKmsContext()
-
-	input := &kms.DecryptInput{
-		CiphertextBlob: token.Signature,
-		EncryptionContext: context,
-	}
-
-	client := kms.New(sess)
-	response, err := client.Decrypt(input)
-	if err != nil {
-		log.Panicf("Decryption error: %s", err.Error())
-	}
-
-	/* We verify that the encryption key used is the one that we expected it to be.
-	   This is very important, as an attacker could submit ciphertext encrypted with
-	   a key they control that grants our Lambda permission to decrypt. Perhaps it
-	   would be worth implementing some kind of alert here?
-	 */
-	if expectedKeyId != *response.KeyId {
-		log.Panicf("Mismatching KMS key ids: %s and %s", expectedKeyId, *response.KeyId)
-	}
+// ValidateToken checks the token's signature and validity period. If replays
+// is non-nil, the token is also redeemed so that it can't be used again. A
+// nil error means the token is valid.
+func ValidateToken(ctx context.Context, authority TokenAuthority, token Token, replays ReplayStore) error {
+	_, err := validateToken(ctx, authority, token, replays)
+	return err
+}
 
-	payload := PlaintextPayload{}
-	err = json.Unmarshal([]byte(response.Plaintext), &payload)
+// validateToken is ValidateToken, also returning the verified payload.
+func validateToken(ctx context.Context, authority TokenAuthority, token Token, replays ReplayStore) (*PlaintextPayload, error) {
+	payload, err := authority.Verify(ctx, token)
 	if err != nil {
-		log.Printf("decoding token json")
-		return false
+		return nil, errors.Wrap(err, "verifying token")
 	}
 
 	now := int64(time.Now().Unix())
 	sway := int64(150) 
 	if now < payload.NotBefore - sway {
-		log.Printf("token yet to be valid")
-		return false
+		return nil, ErrTokenNotYetValid
 	}
 	
 	if now > payload.NotAfter + sway {
-		log.Printf("expired token")
-		return false
+		return nil, ErrTokenExpired
 	}
 
-	return true
+	if replays != nil {
+		if len(payload.Nonce) == 0 {
+			return nil, errors.Wrap(ErrInvalidToken, "token has no nonce")
+		}
+
+		err = replays.Redeem(ctx, payload.Nonce, time.Unix(payload.NotAfter + sway, 0))
+		if err != nil {
+			return nil, errors.Wrap(err, "redeeming token")
+		}
+	}
+
+	return payload, nil
 }
 
 type StsIdentity struct {
@@ -230,9 +251,9 @@ type StsIdentity struct {
 	Type string
 }
 
-func CallerIdentityUser(sess *session.Session) (*StsIdentity, error) {
+func CallerIdentityUser(ctx context.Context, sess *session.Session) (*StsIdentity, error) {
 	client := sts.New(sess)
-	response, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	response, err := client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
 
 	if err == nil {
 		arn := *response.Arn
@@ -257,6 +278,6 @@ func CallerIdentityUser(sess *session.Session) (*StsIdentity, error) {
 			return nil, errors.New("unsupported IAM identity type")
 		}
 	} else {
-		return nil, err
+		return nil, errors.Wrap(ErrAwsCredentials, err.Error())
 	}
 }
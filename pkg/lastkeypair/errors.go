@@ -0,0 +1,96 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// These are returned (usually wrapped, so compare against errors.Cause(err))
+// by the CA and client functions in this package.
+var (
+	ErrBadRequest        = errors.New("bad request")
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrTokenExpired      = errors.New("token has expired")
+	ErrTokenNotYetValid  = errors.New("token is not yet valid")
+	ErrTokenReplayed     = errors.New("token has already been redeemed")
+	ErrKeyMismatch       = errors.New("token was not issued with the expected kms key")
+	ErrPublicKeyMismatch = errors.New("public key does not match token")
+	ErrUnauthorized      = errors.New("not authorised")
+	ErrAwsCredentials    = errors.New("aws credentials unavailable")
+	// ErrAuthorizerUnavailable means no decision could be made, so the request
+	// was denied. Trying again later may work.
+	ErrAuthorizerUnavailable = errors.New("authorizer unavailable")
+)
+
+const ErrorCodeInternal = "InternalError"
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrBadRequest, "BadRequest"},
+	{ErrInvalidToken, "InvalidToken"},
+	{ErrTokenExpired, "TokenExpired"},
+	{ErrTokenNotYetValid, "TokenNotYetValid"},
+	{ErrTokenReplayed, "TokenReplayed"},
+	{ErrKeyMismatch, "KeyMismatch"},
+	{ErrPublicKeyMismatch, "PublicKeyMismatch"},
+	{ErrUnauthorized, "Unauthorized"},
+	{ErrAwsCredentials, "AwsCredentials"},
+	{ErrAuthorizerUnavailable, "AuthorizerUnavailable"},
+}
+
+// ErrorCode maps err to a stable code that is safe to switch on across
+// versions. Errors that don't originate from one of the sentinels above are
+// ErrorCodeInternal.
+func ErrorCode(err error) string {
+	cause := errors.Cause(err)
+	for _, c := range errorCodes {
+		if c.err == cause {
+			return c.code
+		}
+	}
+	return ErrorCodeInternal
+}
+
+// Error is what LambdaHandle returns, so that the Lambda's error payload
+// starts with a stable code. Its Cause is the matching sentinel, including
+// when it's been reconstructed on the client side by RequestSignedPayload.
+type Error struct {
+	Code    string
+	Message string
+	err     error
+}
+
+func NewError(err error) *Error {
+	return &Error{Code: ErrorCode(err), Message: err.Error(), err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *Error) Cause() error {
+	return e.err
+}
+
+// parseError is the inverse of Error.Error(). It returns nil if message
+// doesn't start with a known code.
+func parseError(message string) *Error {
+	parts := strings.SplitN(message, ": ", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	if parts[0] == ErrorCodeInternal {
+		return &Error{Code: parts[0], Message: parts[1], err: errors.New(parts[1])}
+	}
+
+	for _, c := range errorCodes {
+		if c.code == parts[0] {
+			return &Error{Code: c.code, Message: parts[1], err: c.err}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testTokenAuthority stands in for KMS. Every call returns an authority with
+// the same key, so tokens issued by one verify with another.
+func testTokenAuthority() *HmacTokenAuthority {
+	return NewHmacTokenAuthority([]byte("secret"))
+}
+
+func testTokenParams() TokenParams {
+	return TokenParams{
+		FromId: "AIDAEXAMPLE",
+		FromAccount: "123456789012",
+		FromName: "aidan",
+		To: "LastKeypair",
+		Type: "User",
+		RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-0123abcd",
+		SshUsername: "ec2-user",
+	}
+}
+
+func testCaKeyBytes(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// testCaConfig is a CA with a fresh key that accepts tokens from
+// testTokenAuthority.
+func testCaConfig(t *testing.T) LambdaConfig {
+	return LambdaConfig{
+		KmsTokenIdentity: "LastKeypair",
+		CaKeyBytes: testCaKeyBytes(t),
+		ValidityDuration: 3600,
+		TokenAuthority: testTokenAuthority(),
+		Authorizer: AllowAllAuthorizer{},
+	}
+}
+
+func mustCreateToken(t *testing.T, authority TokenAuthority, params TokenParams) Token {
+	token, err := CreateToken(context.Background(), authority, params)
+	assert.Nil(t, err)
+	return token
+}
+
+// testKeyPair generates a key and binds params to it.
+func testKeyPair(t *testing.T, params *TokenParams) *Keypair {
+	kp, err := GenerateKeyPair(DefaultKeyType)
+	assert.Nil(t, err)
+	params.PublicKeyFingerprint, err = PublicKeyFingerprint(kp.PublicKey)
+	assert.Nil(t, err)
+	return kp
+}
+
+// testUserCertReq asks for kp to be signed, with a fresh token for params.
+func testUserCertReq(t *testing.T, params TokenParams, kp *Keypair) UserCertReqJson {
+	return UserCertReqJson{
+		EventType: "UserCertReq",
+		Token: mustCreateToken(t, testTokenAuthority(), params),
+		PublicKey: string(kp.PublicKey),
+	}
+}
+
+func parseTestCert(t *testing.T, signed string) *ssh.Certificate {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+	assert.Nil(t, err)
+	return pub.(*ssh.Certificate)
+}
+
+type staticAuthorizer struct {
+	user *LkpUserCertAuthorizationResponse
+	host *LkpHostCertAuthorizationResponse
+}
+
+func (s staticAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	resp := *s.user
+	return &resp, nil
+}
+
+func (s staticAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	resp := *s.host
+	return &resp, nil
+}
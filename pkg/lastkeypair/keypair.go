@@ -1,9 +1,13 @@
 package lastkeypair
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	"github.com/mitchellh/go-homedir"
 	"path"
@@ -14,37 +18,145 @@ import (
 )
 
 type Keypair struct {
+	Type KeyType
 	PrivateKey []byte
 	PublicKey []byte
 }
 
-func GenerateKeyPair() (*Keypair, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, errors.Wrap(err, "generating privkey")
+type KeyType string
+
+const (
+	KeyTypeEd25519   KeyType = "ed25519"
+	KeyTypeEcdsaP256 KeyType = "ecdsa-p256"
+	KeyTypeRsa4096   KeyType = "rsa-4096"
+)
+
+const DefaultKeyType = KeyTypeEd25519
+
+// keys smaller than this were generated by versions of LKP that only made
+// 2048-bit RSA keys, and are replaced rather than reused.
+const minRsaKeyBits = 4096
+
+func ParseKeyType(s string) (KeyType, error) {
+	switch KeyType(s) {
+	case KeyTypeEd25519, KeyTypeEcdsaP256, KeyTypeRsa4096:
+		return KeyType(s), nil
+	case "":
+		return DefaultKeyType, nil
+	default:
+		return "", errors.Errorf("unknown key type %q (expected ed25519, ecdsa-p256 or rsa-4096)", s)
+	}
+}
+
+// Filename is the name of the private key file, following ssh-keygen's naming.
+// The public key and certificate are stored alongside it with .pub and
+// -cert.pub suffixes.
+func (t KeyType) Filename() string {
+	switch t {
+	case KeyTypeEcdsaP256:
+		return "id_ecdsa"
+	case KeyTypeRsa4096:
+		return "id_rsa"
+	default:
+		return "id_ed25519"
+	}
+}
+
+func GenerateKeyPair(keyType KeyType) (*Keypair, error) {
+	var privateKey interface{}
+	var privateKeyPem []byte
+	var err error
+
+	switch keyType {
+	case KeyTypeEd25519:
+		var key ed25519.PrivateKey
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			privateKey = key
+			privateKeyPem, err = marshalEd25519PrivateKey(key)
+		}
+	case KeyTypeEcdsaP256:
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			privateKey = key
+			var der []byte
+			der, err = x509.MarshalECPrivateKey(key)
+			privateKeyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		}
+	case KeyTypeRsa4096:
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+		if err == nil {
+			privateKey = key
+			der := x509.MarshalPKCS1PrivateKey(key)
+			privateKeyPem = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})
+		}
+	default:
+		return nil, errors.Errorf("unknown key type %q", keyType)
 	}
 
-	privateKeyDer := x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privateKeyDer,
+	if err != nil {
+		return nil, errors.Wrap(err, "generating privkey")
 	}
-	privateKeyPem := pem.EncodeToMemory(&privateKeyBlock)
 
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	signer, err := ssh.NewSignerFromKey(privateKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "deriving pubkey from privkey")
 	}
 
-	pubkey := ssh.MarshalAuthorizedKey(pub)
+	pubkey := ssh.MarshalAuthorizedKey(signer.PublicKey())
 
 	return &Keypair{
+		Type: keyType,
 		PrivateKey: privateKeyPem,
 		PublicKey: pubkey,
 	}, nil
 }
 
+// marshalEd25519PrivateKey writes the unencrypted "openssh-key-v1" format,
+// which is the only one ssh understands for ed25519 keys. See PROTOCOL.key in
+// the OpenSSH source.
+func marshalEd25519PrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	checkBytes := make([]byte, 4)
+	_, err = rand.Read(checkBytes)
+	if err != nil {
+		return nil, err
+	}
+	check := binary.BigEndian.Uint32(checkBytes)
+
+	privBlock := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{check, check, ssh.KeyAlgoED25519, []byte(pub), []byte(key), ""})
+
+	for i := 1; len(privBlock) % 8 != 0; i++ {
+		privBlock = append(privBlock, byte(i))
+	}
+
+	envelope := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, sshPub.Marshal(), privBlock})
+
+	magic := append([]byte("openssh-key-v1"), 0)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append(magic, envelope...)}), nil
+}
+
 func AppDir() string {
 	home, _ := homedir.Dir()
 	appDir := path.Join(home, ".lkp")
@@ -58,19 +170,59 @@ func TmpDir() string {
 	return tmpDir
 }
 
+// KeySource returns the keypair that a Client requests certificates for.
+type KeySource func() (*Keypair, error)
+
 func MyKeyPair() (*Keypair, error) {
-	privkeyPath := path.Join(AppDir(), "id_rsa")
-	pubkeyPath := path.Join(AppDir(), "id_rsa.pub")
+	return KeyPairInDir(AppDir(), DefaultKeyType)
+}
+
+// KeyPairInDir loads the keypair of the given type stored in dir, generating
+// and storing one first if there isn't one there yet. A 2048-bit id_rsa left
+// by older versions is moved aside to id_rsa.legacy rather than reused.
+func KeyPairInDir(dir string, keyType KeyType) (*Keypair, error) {
+	os.MkdirAll(dir, 0755)
+	privkeyPath := path.Join(dir, keyType.Filename())
+	pubkeyPath := privkeyPath + ".pub"
+
+	if keyType == KeyTypeRsa4096 && isLegacyRsaKey(pubkeyPath) {
+		for _, suffix := range []string{"", ".pub", "-cert.pub"} {
+			os.Rename(privkeyPath + suffix, path.Join(dir, "id_rsa.legacy" + suffix))
+		}
+	}
 
 	if _, err := os.Stat(privkeyPath); os.IsNotExist(err) {
-		keypair, _ := GenerateKeyPair()
+		keypair, err := GenerateKeyPair(keyType)
+		if err != nil {
+			return nil, err
+		}
 		ioutil.WriteFile(privkeyPath, keypair.PrivateKey, 0600)
 		ioutil.WriteFile(pubkeyPath, keypair.PublicKey, 0644)
 		return keypair, nil
 	} else {
-		keypair := Keypair{}
+		keypair := Keypair{Type: keyType}
 		keypair.PrivateKey, _ = ioutil.ReadFile(privkeyPath)
 		keypair.PublicKey, _ = ioutil.ReadFile(pubkeyPath)
 		return &keypair, nil
 	}
 }
+
+func isLegacyRsaKey(pubkeyPath string) bool {
+	pubkeyBytes, err := ioutil.ReadFile(pubkeyPath)
+	if err != nil {
+		return false
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+	if err != nil {
+		return false
+	}
+
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return false
+	}
+
+	rsaPub, ok := cryptoPub.CryptoPublicKey().(*rsa.PublicKey)
+	return ok && rsaPub.N.BitLen() < minRsaKeyBits
+}
@@ -0,0 +1,63 @@
+package lastkeypair
+
+import (
+	"testing"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeyPairTypes(t *testing.T) {
+	expected := map[KeyType]string{
+		KeyTypeEd25519:   ssh.KeyAlgoED25519,
+		KeyTypeEcdsaP256: ssh.KeyAlgoECDSA256,
+		KeyTypeRsa4096:   ssh.KeyAlgoRSA,
+	}
+
+	for keyType, algo := range expected {
+		kp, err := GenerateKeyPair(keyType)
+		assert.Nil(t, err)
+
+		signer, err := ssh.ParsePrivateKey(kp.PrivateKey)
+		assert.Nil(t, err, string(keyType))
+		assert.Equal(t, algo, signer.PublicKey().Type())
+		assert.Equal(t, string(kp.PublicKey), string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	}
+}
+
+func TestKeyPairInDirReplacesLegacyRsaKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	legacy, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	legacyPub, err := ssh.NewPublicKey(&legacy.PublicKey)
+	assert.Nil(t, err)
+
+	legacyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(legacy)})
+	ioutil.WriteFile(filepath.Join(dir, "id_rsa"), legacyPem, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "id_rsa.pub"), ssh.MarshalAuthorizedKey(legacyPub), 0644)
+
+	kp, err := KeyPairInDir(dir, KeyTypeEd25519)
+	assert.Nil(t, err)
+	assert.Equal(t, KeyTypeEd25519, kp.Type)
+	assert.True(t, fileExists(filepath.Join(dir, "id_ed25519")))
+	assert.True(t, fileExists(filepath.Join(dir, "id_rsa")), "legacy key left alone for other key types")
+
+	kp, err = KeyPairInDir(dir, KeyTypeRsa4096)
+	assert.Nil(t, err)
+	assert.NotEqual(t, string(ssh.MarshalAuthorizedKey(legacyPub)), string(kp.PublicKey))
+	assert.True(t, fileExists(filepath.Join(dir, "id_rsa.legacy")))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,370 @@
+package lastkeypair
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The KMS encryption context is what CloudTrail logs and what KMS key policies
+   match on, so its encoding is a public interface. The rules are:
+
+   * "contextVersion" names the schema. Tokens without it are legacy (v1)
+     tokens, which are only accepted during the migration window.
+   * scalar fields keep the names that key policies already refer to
+     (fromId, fromAccount, to, type, ...). Optional fields are omitted when
+     empty, so adding a new optional field never changes the context of
+     tokens that don't use it.
+   * list fields are a single key whose value is the elements, each with
+     '%' and ',' percent-escaped, joined by ','.
+   * vouchers are counted by "vouchers" and their scalar fields are
+     flattened into "voucher.<index>.<field>".
+   * every value is limited to maxKmsContextValueLength bytes and the whole
+     context to maxKmsContextSize bytes.
+
+   KMS doesn't care about ordering, but anything that hashes the context
+   should use canonicalKmsContext, which sorts keys bytewise.
+ */
+
+const KmsContextVersion = 2
+
+const (
+	legacyKmsContextVersion = 1
+	kmsContextVersionKey = "contextVersion"
+	maxKmsContextValueLength = 1024
+	maxKmsContextSize = 8192
+	maxKmsContextListLength = 64
+)
+
+type kmsContextScalar struct {
+	key      string
+	value    *string
+	required bool
+}
+
+func (p *TokenParams) kmsContextScalars() []kmsContextScalar {
+	return []kmsContextScalar{
+		{"fromId", &p.FromId, true},
+		{"fromAccount", &p.FromAccount, true},
+		{"to", &p.To, true},
+		{"type", &p.Type, true},
+		{"fromName", &p.FromName, false},
+		{"hostInstanceArn", &p.HostInstanceArn, false},
+		{"remoteInstanceArn", &p.RemoteInstanceArn, false},
+		{"sshUsername", &p.SshUsername, false},
+		{"vouchee", &p.Vouchee, false},
+		{"context", &p.Context, false},
+		{"publicKeyFingerprint", &p.PublicKeyFingerprint, false},
+	}
+}
+
+type kmsContextList struct {
+	key   string
+	value *[]string
+}
+
+func (p *TokenParams) kmsContextLists() []kmsContextList {
+	return []kmsContextList{
+		{"principals", &p.Principals},
+		{"publicKeyFingerprints", &p.PublicKeyFingerprints},
+	}
+}
+
+// KmsContext returns the encryption context for the schema version that the
+// token was issued with.
+func (token *Token) KmsContext() (map[string]*string, error) {
+	switch token.ContextVersion {
+	case 0, legacyKmsContextVersion:
+		return token.Params.ToLegacyKmsContext(), nil
+	case KmsContextVersion:
+		return token.Params.ToKmsContext()
+	default:
+		return nil, errors.Errorf("unsupported kms context version %d", token.ContextVersion)
+	}
+}
+
+func (params *TokenParams) ToKmsContext() (map[string]*string, error) {
+	context := map[string]*string{}
+	set := func(key, value string) error {
+		if len(value) > maxKmsContextValueLength {
+			return errors.Errorf("kms context value for %s exceeds %d bytes", key, maxKmsContextValueLength)
+		}
+		context[key] = &value
+		return nil
+	}
+
+	setScalars := func(prefix string, p *TokenParams) error {
+		for _, s := range p.kmsContextScalars() {
+			if s.required || len(*s.value) > 0 {
+				if err := set(prefix + s.key, *s.value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	set(kmsContextVersionKey, strconv.Itoa(KmsContextVersion))
+	if err := setScalars("", params); err != nil {
+		return nil, err
+	}
+
+	for _, l := range params.kmsContextLists() {
+		if len(*l.value) == 0 {
+			continue
+		}
+		if len(*l.value) > maxKmsContextListLength {
+			return nil, errors.Errorf("kms context list %s exceeds %d elements", l.key, maxKmsContextListLength)
+		}
+		if err := set(l.key, encodeKmsContextList(*l.value)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(params.Vouchers) > maxKmsContextListLength {
+		return nil, errors.Errorf("kms context exceeds %d vouchers", maxKmsContextListLength)
+	}
+	if len(params.Vouchers) > 0 {
+		set("vouchers", strconv.Itoa(len(params.Vouchers)))
+		for i := range params.Vouchers {
+			prefix := fmt.Sprintf("voucher.%d.", i)
+			if err := setScalars(prefix, &params.Vouchers[i].Params); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	size := 0
+	for key, value := range context {
+		size += len(key) + len(*value)
+	}
+	if size > maxKmsContextSize {
+		return nil, errors.Errorf("kms context exceeds %d bytes", maxKmsContextSize)
+	}
+
+	return context, nil
+}
+
+// ToLegacyKmsContext is the v1 encoding, kept so that tokens issued by older
+// clients can still be validated during the migration window.
+func (params *TokenParams) ToLegacyKmsContext() map[string]*string {
+	iterateParams := func(p *TokenParams, cb func(string, *string)) {
+		cb("fromId", &p.FromId)
+		cb("fromAccount", &p.FromAccount)
+		cb("to", &p.To)
+		cb("type", &p.Type)
+
+		if len(p.FromName) > 0 {
+			cb("fromName", &p.FromName)
+		}
+
+		if len(p.HostInstanceArn) > 0 {
+			cb("hostInstanceArn", &p.HostInstanceArn)
+		}
+
+		if len(p.RemoteInstanceArn) > 0 {
+			cb("remoteInstanceArn", &p.RemoteInstanceArn)
+		}
+
+		if len(p.SshUsername) > 0 {
+			cb("sshUsername", &p.SshUsername)
+		}
+
+		if len(p.Vouchee) > 0 {
+			cb("vouchee", &p.Vouchee)
+		}
+
+		if len(p.Context) > 0 {
+			cb("context", &p.Context)
+		}
+	}
+
+	context := make(map[string]*string)
+	iterateParams(params, func(key string, val *string) {
+		context[key] = val
+	})
+
+	if len(params.Vouchers) > 0 {
+		for i, v := range params.Vouchers {
+			keyPrefix := fmt.Sprintf("voucher-%d-", i)
+
+			iterateParams(&v.Params, func(key string, val *string) {
+				context[keyPrefix + key] = val
+			})
+		}
+	}
+
+	if len(params.Principals) > 0 {
+		for i, principal := range params.Principals {
+			principal := principal
+			key := fmt.Sprintf("principal-%d", i)
+			context[key] = &principal
+		}
+	}
+
+	return context
+}
+
+var kmsContextVoucherKey = regexp.MustCompile(`^voucher\.(\d+)\.(.+)$`)
+var legacyKmsContextVoucherKey = regexp.MustCompile(`^voucher-(\d+)-(.+)$`)
+var legacyKmsContextPrincipalKey = regexp.MustCompile(`^principal-(\d+)$`)
+
+// DecodeKmsContext is the inverse of ToKmsContext (and ToLegacyKmsContext for
+// contexts without a version key). Vouchers are reconstructed from their
+// params only, as their signatures aren't part of the context. Unknown keys
+// are an error rather than being silently dropped.
+func DecodeKmsContext(context map[string]*string) (*TokenParams, int, error) {
+	version := legacyKmsContextVersion
+	if v, found := context[kmsContextVersionKey]; found {
+		parsed, err := strconv.Atoi(*v)
+		if err != nil || parsed != KmsContextVersion {
+			return nil, 0, errors.Errorf("unsupported kms context version %s", *v)
+		}
+		version = parsed
+	}
+
+	voucherKey, principalKey := kmsContextVoucherKey, (*regexp.Regexp)(nil)
+	if version == legacyKmsContextVersion {
+		voucherKey, principalKey = legacyKmsContextVoucherKey, legacyKmsContextPrincipalKey
+	}
+
+	params := TokenParams{}
+	scalars := map[string]*string{}
+	for _, s := range params.kmsContextScalars() {
+		scalars[s.key] = s.value
+	}
+	lists := map[string]*[]string{}
+	if version != legacyKmsContextVersion {
+		for _, l := range params.kmsContextLists() {
+			lists[l.key] = l.value
+		}
+	}
+
+	vouchers := map[int]*TokenParams{}
+	voucherCount := -1
+	principals := map[int]string{}
+
+	for key, value := range context {
+		if key == kmsContextVersionKey {
+			continue
+		}
+
+		if ptr, found := scalars[key]; found {
+			*ptr = *value
+		} else if ptr, found := lists[key]; found {
+			list, err := decodeKmsContextList(*value)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "decoding kms context list %s", key)
+			}
+			*ptr = list
+		} else if key == "vouchers" && version != legacyKmsContextVersion {
+			count, err := strconv.Atoi(*value)
+			if err != nil || count < 0 || count > maxKmsContextListLength {
+				return nil, 0, errors.Errorf("invalid kms context voucher count %s", *value)
+			}
+			voucherCount = count
+		} else if m := voucherKey.FindStringSubmatch(key); m != nil {
+			idx, _ := strconv.Atoi(m[1])
+			if idx >= maxKmsContextListLength {
+				return nil, 0, errors.Errorf("kms context voucher index %d out of range", idx)
+			}
+			v, found := vouchers[idx]
+			if !found {
+				v = &TokenParams{}
+				vouchers[idx] = v
+			}
+			matched := false
+			for _, s := range v.kmsContextScalars() {
+				if s.key == m[2] {
+					*s.value = *value
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, 0, errors.Errorf("unknown kms context key %s", key)
+			}
+		} else if principalKey != nil && principalKey.MatchString(key) {
+			idx, _ := strconv.Atoi(principalKey.FindStringSubmatch(key)[1])
+			if idx >= maxKmsContextListLength {
+				return nil, 0, errors.Errorf("kms context principal index %d out of range", idx)
+			}
+			principals[idx] = *value
+		} else {
+			return nil, 0, errors.Errorf("unknown kms context key %s", key)
+		}
+	}
+
+	if version == legacyKmsContextVersion {
+		voucherCount = len(vouchers)
+		for i := 0; i < len(principals); i++ {
+			principal, found := principals[i]
+			if !found {
+				return nil, 0, errors.Errorf("kms context is missing principal-%d", i)
+			}
+			params.Principals = append(params.Principals, principal)
+		}
+	} else if voucherCount == -1 {
+		voucherCount = 0
+	}
+
+	if len(vouchers) > voucherCount {
+		return nil, 0, errors.Errorf("kms context has more vouchers than the %d it declares", voucherCount)
+	}
+	for i := 0; i < voucherCount; i++ {
+		v, found := vouchers[i]
+		if !found {
+			return nil, 0, errors.Errorf("kms context is missing voucher %d", i)
+		}
+		params.Vouchers = append(params.Vouchers, VoucherToken{Params: *v})
+	}
+
+	return &params, version, nil
+}
+
+var kmsContextListEscaper = strings.NewReplacer("%", "%25", ",", "%2C")
+var kmsContextListUnescaper = strings.NewReplacer("%25", "%", "%2C", ",")
+
+func encodeKmsContextList(list []string) string {
+	escaped := make([]string, len(list))
+	for i, item := range list {
+		escaped[i] = kmsContextListEscaper.Replace(item)
+	}
+	return strings.Join(escaped, ",")
+}
+
+func decodeKmsContextList(value string) ([]string, error) {
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		// every '%' must start one of our two escape sequences
+		if strings.Count(item, "%") != strings.Count(item, "%25") + strings.Count(item, "%2C") {
+			return nil, errors.Errorf("invalid escape sequence in %q", item)
+		}
+		items[i] = kmsContextListUnescaper.Replace(item)
+	}
+	return items, nil
+}
+
+// canonicalKmsContext writes the context as length-prefixed key/value pairs
+// sorted by key, for anything that needs to hash or MAC it.
+func canonicalKmsContext(w io.Writer, context map[string]*string) {
+	keys := []string{}
+	for key := range context {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeField := func(field string) {
+		binary.Write(w, binary.BigEndian, uint32(len(field)))
+		io.WriteString(w, field)
+	}
+
+	for _, key := range keys {
+		writeField(key)
+		writeField(*context[key])
+	}
+}
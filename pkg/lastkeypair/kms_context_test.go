@@ -0,0 +1,67 @@
+package lastkeypair
+
+import (
+	"testing"
+	"strings"
+	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestKmsContextRoundTrip(t *testing.T) {
+	voucher := testTokenParams()
+	voucher.FromName = "benjamin"
+	voucher.Vouchee = "aidan"
+	voucher.Context = "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-0123abcd"
+	voucher.RemoteInstanceArn = ""
+	voucher.SshUsername = ""
+
+	params := testTokenParams()
+	params.Principals = []string{"a,b", "100%", ""}
+	params.PublicKeyFingerprints = []string{"SHA256:one", "SHA256:two"}
+	params.Vouchers = []VoucherToken{{Params: voucher}}
+
+	context, err := params.ToKmsContext()
+	assert.Nil(t, err)
+	assert.Equal(t, "2", *context["contextVersion"])
+	assert.Equal(t, "a%2Cb,100%25,", *context["principals"])
+	assert.Equal(t, "1", *context["vouchers"])
+	assert.Equal(t, "benjamin", *context["voucher.0.fromName"])
+
+	decoded, version, err := DecodeKmsContext(context)
+	assert.Nil(t, err)
+	assert.Equal(t, KmsContextVersion, version)
+	assert.Equal(t, params, *decoded)
+}
+
+func TestLegacyKmsContextDecode(t *testing.T) {
+	params := testTokenParams()
+	params.Principals = []string{"one", "two"}
+
+	decoded, version, err := DecodeKmsContext(params.ToLegacyKmsContext())
+	assert.Nil(t, err)
+	assert.Equal(t, legacyKmsContextVersion, version)
+	assert.Equal(t, params, *decoded)
+}
+
+func TestKmsContextRejectsUnknownAndOversized(t *testing.T) {
+	params := testTokenParams()
+	context, err := params.ToKmsContext()
+	assert.Nil(t, err)
+
+	context["somethingNew"] = aws.String("value")
+	_, _, err = DecodeKmsContext(context)
+	assert.NotNil(t, err)
+
+	params.SshUsername = strings.Repeat("a", maxKmsContextValueLength + 1)
+	_, err = params.ToKmsContext()
+	assert.NotNil(t, err)
+}
+
+func TestKmsContextListEscaping(t *testing.T) {
+	_, err := decodeKmsContextList("bad%2")
+	assert.NotNil(t, err)
+
+	list, err := decodeKmsContextList(encodeKmsContextList([]string{"%2C", ",%,"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"%2C", ",%,"}, list)
+}
@@ -0,0 +1,325 @@
+package lastkeypair
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// See PROTOCOL.krl in the OpenSSH source for the format.
+const (
+	krlMagic         = 0x5353484b524c0a00
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSha1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSha256 = 5
+
+	krlCertSectionSerialList   = 0x20
+	krlCertSectionSerialRange  = 0x21
+	krlCertSectionSerialBitmap = 0x22
+	krlCertSectionKeyId        = 0x23
+)
+
+// KRL is an OpenSSH key revocation list, the binary format sshd reads from
+// the file named by RevokedKeys. Only the sections LKP needs are supported:
+// certificate serials and key ids, and SHA256 key fingerprints.
+type KRL struct {
+	Version     uint64
+	GeneratedAt time.Time
+	Comment     string
+
+	// both keyed by the wire encoding of the CA public key
+	serials map[string]map[uint64]bool
+	keyIds  map[string]map[string]bool
+
+	// raw SHA256 hashes of the wire encoding of revoked public keys
+	fingerprints map[string]bool
+}
+
+func newEmptyKRL() *KRL {
+	return &KRL{
+		serials:      map[string]map[uint64]bool{},
+		keyIds:       map[string]map[string]bool{},
+		fingerprints: map[string]bool{},
+	}
+}
+
+// NewKRL revokes certificates signed by any of caKeys that match one of
+// revocations. Fingerprint revocations apply regardless of the CA.
+func NewKRL(caKeys []ssh.PublicKey, revocations []Revocation) (*KRL, error) {
+	krl := newEmptyKRL()
+	krl.GeneratedAt = time.Now()
+	krl.Version = uint64(krl.GeneratedAt.Unix())
+	krl.Comment = "lastkeypair"
+
+	for _, caKey := range caKeys {
+		ca := string(caKey.Marshal())
+		krl.serials[ca] = map[uint64]bool{}
+		krl.keyIds[ca] = map[string]bool{}
+	}
+
+	for _, r := range revocations {
+		err := r.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(r.Fingerprint) > 0 {
+			hash, _ := parseSha256Fingerprint(r.Fingerprint)
+			krl.fingerprints[string(hash)] = true
+		}
+
+		for ca := range krl.serials {
+			if r.Serial != 0 {
+				krl.serials[ca][r.Serial] = true
+			}
+			if len(r.KeyId) > 0 {
+				krl.keyIds[ca][r.KeyId] = true
+			}
+		}
+	}
+
+	return krl, nil
+}
+
+// IsRevoked has the same signature as ssh.CertChecker.IsRevoked.
+func (k *KRL) IsRevoked(cert *ssh.Certificate) bool {
+	if k.isKeyRevoked(cert.Key) || k.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	ca := string(cert.SignatureKey.Marshal())
+	return k.serials[ca][cert.Serial] || k.keyIds[ca][cert.KeyId]
+}
+
+func (k *KRL) isKeyRevoked(key ssh.PublicKey) bool {
+	hash := sha256.Sum256(key.Marshal())
+	return k.fingerprints[string(hash[:])]
+}
+
+func (k *KRL) Marshal() []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint64(krlMagic))
+	binary.Write(buf, binary.BigEndian, uint32(krlFormatVersion))
+	binary.Write(buf, binary.BigEndian, k.Version)
+	binary.Write(buf, binary.BigEndian, uint64(k.GeneratedAt.Unix()))
+	binary.Write(buf, binary.BigEndian, uint64(0)) // flags
+	writeKrlString(buf, nil)                       // reserved
+	writeKrlString(buf, []byte(k.Comment))
+
+	// ssh-keygen emits everything sorted, so we do too. it makes the output
+	// deterministic and easy to diff.
+	for _, ca := range sortedKeys(k.serials, k.keyIds) {
+		section := &bytes.Buffer{}
+		writeKrlString(section, []byte(ca))
+		writeKrlString(section, nil) // reserved
+
+		if serials := k.serials[ca]; len(serials) > 0 {
+			sorted := make([]uint64, 0, len(serials))
+			for serial := range serials {
+				sorted = append(sorted, serial)
+			}
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			sub := &bytes.Buffer{}
+			for _, serial := range sorted {
+				binary.Write(sub, binary.BigEndian, serial)
+			}
+			section.WriteByte(krlCertSectionSerialList)
+			writeKrlString(section, sub.Bytes())
+		}
+
+		if keyIds := k.keyIds[ca]; len(keyIds) > 0 {
+			sub := &bytes.Buffer{}
+			for _, keyId := range sortedStrings(keyIds) {
+				writeKrlString(sub, []byte(keyId))
+			}
+			section.WriteByte(krlCertSectionKeyId)
+			writeKrlString(section, sub.Bytes())
+		}
+
+		buf.WriteByte(krlSectionCertificates)
+		writeKrlString(buf, section.Bytes())
+	}
+
+	if len(k.fingerprints) > 0 {
+		section := &bytes.Buffer{}
+		for _, hash := range sortedStrings(k.fingerprints) {
+			writeKrlString(section, []byte(hash))
+		}
+		buf.WriteByte(krlSectionFingerprintSha256)
+		writeKrlString(buf, section.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func ParseKRL(data []byte) (*KRL, error) {
+	r := &krlReader{data: data}
+	if r.uint64() != krlMagic {
+		return nil, errors.New("not a krl: bad magic")
+	}
+	if version := r.uint32(); version != krlFormatVersion {
+		return nil, errors.Errorf("unsupported krl format version %d", version)
+	}
+
+	krl := newEmptyKRL()
+	krl.Version = r.uint64()
+	krl.GeneratedAt = time.Unix(int64(r.uint64()), 0)
+	r.uint64()  // flags
+	r.string()  // reserved
+	krl.Comment = string(r.string())
+
+	for r.err == nil && len(r.data) > 0 {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			r.err = krl.parseCertificatesSection(section)
+		case krlSectionFingerprintSha256:
+			for section.err == nil && len(section.data) > 0 {
+				hash := section.string()
+				if len(hash) != sha256.Size {
+					return nil, errors.New("krl: bad sha256 fingerprint length")
+				}
+				krl.fingerprints[string(hash)] = true
+			}
+			r.err = section.err
+		case krlSectionSignature:
+			// signatures come last and we don't check them
+			return krl, nil
+		default:
+			return nil, errors.Errorf("krl: unsupported section type %d", sectionType)
+		}
+	}
+
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "parsing krl")
+	}
+	return krl, nil
+}
+
+func (k *KRL) parseCertificatesSection(section *krlReader) error {
+	ca := string(section.string())
+	section.string() // reserved
+
+	if _, found := k.serials[ca]; !found {
+		k.serials[ca] = map[uint64]bool{}
+		k.keyIds[ca] = map[string]bool{}
+	}
+
+	for section.err == nil && len(section.data) > 0 {
+		subType := section.byte()
+		sub := &krlReader{data: section.string()}
+
+		switch subType {
+		case krlCertSectionSerialList:
+			for sub.err == nil && len(sub.data) > 0 {
+				k.serials[ca][sub.uint64()] = true
+			}
+		case krlCertSectionSerialRange:
+			lo, hi := sub.uint64(), sub.uint64()
+			if hi - lo > 1 << 20 {
+				return errors.New("krl: serial range too large")
+			}
+			for serial := lo; sub.err == nil && serial <= hi; serial++ {
+				k.serials[ca][serial] = true
+			}
+		case krlCertSectionKeyId:
+			for sub.err == nil && len(sub.data) > 0 {
+				k.keyIds[ca][string(sub.string())] = true
+			}
+		default:
+			return errors.Errorf("krl: unsupported certificate section type %d", subType)
+		}
+
+		if sub.err != nil {
+			return sub.err
+		}
+	}
+
+	return section.err
+}
+
+func writeKrlString(buf *bytes.Buffer, s []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.Write(s)
+}
+
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errors.New("krl: unexpected end of data")
+		return nil
+	}
+	ret := r.data[:n]
+	r.data = r.data[n:]
+	return ret
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func sortedStrings(set map[string]bool) []string {
+	ret := make([]string, 0, len(set))
+	for s := range set {
+		ret = append(ret, s)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sortedKeys(serials map[string]map[uint64]bool, keyIds map[string]map[string]bool) []string {
+	set := map[string]bool{}
+	for ca, s := range serials {
+		if len(s) > 0 {
+			set[ca] = true
+		}
+	}
+	for ca, k := range keyIds {
+		if len(k) > 0 {
+			set[ca] = true
+		}
+	}
+	return sortedStrings(set)
+}
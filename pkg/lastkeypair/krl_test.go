@@ -0,0 +1,142 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSshServer accepts logins by certificates signed by caKey that aren't
+// revoked by the KRL that *krl points to at the time.
+func testSshServer(t *testing.T, caKey ssh.PublicKey, krl **KRL) string {
+	hostKey, err := NewLocalCaSigner(testCaKeyBytes(t), nil)
+	assert.Nil(t, err)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(caKey.Marshal())
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return (*krl).IsRevoked(cert)
+		},
+	}
+
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, _, _, err := ssh.NewServerConn(conn, config)
+				if err == nil {
+					sconn.Close()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func testSshLogin(addr string, userKey []byte, signedPublicKey string) error {
+	signer, err := ssh.ParsePrivateKey(userKey)
+	if err != nil {
+		return err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedPublicKey))
+	if err != nil {
+		return err
+	}
+
+	certSigner, err := ssh.NewCertSigner(pub.(*ssh.Certificate), signer)
+	if err != nil {
+		return err
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	client.Close()
+	return nil
+}
+
+func TestKrlRevokesCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caSigner, err := NewLocalCaSigner(testCaKeyBytes(t), nil)
+	assert.Nil(t, err)
+
+	revocations := NewFileRevocationStore(filepath.Join(dir, "revocations.jsonl"))
+	config := LambdaConfig{CaSigner: caSigner, RevocationStore: revocations}
+
+	fetchKrl := func() *KRL {
+		resp, err := DoKrlReq(context.Background(), config)
+		assert.Nil(t, err)
+		krl, err := ParseKRL(resp.Krl)
+		assert.Nil(t, err)
+		return krl
+	}
+
+	krl := fetchKrl()
+	addr := testSshServer(t, caSigner.PublicKey(), &krl)
+
+	kp, err := GenerateKeyPair(DefaultKeyType)
+	assert.Nil(t, err)
+
+	sign := func(keyId string) (*ssh.Certificate, string) {
+		cert, err := SignSshCert(caSigner, kp.PublicKey, ssh.UserCert, uint64(time.Now().Unix() + 60), DefaultSshPermissions, keyId, []string{"ec2-user"})
+		assert.Nil(t, err)
+		return cert, FormatSshCert(cert)
+	}
+
+	first, firstSigned := sign("aidan")
+	_, secondSigned := sign("aidan")
+	_, otherSigned := sign("bob")
+	assert.Nil(t, testSshLogin(addr, kp.PrivateKey, firstSigned))
+
+	assert.Nil(t, revocations.Revoke(context.Background(), Revocation{Serial: first.Serial}))
+	krl = fetchKrl()
+	assert.NotNil(t, testSshLogin(addr, kp.PrivateKey, firstSigned))
+	assert.Nil(t, testSshLogin(addr, kp.PrivateKey, secondSigned))
+
+	assert.Nil(t, revocations.Revoke(context.Background(), Revocation{KeyId: "aidan"}))
+	krl = fetchKrl()
+	assert.NotNil(t, testSshLogin(addr, kp.PrivateKey, secondSigned))
+	assert.Nil(t, testSshLogin(addr, kp.PrivateKey, otherSigned))
+
+	fingerprint, err := PublicKeyFingerprint(kp.PublicKey)
+	assert.Nil(t, err)
+	assert.Nil(t, revocations.Revoke(context.Background(), Revocation{Fingerprint: fingerprint}))
+	krl = fetchKrl()
+	assert.NotNil(t, testSshLogin(addr, kp.PrivateKey, otherSigned))
+}
+
+func TestRevocationRequiresExactlyOneTarget(t *testing.T) {
+	assert.NotNil(t, Revocation{}.Validate())
+	assert.NotNil(t, Revocation{Serial: 1, KeyId: "aidan"}.Validate())
+	assert.NotNil(t, Revocation{Fingerprint: "MD5:00:11"}.Validate())
+	assert.Nil(t, Revocation{Serial: 1}.Validate())
+}
@@ -15,15 +15,141 @@ import (
 	"fmt"
 	"log"
 	"golang.org/x/crypto/ssh"
+	"context"
+	"strings"
+	"sync"
 )
 
+// DefaultHostValidityDuration is how long host certs last, in seconds, unless
+// HOST_VALIDITY_DURATION or the authorizer says otherwise. 'lkp host renew'
+// run daily renews them with days to spare.
+const DefaultHostValidityDuration = 7 * 24 * 60 * 60
+
 type LambdaConfig struct {
 	KeyId string
 	KmsTokenIdentity string
 	CaKeyBytes []byte
 	CaKeyPassphraseBytes []byte
+	CaKmsKeyId string
+	CaSigner ssh.Signer
+	// AdditionalCaPublicKeys are trusted alongside the signer's key, i.e. the
+	// next key during a rotation and then the retiring one.
+	AdditionalCaPublicKeys []ssh.PublicKey
+	// ValidityDuration is the default lifetime of user certs in seconds. The
+	// lifetime after the user and auth lambda have had their say is clamped
+	// to Min/MaxValidityDuration, if they're set.
 	ValidityDuration int64
+	MinValidityDuration int64
+	MaxValidityDuration int64
+	// HostValidityDuration is in seconds. Zero means
+	// DefaultHostValidityDuration. Only the authorizer can ask for host certs
+	// that never expire.
+	HostValidityDuration int64
+	// MaxVoucherValidityDuration is the longest, in seconds, that vouchers
+	// can be valid for. Zero means DefaultMaxVoucherValidity.
+	MaxVoucherValidityDuration int64
 	AuthorizationLambda string
+	// Authorizer, if set, is used instead of AuthorizationLambda. With neither,
+	// every request is denied.
+	Authorizer Authorizer
+	TokenAuthority TokenAuthority
+	AllowLegacyTokenContext bool
+	ReplayStore ReplayStore
+	IssuanceLedger IssuanceLedger
+	RevocationStore RevocationStore
+	AuditSink AuditSink
+}
+
+// tokenAuthority defaults to KMS so that callers constructing a LambdaConfig
+// by hand keep the behaviour they had before authorities were pluggable.
+func (c LambdaConfig) tokenAuthority() (TokenAuthority, error) {
+	if c.TokenAuthority != nil {
+		return c.TokenAuthority, nil
+	}
+
+	sess, err := LambdaAwsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	authority := NewKmsTokenAuthority(sess, c.KeyId)
+	authority.AllowLegacyContext = c.AllowLegacyTokenContext
+	return authority, nil
+}
+
+// caSigner prefers, in order: an explicit signer, an asymmetric KMS key and
+// finally the raw CA key bytes.
+func (c LambdaConfig) caSigner() (ssh.Signer, error) {
+	if c.CaSigner != nil {
+		return c.CaSigner, nil
+	}
+
+	if len(c.CaKmsKeyId) > 0 {
+		sess, err := LambdaAwsSession()
+		if err != nil {
+			return nil, err
+		}
+		return NewKmsSigner(sess, c.CaKmsKeyId)
+	}
+
+	return NewLocalCaSigner(c.CaKeyBytes, c.CaKeyPassphraseBytes)
+}
+
+// caTrustBundle is the active CA key followed by the additional keys.
+func (c LambdaConfig) caTrustBundle(active ssh.Signer) []ssh.PublicKey {
+	bundle := []ssh.PublicKey{active.PublicKey()}
+	seen := map[string]bool{string(active.PublicKey().Marshal()): true}
+
+	for _, key := range c.AdditionalCaPublicKeys {
+		if !seen[string(key.Marshal())] {
+			seen[string(key.Marshal())] = true
+			bundle = append(bundle, key)
+		}
+	}
+
+	return bundle
+}
+
+// signAndRecord signs a certificate and, if there is a ledger, records it. A
+// certificate is never returned unless it has been recorded. It's also added
+// to the request's audit event.
+func (c LambdaConfig) signAndRecord(ctx context.Context, audit *AuditEvent, signer ssh.Signer, params TokenParams, pubkeyBytes []byte, certType uint32, expiry uint64, permissions ssh.Permissions, keyId string, principals []string) (*string, error) {
+	cert, err := SignSshCert(signer, pubkeyBytes, certType, expiry, permissions, keyId, principals)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.IssuanceLedger != nil {
+		err = c.IssuanceLedger.Record(ctx, newIssuanceRecord(cert, params))
+		if err != nil {
+			return nil, errors.Wrap(err, "recording issued certificate")
+		}
+	}
+
+	audit.recordCertificate(cert)
+
+	formatted := FormatSshCert(cert)
+	return &formatted, nil
+}
+
+// validateRequestToken checks both the token itself and that it was issued
+// for the public key in the request.
+func (c LambdaConfig) validateRequestToken(ctx context.Context, token Token, publicKey string) error {
+	err := c.validateToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	return checkPublicKeyBinding(token, publicKey)
+}
+
+func (c LambdaConfig) validateToken(ctx context.Context, token Token) error {
+	authority, err := c.tokenAuthority()
+	if err != nil {
+		return err
+	}
+
+	return ValidateToken(ctx, authority, token, c.ReplayStore)
 }
 
 func getPstoreOrKmsOrRawBytes(name string) ([]byte, error) {
@@ -39,6 +165,8 @@ func getPstoreOrKmsOrRawBytes(name string) ([]byte, error) {
 		ssmResp, err := ssmClient.GetParameters(ssmInput)
 		if err != nil {
 			return nil, errors.Wrap(err, "decrypting key bytes from pstore")
+		} else if len(ssmResp.Parameters) == 0 {
+			return nil, errors.Errorf("parameter %s not found in pstore", pstoreName)
 		}
 
 		valstr := ssmResp.Parameters[0].Value
@@ -67,12 +195,25 @@ func getPstoreOrKmsOrRawBytes(name string) ([]byte, error) {
 	return bytes, nil
 }
 
-func LambdaHandle(evt json.RawMessage) (interface{}, error) {
+// LambdaHandle returns errors as *Error, so that the Lambda's error payload
+// starts with a stable error code.
+func LambdaHandle(ctx context.Context, evt json.RawMessage) (interface{}, error) {
+	resp, err := handleLambdaEvent(ctx, evt)
+	if err != nil {
+		log.Printf("error handling event: %+v", err)
+		return nil, NewError(err)
+	}
+	return resp, nil
+}
+
+func handleLambdaEvent(ctx context.Context, evt json.RawMessage) (interface{}, error) {
+	caKmsKeyId := os.Getenv("CA_KMS_KEY_ID")
+
 	caKeyBytes, err := getPstoreOrKmsOrRawBytes("CA_KEY_BYTES")
 	if err != nil {
 		return nil, err
-	} else if caKeyBytes == nil {
-		return nil, errors.New("no ca key bytes provided")
+	} else if caKeyBytes == nil && len(caKmsKeyId) == 0 {
+		return nil, errors.New("no ca key bytes or ca kms key provided")
 	}
 
 	caKeyPassphraseBytes, err := getPstoreOrKmsOrRawBytes("CA_KEY_PASSPHRASE_BYTES")
@@ -80,7 +221,48 @@ func LambdaHandle(evt json.RawMessage) (interface{}, error) {
 		return nil, err
 	}
 
-	validity, err := strconv.ParseInt(os.Getenv("VALIDITY_DURATION"), 10, 64)
+	tokenHmacKey, err := getPstoreOrKmsOrRawBytes("TOKEN_HMAC_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	trustedCaKeyBytes, err := getPstoreOrKmsOrRawBytes("CA_TRUSTED_PUBLIC_KEYS")
+	if err != nil {
+		return nil, err
+	}
+
+	additionalCaKeys, err := parseAuthorizedKeys(trustedCaKeyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing trusted ca public keys")
+	}
+
+	validity, err := durationFromEnv("VALIDITY_DURATION", 3600)
+	if err != nil {
+		return nil, err
+	}
+
+	minValidity, err := durationFromEnv("MIN_VALIDITY_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	maxValidity, err := durationFromEnv("MAX_VALIDITY_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hostValidity, err := durationFromEnv("HOST_VALIDITY_DURATION", DefaultHostValidityDuration)
+	if err != nil {
+		return nil, err
+	}
+	if hostValidity == 0 {
+		return nil, errors.New("invalid HOST_VALIDITY_DURATION \"0\": host certs must expire, so it must be at least 1 second")
+	}
+
+	maxVoucherValidity, err := durationFromEnv("MAX_VOUCHER_VALIDITY_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
 
 	kmsTokenIdentity := os.Getenv("KMS_TOKEN_IDENTITY")
 	if len(kmsTokenIdentity) == 0 {
@@ -92,8 +274,61 @@ func LambdaHandle(evt json.RawMessage) (interface{}, error) {
 		KmsTokenIdentity: kmsTokenIdentity,
 		CaKeyBytes: caKeyBytes,
 		CaKeyPassphraseBytes: caKeyPassphraseBytes,
+		CaKmsKeyId: caKmsKeyId,
+		AdditionalCaPublicKeys: additionalCaKeys,
 		ValidityDuration: validity,
+		MinValidityDuration: minValidity,
+		MaxValidityDuration: maxValidity,
+		HostValidityDuration: hostValidity,
+		MaxVoucherValidityDuration: maxVoucherValidity,
 		AuthorizationLambda: os.Getenv("AUTHORIZATION_LAMBDA"),
+		AllowLegacyTokenContext: os.Getenv("ALLOW_LEGACY_TOKEN_CONTEXT") == "true",
+	}
+
+	if tokenHmacKey != nil {
+		authority := NewHmacTokenAuthority(tokenHmacKey)
+		authority.AllowLegacyContext = config.AllowLegacyTokenContext
+		config.TokenAuthority = authority
+	}
+
+	if table := os.Getenv("REPLAY_TABLE"); len(table) > 0 {
+		sess, err := LambdaAwsSession()
+		if err != nil {
+			return nil, err
+		}
+		config.ReplayStore = NewDynamoReplayStore(sess, table)
+	} else if path := os.Getenv("REPLAY_FILE"); len(path) > 0 {
+		config.ReplayStore = NewFileReplayStore(path)
+	}
+
+	if table := os.Getenv("LEDGER_TABLE"); len(table) > 0 {
+		sess, err := LambdaAwsSession()
+		if err != nil {
+			return nil, err
+		}
+		config.IssuanceLedger = NewDynamoIssuanceLedger(sess, table)
+	} else if path := os.Getenv("LEDGER_FILE"); len(path) > 0 {
+		config.IssuanceLedger = NewFileIssuanceLedger(path)
+	}
+
+	if table := os.Getenv("REVOCATION_TABLE"); len(table) > 0 {
+		sess, err := LambdaAwsSession()
+		if err != nil {
+			return nil, err
+		}
+		config.RevocationStore = NewDynamoRevocationStore(sess, table)
+	} else if path := os.Getenv("REVOCATION_FILE"); len(path) > 0 {
+		config.RevocationStore = NewFileRevocationStore(path)
+	}
+
+	config.AuditSink, err = auditSinkFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	config.Authorizer, err = authorizerFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
 	raw := make(map[string]string)
@@ -104,22 +339,248 @@ func LambdaHandle(evt json.RawMessage) (interface{}, error) {
 		req := UserCertReqJson{}
 		err := json.Unmarshal(evt, &req)
 		if err != nil {
-			return nil, errors.Wrap(err, "unmarshalling input")
+			return nil, errors.Wrap(ErrBadRequest, err.Error())
+		}
+		return DoUserCertReq(ctx, req, config)
+	case "SimulateUserCertReq":
+		req := UserCertReqJson{}
+		err := json.Unmarshal(evt, &req)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, err.Error())
 		}
-		return DoUserCertReq(req, config)
+		return DoSimulateUserCertReq(ctx, req, config)
 	case "HostCertReq":
 		req := HostCertReqJson{}
 		err := json.Unmarshal(evt, &req)
 		if err != nil {
-			return nil, errors.Wrap(err, "unmarshalling input")
+			return nil, errors.Wrap(ErrBadRequest, err.Error())
 		}
-		return DoHostCertReq(req, config)
+		return DoHostCertReq(ctx, req, config)
+	case "KrlReq":
+		return DoKrlReq(ctx, config)
+	case "CaKeysReq":
+		return DoCaKeysReq(ctx, config)
 	default:
-		return nil, errors.New("unexpected event type")
+		return nil, errors.Wrapf(ErrBadRequest, "unexpected event type %q", raw["EventType"])
 	}
 }
 
-func LambdaAwsSession() *session.Session {
+// auditSinkFromEnv always includes stdout (i.e. CloudWatch Logs) unless
+// AUDIT_STDOUT is "false".
+func auditSinkFromEnv() (AuditSink, error) {
+	sinks := MultiAuditSink{}
+
+	if os.Getenv("AUDIT_STDOUT") != "false" {
+		sinks = append(sinks, NewStdoutAuditSink())
+	}
+
+	if path := os.Getenv("AUDIT_FILE"); len(path) > 0 {
+		sinks = append(sinks, NewFileAuditSink(path))
+	}
+
+	if url := os.Getenv("AUDIT_WEBHOOK_URL"); len(url) > 0 {
+		secret, err := getPstoreOrKmsOrRawBytes("AUDIT_WEBHOOK_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, NewWebhookAuditSink(url, secret))
+	}
+
+	return sinks, nil
+}
+
+// authorizerFromEnv denies everything if no authorizer is configured, unless
+// AUTHORIZER is allow-all. If several are, every one of them must allow a
+// request.
+func authorizerFromEnv() (Authorizer, error) {
+	chain := ChainAuthorizer{}
+
+	allowAll := false
+	switch mode := os.Getenv("AUTHORIZER"); mode {
+	case "allow-all":
+		allowAll = true
+	case "":
+	default:
+		return nil, errors.Errorf("unknown AUTHORIZER %q, the only option is allow-all", mode)
+	}
+
+	policy, err := policyFromEnv()
+	if err != nil {
+		return nil, err
+	} else if policy != nil {
+		chain = append(chain, policy)
+	}
+
+	if name := os.Getenv("AUTHORIZATION_LAMBDA"); len(name) > 0 {
+		lambdaAuthorizer, err := lambdaAuthorizerFromEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, lambdaAuthorizer)
+	}
+
+	if url := os.Getenv("AUTHORIZER_WEBHOOK_URL"); len(url) > 0 {
+		secret, err := getPstoreOrKmsOrRawBytes("AUTHORIZER_WEBHOOK_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		webhook, err := NewWebhookAuthorizer(url, secret)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, webhook)
+	}
+
+	if command := os.Getenv("AUTHORIZER_COMMAND"); len(command) > 0 {
+		chain = append(chain, NewExecAuthorizer("/bin/sh", "-c", command))
+	}
+
+	switch {
+	case len(chain) == 0 && allowAll:
+		return AllowAllAuthorizer{}, nil
+	case len(chain) == 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+var (
+	lambdaAuthorizersMu sync.Mutex
+	lambdaAuthorizers   = map[string]Authorizer{}
+)
+
+// sharedAuthorizer returns the authorizer built for key, building it the
+// first time, so that it lasts for as long as the CA's container is warm.
+func sharedAuthorizer(key string, build func() Authorizer) Authorizer {
+	lambdaAuthorizersMu.Lock()
+	defer lambdaAuthorizersMu.Unlock()
+
+	if authorizer, ok := lambdaAuthorizers[key]; ok {
+		return authorizer
+	}
+
+	authorizer := build()
+	lambdaAuthorizers[key] = authorizer
+	return authorizer
+}
+
+// lambdaAuthorizerSettings are the AUTHORIZATION_LAMBDA_* and
+// AUTHORIZATION_CACHE_TTL variables, durations in seconds.
+type lambdaAuthorizerSettings struct {
+	name      string
+	timeout   int64
+	retries   int64
+	threshold int64
+	cooldown  int64
+	cacheTtl  int64
+}
+
+// lambdaAuthorizerFromEnv returns the same authorizer for as long as the
+// CA's container is warm and its settings don't change, so that its client,
+// circuit breaker and cache outlive a single request.
+func lambdaAuthorizerFromEnv(name string) (Authorizer, error) {
+	settings := lambdaAuthorizerSettings{name: name}
+
+	var err error
+	settings.timeout, err = durationFromEnv("AUTHORIZATION_LAMBDA_TIMEOUT", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.retries, err = countFromEnv("AUTHORIZATION_LAMBDA_RETRIES", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.threshold, err = countFromEnv("AUTHORIZATION_LAMBDA_BREAKER_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.cooldown, err = durationFromEnv("AUTHORIZATION_LAMBDA_BREAKER_COOLDOWN", 30)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.cacheTtl, err = durationFromEnv("AUTHORIZATION_CACHE_TTL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings.authorizer()
+}
+
+func (s lambdaAuthorizerSettings) authorizer() (Authorizer, error) {
+	if s.timeout == 0 {
+		return nil, errors.New("invalid AUTHORIZATION_LAMBDA_TIMEOUT \"0\": must be at least 1 second")
+	}
+
+	key := fmt.Sprintf("%s/%d/%d/%d/%d/%d", s.name, s.timeout, s.retries, s.threshold, s.cooldown, s.cacheTtl)
+	return sharedAuthorizer(key, func() Authorizer {
+		lambdaAuthorizer := NewLambdaAuthorizer(s.name)
+		lambdaAuthorizer.Timeout = time.Duration(s.timeout) * time.Second
+		lambdaAuthorizer.Retries = int(s.retries)
+		lambdaAuthorizer.BreakerThreshold = int(s.threshold)
+		lambdaAuthorizer.BreakerCooldown = time.Duration(s.cooldown) * time.Second
+
+		if s.cacheTtl > 0 {
+			return NewCachingAuthorizer(lambdaAuthorizer, time.Duration(s.cacheTtl) * time.Second)
+		}
+		return lambdaAuthorizer
+	}), nil
+}
+
+// policyFromEnv reads POLICY_DOCUMENT (raw, KMS-encrypted or from Parameter
+// Store) or else POLICY_FILE.
+func policyFromEnv() (*PolicyAuthorizer, error) {
+	raw, err := getPstoreOrKmsOrRawBytes("POLICY_DOCUMENT")
+	if err != nil {
+		return nil, err
+	}
+
+	var doc *PolicyDocument
+	if raw != nil {
+		doc, err = ParsePolicyDocument(raw)
+	} else if path := os.Getenv("POLICY_FILE"); len(path) > 0 {
+		doc, err = ReadPolicyDocument(path)
+	} else {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return NewPolicyAuthorizer(doc)
+}
+
+// durationFromEnv parses a number of seconds, or returns def if name is unset.
+func durationFromEnv(name string, def int64) (int64, error) {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return def, nil
+	}
+
+	duration, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || duration < 0 {
+		return 0, errors.Errorf("invalid %s %q: must be a number of seconds", name, raw)
+	}
+	return duration, nil
+}
+
+func countFromEnv(name string, def int64) (int64, error) {
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return def, nil
+	}
+
+	count, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || count < 0 {
+		return 0, errors.Errorf("invalid %s %q: must be a whole number", name, raw)
+	}
+	return count, nil
+}
+
+func LambdaAwsSession() (*session.Session, error) {
 	sessOpts := session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
@@ -127,17 +588,43 @@ func LambdaAwsSession() *session.Session {
 
 	sess, err := session.NewSessionWithOptions(sessOpts)
 	if err != nil {
-		log.Panicf("couldn't create aws session")
+		return nil, errors.Wrap(err, "creating aws session")
 	}
 
-	return sess
+	return sess, nil
 }
 
-func DoHostCertReq(req HostCertReqJson, config LambdaConfig) (*HostCertRespJson, error) {
-	sess := LambdaAwsSession()
+func DoHostCertReq(ctx context.Context, req HostCertReqJson, config LambdaConfig) (*HostCertRespJson, error) {
+	publicKeys := []string{req.PublicKey}
+	if len(req.PublicKeys) > 0 {
+		publicKeys = req.PublicKeys
+	}
 
-	if !ValidateToken(sess, req.Token, config.KeyId) {
-		return nil, errors.New("invalid token")
+	audit := newAuditEvent("HostCertReq", req.Token.Params, publicKeys)
+	resp, err := doHostCertReq(ctx, req, config, audit)
+	config.emitAudit(ctx, audit, err)
+	return resp, err
+}
+
+func doHostCertReq(ctx context.Context, req HostCertReqJson, config LambdaConfig, audit *AuditEvent) (*HostCertRespJson, error) {
+	publicKeys := []string{req.PublicKey}
+	var err error
+
+	if len(req.PublicKeys) > 0 {
+		if len(req.PublicKey) > 0 {
+			return nil, errors.Wrap(ErrBadRequest, "only one of PublicKey and PublicKeys may be set")
+		}
+
+		publicKeys = req.PublicKeys
+		err = config.validateToken(ctx, req.Token)
+		if err == nil {
+			err = checkPublicKeysBinding(req.Token, publicKeys)
+		}
+	} else {
+		err = config.validateRequestToken(ctx, req.Token, req.PublicKey)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	permissions := ssh.Permissions{
@@ -145,106 +632,281 @@ func DoHostCertReq(req HostCertReqJson, config LambdaConfig) (*HostCertRespJson,
 		Extensions: map[string]string{},
 	}
 
-	authLambda := NewAuthorizationLambda(config)
-	auth, err := authLambda.DoHostReq(req)
+	auth, err := config.authorizeHost(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "authorising host cert")
+	}
 
-	signed, err := SignSsh(
-		config.CaKeyBytes,
-		config.CaKeyPassphraseBytes,
-		[]byte(req.PublicKey),
-		ssh.HostCert,
-		ssh.CertTimeInfinity,
-		permissions,
-		auth.KeyId,
-		auth.Principals,
-	)
+	audit.recordAuthorizer(auth.Authorized, auth.Message)
+	if !auth.Authorized {
+		errorMessage := "host cert denied by authorizer"
+		if len(auth.Message) > 0 {
+			errorMessage = auth.Message
+		}
+		return nil, errors.Wrap(ErrUnauthorized, errorMessage)
+	}
 
+	err = auth.validate()
 	if err != nil {
-		return nil, errors.Wrap(err, "signing ssh key")
+		return nil, err
 	}
 
-	resp := HostCertRespJson{
-		SignedHostPublicKey: *signed,
+	signer, err := config.caSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	validity := config.HostValidityDuration
+	if validity <= 0 {
+		validity = DefaultHostValidityDuration
+	}
+	if auth.ValidityDuration != nil {
+		validity = *auth.ValidityDuration
+	}
+	if auth.MaxValidityDuration != nil && (validity == 0 || validity > *auth.MaxValidityDuration) {
+		validity = *auth.MaxValidityDuration
+	}
+
+	expiry := uint64(ssh.CertTimeInfinity)
+	if validity > 0 {
+		expiry = uint64(time.Now().Unix() + validity)
+	}
+
+	resp := HostCertRespJson{}
+	for _, publicKey := range publicKeys {
+		signed, err := config.signAndRecord(
+			ctx,
+			audit,
+			signer,
+			req.Token.Params,
+			[]byte(publicKey),
+			ssh.HostCert,
+			expiry,
+			permissions,
+			auth.KeyId,
+			auth.Principals,
+		)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "signing ssh key")
+		}
+
+		if len(req.PublicKeys) > 0 {
+			resp.SignedHostPublicKeys = append(resp.SignedHostPublicKeys, *signed)
+		} else {
+			resp.SignedHostPublicKey = *signed
+		}
+	}
+
+	if expiry != ssh.CertTimeInfinity {
+		resp.Expiry = int64(expiry)
 	}
 
 	return &resp, nil
 }
 
-func GenerateSshPermissions(options *CertificateOptions) ssh.Permissions {
-	var SshPermissions = ssh.Permissions{
-		CriticalOptions: map[string]string{},
-		Extensions: map[string]string{
-			"permit-X11-forwarding":   "",
-			"permit-agent-forwarding": "",
-			"permit-port-forwarding":  "",
-			"permit-pty":              "",
-			"permit-user-rc":          "",
-		},
+func DoKrlReq(ctx context.Context, config LambdaConfig) (*KrlRespJson, error) {
+	signer, err := config.caSigner()
+	if err != nil {
+		return nil, err
 	}
-	if options != nil {
-		if options.ForceCommand != nil {
-			SshPermissions.Extensions["force-command"] = *options.ForceCommand
-		}
-		if options.SourceAddress != nil {
-			SshPermissions.Extensions["source-address"] = *options.SourceAddress
+
+	revocations := []Revocation{}
+	if config.RevocationStore != nil {
+		revocations, err = config.RevocationStore.Revocations(ctx)
+		if err != nil {
+			return nil, err
 		}
-		if options.PermitX11Forwarding == false {
-			delete(SshPermissions.Extensions, "permit-X11-forwarding")
+	}
+
+	krl, err := NewKRL(config.caTrustBundle(signer), revocations)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KrlRespJson{Krl: krl.Marshal()}, nil
+}
+
+func DoCaKeysReq(ctx context.Context, config LambdaConfig) (*CaKeysRespJson, error) {
+	signer, err := config.caSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaKeysRespJson{
+		ActiveKey:   marshalAuthorizedKey(signer.PublicKey()),
+		TrustedKeys: marshalAuthorizedKeys(config.caTrustBundle(signer)),
+	}, nil
+}
+
+func parseAuthorizedKeys(authorizedKeys []byte) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	for len(strings.TrimSpace(string(authorizedKeys))) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeys)
+		if err != nil {
+			return nil, err
 		}
-		if options.PermitAgentForwarding == false {
-			delete(SshPermissions.Extensions, "permit-agent-forwarding")
+		keys = append(keys, key)
+		authorizedKeys = rest
+	}
+	return keys, nil
+}
+
+func marshalAuthorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func marshalAuthorizedKeys(keys []ssh.PublicKey) []string {
+	ret := []string{}
+	for _, key := range keys {
+		ret = append(ret, marshalAuthorizedKey(key))
+	}
+	return ret
+}
+
+// checkPublicKeyBinding ensures that the key we've been asked to sign is the
+// one the requester authenticated. Legacy tokens predate the binding and are
+// only accepted at all during the kms context migration window.
+func checkPublicKeyBinding(token Token, publicKey string) error {
+	if token.ContextVersion < KmsContextVersion {
+		return nil
+	}
+
+	fingerprint, err := PublicKeyFingerprint([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+
+	if fingerprint != token.Params.PublicKeyFingerprint {
+		return errors.Wrapf(ErrPublicKeyMismatch, "public key %s", fingerprint)
+	}
+
+	return nil
+}
+
+// checkPublicKeysBinding is checkPublicKeyBinding for batched host key
+// requests. The fingerprints must be in the same order as the keys.
+func checkPublicKeysBinding(token Token, publicKeys []string) error {
+	if token.ContextVersion < KmsContextVersion {
+		return nil
+	}
+
+	if len(publicKeys) != len(token.Params.PublicKeyFingerprints) {
+		return errors.Wrapf(ErrPublicKeyMismatch, "%d public keys for %d fingerprints", len(publicKeys), len(token.Params.PublicKeyFingerprints))
+	}
+
+	for i, publicKey := range publicKeys {
+		fingerprint, err := PublicKeyFingerprint([]byte(publicKey))
+		if err != nil {
+			return err
 		}
-		if options.PermitPortForwarding == false {
-			delete(SshPermissions.Extensions, "permit-port-forwarding")
+
+		if fingerprint != token.Params.PublicKeyFingerprints[i] {
+			return errors.Wrapf(ErrPublicKeyMismatch, "public key %s", fingerprint)
 		}
 	}
 
-	return SshPermissions
+	return nil
 }
 
-func DoUserCertReq(req UserCertReqJson, config LambdaConfig) (*UserCertRespJson, error) {
-	sess := LambdaAwsSession()
+// userCertValidity works out a user cert's lifetime in seconds. The auth
+// lambda can replace the default, the user can ask for less and the auth
+// lambda can cap that. Then the result is clamped to the configured bounds.
+func (c LambdaConfig) userCertValidity(requested int64, auth *LkpUserCertAuthorizationResponse) int64 {
+	validity := c.ValidityDuration
+	if auth.ValidityDuration != nil {
+		validity = *auth.ValidityDuration
+	}
+
+	if requested > 0 && requested < validity {
+		validity = requested
+	}
+
+	if auth.MaxValidityDuration != nil && validity > *auth.MaxValidityDuration {
+		validity = *auth.MaxValidityDuration
+	}
+
+	if c.MinValidityDuration > 0 && validity < c.MinValidityDuration {
+		validity = c.MinValidityDuration
+	}
+	if c.MaxValidityDuration > 0 && validity > c.MaxValidityDuration {
+		validity = c.MaxValidityDuration
+	}
+
+	return validity
+}
 
-	if !ValidateToken(sess, req.Token, config.KeyId) {
-		return nil, errors.New("invalid token")
+// tokenIdentity is used as the key id of user certificates.
+func tokenIdentity(params TokenParams) string {
+	if len(params.FromName) > 0 {
+		return fmt.Sprintf("%s-%s", params.FromName, params.FromId)
 	}
+	return params.FromId
+}
 
-	identity := req.Token.Params.FromId
-	if name := req.Token.Params.FromName; len(name) > 0 {
-		identity = fmt.Sprintf("%s-%s", name, identity)
+func DoUserCertReq(ctx context.Context, req UserCertReqJson, config LambdaConfig) (*UserCertRespJson, error) {
+	audit := newAuditEvent("UserCertReq", req.Token.Params, []string{req.PublicKey})
+	resp, err := doUserCertReq(ctx, req, config, audit)
+	config.emitAudit(ctx, audit, err)
+	return resp, err
+}
+
+// userCertDecision is everything about a user cert request except the
+// signatures, so that it can be simulated.
+type userCertDecision struct {
+	auth                *LkpUserCertAuthorizationResponse // with jumpbox defaults filled in
+	validity            int64
+	permissions         ssh.Permissions
+	jumpboxPermissions  []ssh.Permissions
+}
+
+func decideUserCert(ctx context.Context, req UserCertReqJson, config LambdaConfig, audit *AuditEvent) (*userCertDecision, error) {
+	err := config.validateRequestToken(ctx, req.Token, req.PublicKey)
+	if err != nil {
+		return nil, err
 	}
 
 	instanceArn := req.Token.Params.RemoteInstanceArn
 	if len(instanceArn) == 0 {
-		return nil, errors.New("target instance arn must be specified")
+		return nil, errors.Wrap(ErrBadRequest, "target instance arn must be specified")
+	}
+
+	// the authorizer only gets to see vouchers that check out
+	vouchers, rejected, err := config.verifyVouchers(ctx, req.Token.Params)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying vouchers")
 	}
+	req.Token.Params.Vouchers = vouchers
+	audit.recordVouchers(vouchers, rejected)
 
-	authLambda := NewAuthorizationLambda(config)
-	auth, err := authLambda.DoUserReq(req)
+	auth, err := config.authorizeUser(ctx, req)
 	if err != nil {
 		return nil, errors.Wrap(err, "authorising user cert")
 	}
 
+	audit.recordAuthorizer(auth.Authorized, auth.Message)
 	if !auth.Authorized {
 		errorMessage := "authorisation denied by auth lambda"
 		if len(auth.Message) > 0 {
 			errorMessage = auth.Message
 		}
-		return nil, errors.New(errorMessage)
+		return nil, errors.Wrap(ErrUnauthorized, errorMessage)
 	}
 
-	SshPermissions := GenerateSshPermissions(auth.CertificateOptions)
+	err = auth.validate()
+	if err != nil {
+		return nil, err
+	}
 
-	signed, err := SignSsh(
-		config.CaKeyBytes,
-		config.CaKeyPassphraseBytes,
-		[]byte(req.PublicKey),
-		ssh.UserCert,
-		uint64(time.Now().Unix() + config.ValidityDuration),
-		SshPermissions,
-		identity,
-		auth.Principals,
-	)
+	decision := &userCertDecision{
+		auth:     auth,
+		validity: config.userCertValidity(req.ValidityDuration, auth),
+	}
+
+	decision.permissions, err = GenerateSshPermissions(auth.CertificateOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid certificate options from auth lambda")
+	}
 
 	for idx := range auth.Jumpboxes {
 		j := &auth.Jumpboxes[idx]
@@ -254,35 +916,101 @@ func DoUserCertReq(req UserCertReqJson, config LambdaConfig) (*UserCertRespJson,
 		if len(j.Principals) == 0 {
 			j.Principals = append(j.Principals, j.Address)
 		}
-		jSshPermissions := GenerateSshPermissions(j.CertificateOptions)
-		jSigned, jErr := SignSsh(
-			config.CaKeyBytes,
-			config.CaKeyPassphraseBytes,
-			[]byte(req.PublicKey),
-			ssh.UserCert,
-			uint64(time.Now().Unix() + config.ValidityDuration),
-			jSshPermissions,
-			identity,
-			j.Principals,
-		)
-		j.SignedPublicKey = *jSigned
+		jSshPermissions, jErr := GenerateSshPermissions(j.CertificateOptions)
 		if jErr != nil {
-			return nil, errors.Wrap(err, "error signing ssh key for jumphost")
+			return nil, errors.Wrap(jErr, "invalid jumpbox certificate options from auth lambda")
 		}
+		decision.jumpboxPermissions = append(decision.jumpboxPermissions, jSshPermissions)
+	}
+
+	return decision, nil
+}
+
+func doUserCertReq(ctx context.Context, req UserCertReqJson, config LambdaConfig, audit *AuditEvent) (*UserCertRespJson, error) {
+	decision, err := decideUserCert(ctx, req, config, audit)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := tokenIdentity(req.Token.Params)
+	auth := decision.auth
+	expiry := time.Now().Add(time.Duration(decision.validity) * time.Second)
+
+	signer, err := config.caSigner()
+	if err != nil {
+		return nil, err
 	}
 
+	signed, err := config.signAndRecord(
+		ctx,
+		audit,
+		signer,
+		req.Token.Params,
+		[]byte(req.PublicKey),
+		ssh.UserCert,
+		uint64(expiry.Unix()),
+		decision.permissions,
+		identity,
+		auth.Principals,
+	)
 	if err != nil {
 		return nil, errors.Wrap(err, "error signing ssh key")
 	}
 
-	expiry := time.Now().Add(time.Duration(config.ValidityDuration) * time.Second)
+	for idx := range auth.Jumpboxes {
+		j := &auth.Jumpboxes[idx]
+		jSigned, jErr := config.signAndRecord(
+			ctx,
+			audit,
+			signer,
+			req.Token.Params,
+			[]byte(req.PublicKey),
+			ssh.UserCert,
+			uint64(expiry.Unix()),
+			decision.jumpboxPermissions[idx],
+			identity,
+			j.Principals,
+		)
+		if jErr != nil {
+			return nil, errors.Wrap(jErr, "error signing ssh key for jumphost")
+		}
+		j.SignedPublicKey = *jSigned
+	}
 
 	resp := UserCertRespJson{
 		SignedPublicKey: *signed,
 		Jumpboxes: auth.Jumpboxes,
 		TargetAddress: auth.TargetAddress,
 		Expiry: expiry.Unix(),
+		TrustedCaKeys: marshalAuthorizedKeys(config.caTrustBundle(signer)),
 	}
 
 	return &resp, nil
 }
+
+// DoSimulateUserCertReq goes through everything DoUserCertReq does except
+// signing. Denials are part of the response rather than errors, so that
+// they can be shown to the user.
+func DoSimulateUserCertReq(ctx context.Context, req UserCertReqJson, config LambdaConfig) (*SimulateUserCertRespJson, error) {
+	audit := newAuditEvent("SimulateUserCertReq", req.Token.Params, []string{req.PublicKey})
+	decision, err := decideUserCert(ctx, req, config, audit)
+	config.emitAudit(ctx, audit, err)
+
+	if err != nil {
+		return &SimulateUserCertRespJson{
+			Allowed:   false,
+			ErrorCode: ErrorCode(err),
+			Message:   err.Error(),
+		}, nil
+	}
+
+	return &SimulateUserCertRespJson{
+		Allowed:          true,
+		Principals:       decision.auth.Principals,
+		Jumpboxes:        decision.auth.Jumpboxes,
+		TargetAddress:    decision.auth.TargetAddress,
+		CriticalOptions:  decision.permissions.CriticalOptions,
+		Extensions:       decision.permissions.Extensions,
+		ValidityDuration: decision.validity,
+	}, nil
+}
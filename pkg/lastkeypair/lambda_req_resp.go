@@ -7,12 +7,18 @@ type UserCertReqJson struct {
 	EventType string
 	Token Token
 	PublicKey string
+	// ValidityDuration (in seconds) can only shorten the cert's lifetime, so
+	// it doesn't need to be part of the token.
+	ValidityDuration int64 `json:",omitempty"`
 }
 
 type HostCertReqJson struct {
 	EventType string
 	Token Token
 	PublicKey string
+	// PublicKeys is set instead of PublicKey to sign several host keys (e.g.
+	// rsa, ecdsa and ed25519) in one request.
+	PublicKeys []string `json:",omitempty"`
 }
 
 type UserCertRespJson struct {
@@ -20,6 +26,23 @@ type UserCertRespJson struct {
 	Jumpboxes []Jumpbox `json:",omitempty"`
 	TargetAddress string `json:",omitempty"`
 	Expiry int64
+	TrustedCaKeys []string `json:",omitempty"` // authorized_keys format, for @cert-authority lines
+}
+
+// SimulateUserCertRespJson is the response to a SimulateUserCertReq, which
+// takes a UserCertReqJson. Nothing is signed, so the jumpboxes have no
+// SignedPublicKey.
+type SimulateUserCertRespJson struct {
+	Allowed   bool
+	ErrorCode string `json:",omitempty"`
+	Message   string `json:",omitempty"`
+
+	Principals       []string          `json:",omitempty"`
+	Jumpboxes        []Jumpbox         `json:",omitempty"`
+	TargetAddress    string            `json:",omitempty"`
+	CriticalOptions  map[string]string `json:",omitempty"`
+	Extensions       map[string]string `json:",omitempty"`
+	ValidityDuration int64             `json:",omitempty"` // seconds
 }
 
 type Jumpbox struct {
@@ -31,14 +54,30 @@ type Jumpbox struct {
 	CertificateOptions *CertificateOptions
 }
 
-type CertificateOptions struct {
-	ForceCommand  *string `json:",omitempty"`
-	SourceAddress *string `json:",omitempty"`
-	PermitX11Forwarding bool
-	PermitAgentForwarding bool
-	PermitPortForwarding bool
-}
-
 type HostCertRespJson struct {
 	SignedHostPublicKey string
+	SignedHostPublicKeys []string `json:",omitempty"` // in the same order as the request's PublicKeys
+	Expiry int64 `json:",omitempty"` // unset if the cert never expires
+}
+
+// KrlReqJson needs no token: the KRL is public, and hosts need to be able to
+// fetch it even if their own credentials have been revoked.
+type KrlReqJson struct {
+	EventType string
+}
+
+type KrlRespJson struct {
+	Krl []byte // binary OpenSSH KRL, suitable for sshd's RevokedKeys
+}
+
+// CaKeysReqJson, like KrlReqJson, needs no token.
+type CaKeysReqJson struct {
+	EventType string
+}
+
+// CaKeysRespJson keys are in authorized_keys format. TrustedKeys includes
+// ActiveKey, along with any keys being rotated in or out.
+type CaKeysRespJson struct {
+	ActiveKey   string
+	TrustedKeys []string
 }
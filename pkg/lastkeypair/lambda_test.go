@@ -0,0 +1,174 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostCertReqValidity(t *testing.T) {
+	params := testTokenParams()
+	params.Type = "AssumedRole"
+	params.HostInstanceArn = params.RemoteInstanceArn
+	hostKey := testKeyPair(t, &params)
+
+	sign := func(validity int64) (*HostCertRespJson, *ssh.Certificate) {
+		config := testCaConfig(t)
+		config.HostValidityDuration = validity
+
+		resp, err := DoHostCertReq(context.Background(), HostCertReqJson{
+			EventType: "HostCertReq",
+			Token: mustCreateToken(t, config.TokenAuthority, params),
+			PublicKey: string(hostKey.PublicKey),
+		}, config)
+		assert.Nil(t, err)
+		return resp, parseTestCert(t, resp.SignedHostPublicKey)
+	}
+
+	resp, cert := sign(0)
+	assert.InDelta(t, time.Now().Unix() + DefaultHostValidityDuration, int64(cert.ValidBefore), 5)
+	assert.Equal(t, int64(cert.ValidBefore), resp.Expiry)
+
+	resp, cert = sign(3600)
+	expected := time.Now().Unix() + 3600
+	assert.InDelta(t, expected, int64(cert.ValidBefore), 5)
+	assert.Equal(t, int64(cert.ValidBefore), resp.Expiry)
+	assert.Equal(t, []string{params.HostInstanceArn}, cert.ValidPrincipals)
+}
+
+func TestHostCertReqSignsSeveralKeys(t *testing.T) {
+	config := testCaConfig(t)
+
+	params := testTokenParams()
+	params.Type = "AssumedRole"
+	params.HostInstanceArn = params.RemoteInstanceArn
+
+	publicKeys := []string{}
+	for _, keyType := range []KeyType{KeyTypeEd25519, KeyTypeEcdsaP256} {
+		kp, err := GenerateKeyPair(keyType)
+		assert.Nil(t, err)
+		fingerprint, err := PublicKeyFingerprint(kp.PublicKey)
+		assert.Nil(t, err)
+		params.PublicKeyFingerprints = append(params.PublicKeyFingerprints, fingerprint)
+		publicKeys = append(publicKeys, string(kp.PublicKey))
+	}
+
+	resp, err := DoHostCertReq(context.Background(), HostCertReqJson{
+		EventType: "HostCertReq",
+		Token: mustCreateToken(t, config.TokenAuthority, params),
+		PublicKeys: publicKeys,
+	}, config)
+	assert.Nil(t, err)
+	assert.Len(t, resp.SignedHostPublicKeys, 2)
+
+	for i, signed := range resp.SignedHostPublicKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKeys[i]))
+		assert.Nil(t, err)
+		assert.Equal(t, key.Marshal(), parseTestCert(t, signed).Key.Marshal())
+	}
+
+	// the keys must be the ones the token was issued for, in order
+	_, err = DoHostCertReq(context.Background(), HostCertReqJson{
+		EventType: "HostCertReq",
+		Token: mustCreateToken(t, config.TokenAuthority, params),
+		PublicKeys: []string{publicKeys[1], publicKeys[0]},
+	}, config)
+	assert.Equal(t, ErrPublicKeyMismatch, errors.Cause(err))
+}
+
+func TestUserCertValidity(t *testing.T) {
+	seconds := func(n int64) *int64 { return &n }
+
+	config := LambdaConfig{ValidityDuration: 3600, MinValidityDuration: 60, MaxValidityDuration: 28800}
+	none := &LkpUserCertAuthorizationResponse{}
+
+	assert.Equal(t, int64(3600), config.userCertValidity(0, none))
+	assert.Equal(t, int64(300), config.userCertValidity(300, none))
+	assert.Equal(t, int64(3600), config.userCertValidity(7200, none), "users can only shorten their certs")
+	assert.Equal(t, int64(60), config.userCertValidity(10, none))
+
+	dev := &LkpUserCertAuthorizationResponse{ValidityDuration: seconds(28800)}
+	assert.Equal(t, int64(28800), config.userCertValidity(0, dev))
+	assert.Equal(t, int64(600), config.userCertValidity(600, dev))
+
+	prod := &LkpUserCertAuthorizationResponse{MaxValidityDuration: seconds(300)}
+	assert.Equal(t, int64(300), config.userCertValidity(0, prod))
+	assert.Equal(t, int64(120), config.userCertValidity(120, prod))
+
+	tooLong := &LkpUserCertAuthorizationResponse{ValidityDuration: seconds(86400)}
+	assert.Equal(t, int64(28800), config.userCertValidity(0, tooLong))
+}
+
+func TestUserCertReqDuration(t *testing.T) {
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	req := testUserCertReq(t, params, kp)
+	req.ValidityDuration = 300
+	resp, err := DoUserCertReq(context.Background(), req, testCaConfig(t))
+	assert.Nil(t, err)
+
+	cert := parseTestCert(t, resp.SignedPublicKey)
+	assert.InDelta(t, time.Now().Unix() + 300, int64(cert.ValidBefore), 5)
+	assert.Equal(t, int64(cert.ValidBefore), resp.Expiry)
+}
+
+func TestUserCertReqRejectsNonPositiveDurations(t *testing.T) {
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	for _, seconds := range []int64{0, -60} {
+		seconds := seconds
+		for _, auth := range []*LkpUserCertAuthorizationResponse{
+			{Authorized: true, ValidityDuration: &seconds},
+			{Authorized: true, MaxValidityDuration: &seconds},
+		} {
+			config := testCaConfig(t)
+			config.Authorizer = staticAuthorizer{user: auth}
+
+			_, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+			assert.Equal(t, ErrUnauthorized, errors.Cause(err))
+		}
+	}
+}
+
+func TestSimulateUserCertReq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ledgerPath := filepath.Join(dir, "ledger.jsonl")
+	config := testCaConfig(t)
+	config.IssuanceLedger = NewFileIssuanceLedger(ledgerPath)
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	req := testUserCertReq(t, params, kp)
+	req.EventType = "SimulateUserCertReq"
+	req.ValidityDuration = 600
+	resp, err := DoSimulateUserCertReq(context.Background(), req, config)
+	assert.Nil(t, err)
+	assert.True(t, resp.Allowed)
+	assert.Equal(t, []string{params.RemoteInstanceArn}, resp.Principals)
+	assert.Equal(t, int64(600), resp.ValidityDuration)
+	assert.Equal(t, DefaultSshPermissions.Extensions, resp.Extensions)
+
+	// nothing was signed
+	_, err = os.Stat(ledgerPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// denials are reported rather than returned
+	req = testUserCertReq(t, params, testKeyPair(t, &TokenParams{}))
+	req.EventType = "SimulateUserCertReq"
+	resp, err = DoSimulateUserCertReq(context.Background(), req, config)
+	assert.Nil(t, err)
+	assert.False(t, resp.Allowed)
+	assert.Equal(t, "PublicKeyMismatch", resp.ErrorCode)
+}
@@ -0,0 +1,121 @@
+package lastkeypair
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"encoding/json"
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// IssuanceRecord describes a single signed certificate. Jumpbox certificates
+// get their own records, with their own serials.
+type IssuanceRecord struct {
+	Serial               uint64
+	CertType             string // "user" or "host"
+	KeyId                string
+	Principals           []string
+	PublicKeyFingerprint string
+	ValidAfter           int64
+	ValidBefore          int64
+	IssuedAt             int64
+
+	RequesterId      string
+	RequesterAccount string
+	RequesterName    string   `json:",omitempty"`
+	Vouchers         []string `json:",omitempty"` // identities of the vouchers
+}
+
+// IssuanceLedger records every certificate the CA signs, so that they can
+// later be audited or revoked by serial.
+type IssuanceLedger interface {
+	Record(ctx context.Context, record IssuanceRecord) error
+}
+
+func newIssuanceRecord(cert *ssh.Certificate, params TokenParams) IssuanceRecord {
+	certType := "user"
+	if cert.CertType == ssh.HostCert {
+		certType = "host"
+	}
+
+	vouchers := []string{}
+	for _, v := range params.Vouchers {
+		vouchers = append(vouchers, tokenIdentity(v.Params))
+	}
+
+	return IssuanceRecord{
+		Serial:               cert.Serial,
+		CertType:             certType,
+		KeyId:                cert.KeyId,
+		Principals:           cert.ValidPrincipals,
+		PublicKeyFingerprint: ssh.FingerprintSHA256(cert.Key),
+		ValidAfter:           int64(cert.ValidAfter),
+		ValidBefore:          int64(cert.ValidBefore),
+		IssuedAt:             time.Now().Unix(),
+		RequesterId:          params.FromId,
+		RequesterAccount:     params.FromAccount,
+		RequesterName:        params.FromName,
+		Vouchers:             vouchers,
+	}
+}
+
+// DynamoIssuanceLedger needs a table with a numeric hash key named "Serial".
+type DynamoIssuanceLedger struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+}
+
+func NewDynamoIssuanceLedger(sess *session.Session, table string) *DynamoIssuanceLedger {
+	return &DynamoIssuanceLedger{client: dynamodb.New(sess), table: table}
+}
+
+func (l *DynamoIssuanceLedger) Record(ctx context.Context, record IssuanceRecord) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return errors.Wrap(err, "encoding issuance record")
+	}
+
+	_, err = l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &l.table,
+		Item:      item,
+		// a serial collision would make revocation ambiguous
+		ConditionExpression: aws.String("attribute_not_exists(Serial)"),
+	})
+	return errors.Wrap(err, "recording issuance in dynamodb")
+}
+
+// FileIssuanceLedger appends records to a JSON-lines file.
+type FileIssuanceLedger struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileIssuanceLedger(path string) *FileIssuanceLedger {
+	return &FileIssuanceLedger{path: path}
+}
+
+func (l *FileIssuanceLedger) Record(ctx context.Context, record IssuanceRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encoding issuance record")
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening issuance ledger file")
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return errors.Wrap(err, "writing issuance ledger file")
+}
@@ -0,0 +1,53 @@
+package lastkeypair
+
+import (
+	"testing"
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserCertReqRecordsIssuance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ledgerPath := filepath.Join(dir, "ledger.jsonl")
+	config := testCaConfig(t)
+	config.IssuanceLedger = NewFileIssuanceLedger(ledgerPath)
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+
+	serials := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		resp, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+		assert.Nil(t, err)
+
+		serial := parseTestCert(t, resp.SignedPublicKey).Serial
+		assert.NotEqual(t, uint64(0), serial)
+		serials[serial] = true
+	}
+	assert.Len(t, serials, 2)
+
+	f, err := os.Open(ledgerPath)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := IssuanceRecord{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		assert.True(t, serials[record.Serial])
+		assert.Equal(t, "user", record.CertType)
+		assert.Equal(t, "aidan-AIDAEXAMPLE", record.KeyId)
+		assert.Equal(t, params.PublicKeyFingerprint, record.PublicKeyFingerprint)
+		assert.Equal(t, "AIDAEXAMPLE", record.RequesterId)
+		delete(serials, record.Serial)
+	}
+	assert.Empty(t, serials)
+}
@@ -0,0 +1,224 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OnCallRoster says who is on call when, for policy rules that only allow
+// access to whoever is on call. Who is matched case-insensitively against the
+// requester's IAM username or unique ID. For assumed roles, that's the role's
+// unique ID, as the caller chooses the role session name.
+type OnCallRoster struct {
+	Shifts []OnCallShift
+}
+
+type OnCallShift struct {
+	Who  []string
+	From time.Time
+	To   time.Time // exclusive
+}
+
+// ReadOnCallRoster reads an iCalendar file if path ends in .ics, and a YAML
+// (or JSON) schedule of the form:
+//
+//   Shifts:
+//     - Who: [aidan@example.com]
+//       From: 2026-10-16T09:00:00+11:00
+//       To: 2026-10-23T09:00:00+11:00
+func ReadOnCallRoster(path string) (*OnCallRoster, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading on-call roster")
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".ics") {
+		return ParseICalRoster(raw)
+	}
+
+	roster := &OnCallRoster{}
+	err = decodeYamlAsJson(raw, roster)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing on-call roster %s", path)
+	}
+	return roster, nil
+}
+
+// OnCall is true if any of identities is on call at t.
+func (r *OnCallRoster) OnCall(identities []string, t time.Time) bool {
+	_, onCall := r.OnCallUntil(identities, t)
+	return onCall
+}
+
+// OnCallUntil is when the latest of the shifts that any of identities is on
+// at t ends.
+func (r *OnCallRoster) OnCallUntil(identities []string, t time.Time) (time.Time, bool) {
+	var until time.Time
+	onCall := false
+
+	for _, shift := range r.Shifts {
+		if t.Before(shift.From) || !t.Before(shift.To) {
+			continue
+		}
+
+		for _, who := range shift.Who {
+			for _, identity := range identities {
+				if len(identity) > 0 && strings.EqualFold(who, identity) && shift.To.After(until) {
+					until = shift.To
+					onCall = true
+				}
+			}
+		}
+	}
+	return until, onCall
+}
+
+// ParseICalRoster turns each VEVENT into a shift for the people named in its
+// SUMMARY and ATTENDEEs, which is how on-call tools tend to export their
+// schedules. Recurring events aren't supported.
+func ParseICalRoster(raw []byte) (*OnCallRoster, error) {
+	roster := &OnCallRoster{}
+	var event map[string][]icalProperty
+
+	for _, line := range unfoldICalLines(string(raw)) {
+		prop := parseICalProperty(line)
+
+		switch {
+		case prop.name == "BEGIN" && prop.value == "VEVENT":
+			event = map[string][]icalProperty{}
+		case prop.name == "END" && prop.value == "VEVENT" && event != nil:
+			shift, err := icalEventToShift(event)
+			if err != nil {
+				return nil, err
+			}
+			roster.Shifts = append(roster.Shifts, *shift)
+			event = nil
+		case event != nil:
+			event[prop.name] = append(event[prop.name], prop)
+		}
+	}
+
+	return roster, nil
+}
+
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// unfoldICalLines joins continuation lines, which start with whitespace.
+func unfoldICalLines(raw string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.Replace(raw, "\r\n", "\n", -1), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseICalProperty parses NAME;PARAM=value;PARAM="quoted:value":value
+func parseICalProperty(line string) icalProperty {
+	quoted := false
+	colon := len(line)
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+
+	prop := icalProperty{params: map[string]string{}}
+	if colon < len(line) {
+		prop.value = line[colon+1:]
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if idx := strings.Index(param, "="); idx >= 0 {
+			prop.params[strings.ToUpper(param[:idx])] = strings.Trim(param[idx+1:], `"`)
+		}
+	}
+
+	return prop
+}
+
+func icalEventToShift(event map[string][]icalProperty) (*OnCallShift, error) {
+	if _, recurring := event["RRULE"]; recurring {
+		return nil, errors.New("recurring events in on-call rosters aren't supported")
+	}
+
+	starts := event["DTSTART"]
+	if len(starts) == 0 {
+		return nil, errors.New("on-call roster event has no DTSTART")
+	}
+
+	from, allDay, err := parseICalTime(starts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	to := from
+	if allDay {
+		to = from.AddDate(0, 0, 1)
+	}
+	if ends := event["DTEND"]; len(ends) > 0 {
+		to, _, err = parseICalTime(ends[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shift := &OnCallShift{From: from, To: to}
+	for _, summary := range event["SUMMARY"] {
+		shift.Who = append(shift.Who, strings.TrimSpace(summary.value))
+	}
+	for _, attendee := range event["ATTENDEE"] {
+		value := attendee.value
+		if strings.HasPrefix(strings.ToLower(value), "mailto:") {
+			value = value[len("mailto:"):]
+		}
+		shift.Who = append(shift.Who, value)
+	}
+
+	return shift, nil
+}
+
+// parseICalTime handles UTC times, times in a TZID and all-day dates, which
+// are taken to be in UTC.
+func parseICalTime(prop icalProperty) (time.Time, bool, error) {
+	loc := time.UTC
+	if tzid, ok := prop.params["TZID"]; ok {
+		var err error
+		loc, err = time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, errors.Wrapf(err, "loading on-call roster time zone %s", tzid)
+		}
+	}
+
+	var layout string
+	allDay := false
+	switch {
+	case len(prop.value) == 8:
+		layout, allDay = "20060102", true
+	case strings.HasSuffix(prop.value, "Z"):
+		layout, loc = "20060102T150405Z", time.UTC
+	default:
+		layout = "20060102T150405"
+	}
+
+	t, err := time.ParseInLocation(layout, prop.value, loc)
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "parsing on-call roster %s", prop.name)
+	}
+	return t, allDay, nil
+}
@@ -0,0 +1,513 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PolicyDocument is an in-process alternative to an authorisation Lambda,
+// for the common case of mapping identities to instances and principals.
+// Rules are checked in order and the first to match decides. Requests that
+// match no rule are denied. See docs/access-policy.md.
+type PolicyDocument struct {
+	Rules     []PolicyRule
+	HostRules []HostPolicyRule `json:",omitempty"`
+	// Groups name sets of identities for voucher requirements. Only the
+	// identity fields of each PolicyMatch are meaningful.
+	Groups map[string]PolicyMatch `json:",omitempty"`
+}
+
+// PolicyMatch is what a rule applies to. Every non-empty field must match.
+// Names, Ids, Instances and SshUsernames are globs, in which * matches
+// anything, including slashes.
+type PolicyMatch struct {
+	Accounts     []string `json:",omitempty"`
+	Types        []string `json:",omitempty"` // "User", "AssumedRole" or "FederatedUser"
+	Names        []string `json:",omitempty"`
+	Ids          []string `json:",omitempty"`
+	Instances    []string `json:",omitempty"` // the target instance, or the host being certified
+	SshUsernames []string `json:",omitempty"`
+	MinVouchers  int      `json:",omitempty"`
+	Vouchers     []PolicyVoucherRequirement `json:",omitempty"` // all of them
+}
+
+// PolicyVoucherRequirement is met by at least Min vouchers from distinct
+// identities in Group, e.g. two of the senior engineers. Vouchers are
+// verified by the CA before the policy sees them.
+type PolicyVoucherRequirement struct {
+	Min   int
+	Group string
+}
+
+// PolicyRule produces the same fields as an authorisation Lambda's
+// LkpUserCertAuthorizationResponse. A rule whose When conditions don't hold
+// is skipped, as if it didn't match; if no later rule allows the request, the
+// user is told why.
+type PolicyRule struct {
+	Name    string
+	Effect  string `json:",omitempty"` // "Allow" (the default) or "Deny"
+	Message string `json:",omitempty"` // returned to the user when denied
+	Match   PolicyMatch
+	When    *PolicyConditions `json:",omitempty"`
+
+	Principals          []string            `json:",omitempty"`
+	Jumpboxes           []Jumpbox           `json:",omitempty"`
+	TargetAddress       string              `json:",omitempty"`
+	CertificateOptions  *CertificateOptions `json:",omitempty"`
+	ValidityDuration    *int64              `json:",omitempty"`
+	MaxValidityDuration *int64              `json:",omitempty"`
+}
+
+// HostPolicyRule produces a LkpHostCertAuthorizationResponse. Only the
+// identity fields and Instances of its Match are meaningful.
+type HostPolicyRule struct {
+	Name    string
+	Effect  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+	Match   PolicyMatch
+
+	KeyId            string   `json:",omitempty"`
+	Principals       []string `json:",omitempty"`
+	ValidityDuration *int64   `json:",omitempty"`
+}
+
+// ParsePolicyDocument accepts YAML or JSON. Keys are matched to fields the
+// same way as authorisation Lambda responses, i.e. case-insensitively.
+// Unknown keys are errors, so that a typo can't silently widen a rule.
+func ParsePolicyDocument(raw []byte) (*PolicyDocument, error) {
+	doc := &PolicyDocument{}
+	err := decodeYamlAsJson(raw, doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing policy document")
+	}
+
+	return doc, doc.Validate()
+}
+
+func ReadPolicyDocument(path string) (*PolicyDocument, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading policy document")
+	}
+	return ParsePolicyDocument(raw)
+}
+
+// decodeYamlAsJson decodes YAML into v as if it were JSON, so that v's json
+// tags and case-insensitive field matching apply.
+func decodeYamlAsJson(raw []byte, v interface{}) error {
+	var generic interface{}
+	err := yaml.Unmarshal(raw, &generic)
+	if err != nil {
+		return err
+	}
+
+	generic, err = yamlToJsonValue(generic)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	err = checkJsonFields(generic, reflect.TypeOf(v), "")
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(encoded, v)
+}
+
+// checkJsonFields fails if value, decoded JSON, has an object key that
+// wouldn't be decoded into any field of t. It's what json.Decoder's
+// DisallowUnknownFields does, which needs Go 1.10.
+func checkJsonFields(value interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil // json.Unmarshal reports the type mismatch
+		}
+		for key, fieldValue := range object {
+			field, ok := jsonField(t, key)
+			if !ok {
+				return errors.Errorf("unknown field %q", path + key)
+			}
+			err := checkJsonFields(fieldValue, field.Type, path + key + ".")
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		array, _ := value.([]interface{})
+		for i, elem := range array {
+			err := checkJsonFields(elem, t.Elem(), fmt.Sprintf("%s%d.", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		object, _ := value.(map[string]interface{})
+		for key, elem := range object {
+			err := checkJsonFields(elem, t.Elem(), path + key + ".")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonField finds the field that encoding/json would decode key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || len(field.PkgPath) > 0 {
+			continue
+		} else if len(name) == 0 {
+			name = field.Name
+		}
+
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlToJsonValue converts the map[interface{}]interface{}s that yaml.v2
+// produces into something encoding/json can marshal.
+func yamlToJsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			converted, err := yamlToJsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprintf("%v", key)] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for i, value := range v {
+			converted, err := yamlToJsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+func (d *PolicyDocument) Validate() error {
+	for i, rule := range d.Rules {
+		err := validatePolicyRule(rule.Effect, rule.Match)
+		for _, requirement := range rule.Match.Vouchers {
+			if _, ok := d.Groups[requirement.Group]; err == nil && !ok {
+				err = errors.Errorf("voucher group %q isn't defined", requirement.Group)
+			} else if err == nil && requirement.Min < 1 {
+				err = errors.New("voucher requirements need a Min of at least 1")
+			}
+		}
+		if err == nil && rule.When != nil {
+			err = rule.When.Validate()
+		}
+		if err == nil && rule.CertificateOptions != nil {
+			err = rule.CertificateOptions.Validate()
+		}
+		for _, jumpbox := range rule.Jumpboxes {
+			if err == nil && jumpbox.CertificateOptions != nil {
+				err = jumpbox.CertificateOptions.Validate()
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "policy rule %d (%s)", i+1, rule.Name)
+		}
+	}
+
+	for i, rule := range d.HostRules {
+		err := validatePolicyRule(rule.Effect, rule.Match)
+		if err != nil {
+			return errors.Wrapf(err, "host policy rule %d (%s)", i+1, rule.Name)
+		}
+	}
+
+	for name, group := range d.Groups {
+		err := validatePolicyIds(group.Ids)
+		if err != nil {
+			return errors.Wrapf(err, "voucher group %q", name)
+		}
+	}
+
+	return nil
+}
+
+func validatePolicyRule(effect string, match PolicyMatch) error {
+	if effect != "" && effect != "Allow" && effect != "Deny" {
+		return errors.Errorf("effect must be Allow or Deny, not %q", effect)
+	}
+	if match.MinVouchers < 0 {
+		return errors.New("MinVouchers must not be negative")
+	}
+	return validatePolicyIds(match.Ids)
+}
+
+// validatePolicyIds rejects role session names in Ids, as they're chosen by
+// whoever assumes the role. Ids are matched against the role's unique ID.
+func validatePolicyIds(ids []string) error {
+	for _, id := range ids {
+		if strings.Contains(id, ":") {
+			return errors.Errorf("Ids are matched without the role session name, so %q can't contain a colon", id)
+		}
+	}
+	return nil
+}
+
+// PolicyAuthorizer is an Authorizer backed by a PolicyDocument.
+type PolicyAuthorizer struct {
+	doc     *PolicyDocument
+	rosters map[string]*OnCallRoster
+	now     func() time.Time
+}
+
+type PolicyAuthorizerOption func(*PolicyAuthorizer)
+
+// WithPolicyClock makes rules' When conditions use now instead of the
+// system clock, e.g. to test a policy against next week's roster.
+func WithPolicyClock(now func() time.Time) PolicyAuthorizerOption {
+	return func(a *PolicyAuthorizer) { a.now = now }
+}
+
+// NewPolicyAuthorizer also reads the on-call rosters that doc refers to.
+func NewPolicyAuthorizer(doc *PolicyDocument, opts ...PolicyAuthorizerOption) (*PolicyAuthorizer, error) {
+	err := doc.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	rosters := map[string]*OnCallRoster{}
+	for _, rule := range doc.Rules {
+		if rule.When == nil || len(rule.When.OnCall) == 0 || rosters[rule.When.OnCall] != nil {
+			continue
+		}
+
+		rosters[rule.When.OnCall], err = ReadOnCallRoster(rule.When.OnCall)
+		if err != nil {
+			return nil, errors.Wrapf(err, "policy rule %s", rule.Name)
+		}
+	}
+
+	a := &PolicyAuthorizer{doc: doc, rosters: rosters, now: time.Now}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+func (a *PolicyAuthorizer) AuthorizeUser(ctx context.Context, req LkpUserCertAuthorizationRequest) (*LkpUserCertAuthorizationResponse, error) {
+	now := a.now()
+	skippedBecause := ""
+
+	for _, rule := range a.doc.Rules {
+		if !rule.Match.matchesUser(req, a.doc.Groups) {
+			continue
+		}
+
+		var until time.Time
+		if rule.When != nil {
+			var reason string
+			reason, until = rule.When.check(now, requesterIdentities(req.From), a.rosters)
+			if len(reason) > 0 {
+				if len(skippedBecause) == 0 && rule.Effect != "Deny" {
+					skippedBecause = denialMessage(rule.Name, rule.Message, reason)
+				}
+				continue
+			}
+		}
+
+		if rule.Effect == "Deny" {
+			return &LkpUserCertAuthorizationResponse{Message: denialMessage(rule.Name, rule.Message, "")}, nil
+		}
+
+		return &LkpUserCertAuthorizationResponse{
+			Authorized:          true,
+			Message:             rule.Message,
+			Principals:          copyStrings(rule.Principals),
+			Jumpboxes:           append([]Jumpbox(nil), rule.Jumpboxes...),
+			TargetAddress:       rule.TargetAddress,
+			CertificateOptions:  rule.CertificateOptions,
+			ValidityDuration:    rule.ValidityDuration,
+			MaxValidityDuration: capValidity(rule.MaxValidityDuration, now, until),
+		}, nil
+	}
+
+	if len(skippedBecause) > 0 {
+		return &LkpUserCertAuthorizationResponse{Message: skippedBecause}, nil
+	}
+	return &LkpUserCertAuthorizationResponse{Message: "no policy rule allows this request"}, nil
+}
+
+func (a *PolicyAuthorizer) AuthorizeHost(ctx context.Context, req LkpHostCertAuthorizationRequest) (*LkpHostCertAuthorizationResponse, error) {
+	for _, rule := range a.doc.HostRules {
+		if !rule.Match.matchesHost(req) {
+			continue
+		}
+
+		if rule.Effect == "Deny" {
+			return &LkpHostCertAuthorizationResponse{Message: denialMessage(rule.Name, rule.Message, "")}, nil
+		}
+
+		principals := copyStrings(rule.Principals)
+		if principals == nil {
+			principals = []string{req.HostInstanceArn}
+		}
+
+		return &LkpHostCertAuthorizationResponse{
+			Authorized:       true,
+			KeyId:            rule.KeyId,
+			Principals:       principals,
+			ValidityDuration: rule.ValidityDuration,
+		}, nil
+	}
+
+	return &LkpHostCertAuthorizationResponse{Message: "no host policy rule allows this request"}, nil
+}
+
+func denialMessage(name, message, reason string) string {
+	if len(message) > 0 {
+		return message
+	} else if len(reason) > 0 {
+		return fmt.Sprintf("%s: %s", name, reason)
+	}
+	return fmt.Sprintf("denied by policy rule %s", name)
+}
+
+// capValidity shortens max so that the cert expires by until, i.e. when the
+// rule's window or on-call shift ends. A zero until doesn't cap it.
+func capValidity(max *int64, now, until time.Time) *int64 {
+	if until.IsZero() {
+		return max
+	}
+
+	seconds := int64(until.Sub(now) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return shorterDuration(max, &seconds)
+}
+
+// requesterIdentities are the names an on-call roster might know someone by:
+// their IAM username and unique ID. Role session names are chosen by whoever
+// assumes the role, so for assumed roles only the role's unique ID counts.
+func requesterIdentities(from authorizationLambdaIdentity) []string {
+	identities := []string{uniqueId(from.Id)}
+	if from.Name != nil {
+		identities = append(identities, *from.Name)
+	}
+	return identities
+}
+
+// uniqueId strips the role session name from an assumed role's user id,
+// e.g. AROAEXAMPLE:aidan, leaving the role's unique ID. Users' ids are
+// returned as they are.
+func uniqueId(id string) string {
+	if idx := strings.Index(id, ":"); idx >= 0 {
+		return id[:idx]
+	}
+	return id
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func (m PolicyMatch) matchesIdentity(from authorizationLambdaIdentity) bool {
+	// assumed roles have no name, which mustn't match a pattern of "*"
+	hasName := from.Name != nil && len(*from.Name) > 0
+	if len(m.Names) > 0 && !hasName {
+		return false
+	}
+
+	return matchesAny(m.Accounts, from.Account, false) &&
+		matchesAny(m.Types, from.Type, false) &&
+		(!hasName || matchesAny(m.Names, *from.Name, true)) &&
+		matchesAny(m.Ids, uniqueId(from.Id), true)
+}
+
+func (m PolicyMatch) matchesUser(req LkpUserCertAuthorizationRequest, groups map[string]PolicyMatch) bool {
+	if !m.matchesIdentity(req.From) ||
+		!matchesAny(m.Instances, req.RemoteInstanceArn, true) ||
+		!matchesAny(m.SshUsernames, req.SshUsername, true) ||
+		len(req.Vouchers) < m.MinVouchers {
+		return false
+	}
+
+	for _, requirement := range m.Vouchers {
+		if countVouchersFrom(req.Vouchers, groups[requirement.Group]) < requirement.Min {
+			return false
+		}
+	}
+	return true
+}
+
+// countVouchersFrom counts the distinct identities in vouchers that match
+// group.
+func countVouchersFrom(vouchers []authorizationLambdaVoucher, group PolicyMatch) int {
+	seen := map[string]bool{}
+	for _, v := range vouchers {
+		identity := authorizationLambdaIdentity{Name: v.Name, Id: v.Id, Account: v.Account, Type: v.Type}
+		if group.matchesIdentity(identity) {
+			seen[voucherIdentity(v.Account, v.Id)] = true
+		}
+	}
+	return len(seen)
+}
+
+func (m PolicyMatch) matchesHost(req LkpHostCertAuthorizationRequest) bool {
+	return m.matchesIdentity(req.From) && matchesAny(m.Instances, req.HostInstanceArn, true)
+}
+
+// matchesAny is true if patterns is empty or one of them matches value.
+func matchesAny(patterns []string, value string, glob bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if pattern == value || (glob && globMatch(pattern, value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re := regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	return re.MatchString(value)
+}
@@ -0,0 +1,280 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PolicyConditions restrict when a rule applies. Every condition that is set
+// must hold.
+type PolicyConditions struct {
+	TimeZone    string             `json:",omitempty"` // e.g. Australia/Sydney. Defaults to UTC
+	Windows     []PolicyTimeWindow `json:",omitempty"` // now must be in one of them
+	Dates       []PolicyDateRange  `json:",omitempty"` // now must be in one of them
+	ExceptDates []PolicyDateRange  `json:",omitempty"` // now must be in none of them, e.g. change freezes
+	OnCall      string             `json:",omitempty"` // path to a roster the requester must be on call in
+}
+
+// PolicyTimeWindow is a range of hours on some days of the week, e.g. Days
+// [Mon, Tue, Wed, Thu, Fri] From "09:00" To "17:00". To is exclusive, and a
+// window that ends before it starts runs past midnight into the next day.
+// No Days means every day.
+type PolicyTimeWindow struct {
+	Days []string `json:",omitempty"`
+	From string
+	To   string
+}
+
+// PolicyDateRange is inclusive, e.g. From "2026-12-20" To "2027-01-05".
+// Either end may be left open.
+type PolicyDateRange struct {
+	From string `json:",omitempty"`
+	To   string `json:",omitempty"`
+}
+
+var policyWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (c *PolicyConditions) Validate() error {
+	_, err := c.location()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range c.Windows {
+		_, _, err = w.minutes()
+		if err == nil {
+			_, err = w.weekdays()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range append(append([]PolicyDateRange{}, c.Dates...), c.ExceptDates...) {
+		_, _, err = d.bounds(time.UTC)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *PolicyConditions) location() (*time.Location, error) {
+	if len(c.TimeZone) == 0 {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	return loc, errors.Wrapf(err, "loading time zone %s", c.TimeZone)
+}
+
+// check returns why the conditions don't hold at now, or "" if they do.
+// rosters are the rosters named by OnCall, loaded ahead of time. If they do
+// hold, until is when they stop holding, or zero if they hold indefinitely.
+func (c *PolicyConditions) check(now time.Time, identities []string, rosters map[string]*OnCallRoster) (reason string, until time.Time) {
+	loc, err := c.location()
+	if err != nil {
+		return err.Error(), until
+	}
+	local := now.In(loc)
+
+	earliest := func(t time.Time) {
+		if until.IsZero() || t.Before(until) {
+			until = t
+		}
+	}
+
+	if len(c.Windows) > 0 {
+		var end time.Time
+		descriptions := []string{}
+		for _, w := range c.Windows {
+			if w.contains(local) && w.end(local).After(end) {
+				end = w.end(local)
+			}
+			descriptions = append(descriptions, w.String())
+		}
+		if end.IsZero() {
+			return fmt.Sprintf("access is only allowed %s (%s)", strings.Join(descriptions, " or "), loc), time.Time{}
+		}
+		earliest(end)
+	}
+
+	if len(c.Dates) > 0 {
+		inRange, openEnded := false, false
+		var end time.Time
+		for _, d := range c.Dates {
+			if !d.contains(local) {
+				continue
+			}
+			inRange = true
+			_, to, _ := d.bounds(loc)
+			openEnded = openEnded || to.IsZero()
+			if to.After(end) {
+				end = to
+			}
+		}
+		if !inRange {
+			return fmt.Sprintf("access isn't allowed on %s (%s)", local.Format("2006-01-02"), loc), time.Time{}
+		}
+		if !openEnded {
+			earliest(end)
+		}
+	}
+
+	for _, d := range c.ExceptDates {
+		if d.contains(local) {
+			return fmt.Sprintf("access isn't allowed between %s (%s)", d, loc), time.Time{}
+		}
+		if from, _, _ := d.bounds(loc); from.After(local) {
+			earliest(from)
+		}
+	}
+
+	if len(c.OnCall) > 0 {
+		roster := rosters[c.OnCall]
+		if roster == nil {
+			return "access is only allowed while on call", time.Time{}
+		}
+		end, onCall := roster.OnCallUntil(identities, now)
+		if !onCall {
+			return "access is only allowed while on call", time.Time{}
+		}
+		earliest(end)
+	}
+
+	return "", until
+}
+
+func (w PolicyTimeWindow) minutes() (int, int, error) {
+	parse := func(s string) (int, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, errors.Errorf("invalid time of day %q: must be HH:MM", s)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	from, err := parse(w.From)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := parse(w.To)
+	return from, to, err
+}
+
+func (w PolicyTimeWindow) weekdays() (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+	for _, day := range w.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+
+		weekday, ok := policyWeekdays[key]
+		if !ok {
+			return nil, errors.Errorf("invalid day %q", day)
+		}
+		days[weekday] = true
+	}
+	return days, nil
+}
+
+func (w PolicyTimeWindow) contains(t time.Time) bool {
+	from, to, err := w.minutes()
+	if err != nil {
+		return false
+	}
+
+	days, err := w.weekdays()
+	if err != nil {
+		return false
+	}
+
+	onDay := func(day time.Weekday) bool {
+		return len(days) == 0 || days[day]
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	if from < to {
+		return onDay(t.Weekday()) && now >= from && now < to
+	}
+
+	// the window runs past midnight, so the early hours belong to yesterday's
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	return (onDay(t.Weekday()) && now >= from) || (onDay(yesterday) && now < to)
+}
+
+// end is when the window that contains t closes.
+func (w PolicyTimeWindow) end(t time.Time) time.Time {
+	from, to, _ := w.minutes()
+	end := time.Date(t.Year(), t.Month(), t.Day(), to/60, to%60, 0, 0, t.Location())
+
+	// a window that runs past midnight closes tomorrow, unless it's already
+	// the early hours
+	if from >= to && t.Hour()*60+t.Minute() >= from {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+func (w PolicyTimeWindow) String() string {
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ", ")
+	}
+	return fmt.Sprintf("%s %s-%s", days, w.From, w.To)
+}
+
+// bounds returns the start of From and the end of To, in loc.
+func (d PolicyDateRange) bounds(loc *time.Location) (time.Time, time.Time, error) {
+	var from, to time.Time
+
+	if len(d.From) > 0 {
+		t, err := time.ParseInLocation("2006-01-02", d.From, loc)
+		if err != nil {
+			return from, to, errors.Errorf("invalid date %q: must be YYYY-MM-DD", d.From)
+		}
+		from = t
+	}
+
+	if len(d.To) > 0 {
+		t, err := time.ParseInLocation("2006-01-02", d.To, loc)
+		if err != nil {
+			return from, to, errors.Errorf("invalid date %q: must be YYYY-MM-DD", d.To)
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+
+	return from, to, nil
+}
+
+func (d PolicyDateRange) contains(t time.Time) bool {
+	from, to, err := d.bounds(t.Location())
+	if err != nil {
+		return false
+	}
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+func (d PolicyDateRange) String() string {
+	from, to := d.From, d.To
+	if len(from) == 0 {
+		from = "the beginning of time"
+	}
+	if len(to) == 0 {
+		to = "the end of time"
+	}
+	return fmt.Sprintf("%s and %s", from, to)
+}
@@ -0,0 +1,157 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyTimeWindows(t *testing.T) {
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	assert.Nil(t, err)
+
+	conditions := &PolicyConditions{
+		TimeZone: "Australia/Sydney",
+		Windows: []PolicyTimeWindow{
+			{Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, From: "09:00", To: "17:00"},
+			{Days: []string{"Saturday"}, From: "22:00", To: "02:00"},
+		},
+	}
+	assert.Nil(t, conditions.Validate())
+
+	at := func(day, hour, minute int) time.Time {
+		// 2026-10-12 is a Monday
+		return time.Date(2026, 10, day, hour, minute, 0, 0, sydney).UTC()
+	}
+
+	assert.Equal(t, "", checkReason(conditions, at(12, 9, 0)))
+	assert.Equal(t, "", checkReason(conditions, at(16, 16, 59)))
+	assert.NotEqual(t, "", checkReason(conditions, at(16, 17, 0)))
+	assert.NotEqual(t, "", checkReason(conditions, at(17, 12, 0)), "saturday lunch")
+	assert.Equal(t, "", checkReason(conditions, at(17, 23, 0)))
+	assert.Equal(t, "", checkReason(conditions, at(18, 1, 30)), "sunday morning belongs to saturday night")
+	assert.NotEqual(t, "", checkReason(conditions, at(18, 22, 30)))
+
+	// certs only last until the window closes
+	_, until := conditions.check(at(16, 16, 59), nil, nil)
+	assert.Equal(t, at(16, 17, 0), until.UTC())
+	_, until = conditions.check(at(17, 23, 0), nil, nil)
+	assert.Equal(t, at(18, 2, 0), until.UTC())
+	_, until = conditions.check(at(18, 1, 30), nil, nil)
+	assert.Equal(t, at(18, 2, 0), until.UTC())
+
+	// it's 9am in Sydney, but midnight in UTC
+	utc := &PolicyConditions{Windows: conditions.Windows[:1]}
+	assert.NotEqual(t, "", checkReason(utc, at(13, 9, 30)))
+
+	assert.NotNil(t, (&PolicyConditions{TimeZone: "Mars/Olympus_Mons"}).Validate())
+	assert.NotNil(t, (&PolicyConditions{Windows: []PolicyTimeWindow{{From: "9am", To: "5pm"}}}).Validate())
+	assert.NotNil(t, (&PolicyConditions{Windows: []PolicyTimeWindow{{Days: []string{"Funday"}, From: "09:00", To: "17:00"}}}).Validate())
+}
+
+func TestPolicyDateRanges(t *testing.T) {
+	conditions := &PolicyConditions{
+		Dates:       []PolicyDateRange{{From: "2026-10-01"}},
+		ExceptDates: []PolicyDateRange{{From: "2026-12-20", To: "2027-01-05"}},
+	}
+	assert.Nil(t, conditions.Validate())
+
+	assert.NotEqual(t, "", checkReason(conditions, time.Date(2026, 9, 30, 23, 59, 0, 0, time.UTC)))
+	assert.Equal(t, "", checkReason(conditions, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Contains(t, checkReason(conditions, time.Date(2027, 1, 5, 23, 0, 0, 0, time.UTC)), "2026-12-20 and 2027-01-05")
+	assert.Equal(t, "", checkReason(conditions, time.Date(2027, 1, 6, 0, 0, 0, 0, time.UTC)))
+
+	_, until := conditions.check(time.Date(2026, 12, 19, 12, 0, 0, 0, time.UTC), nil, nil)
+	assert.Equal(t, time.Date(2026, 12, 20, 0, 0, 0, 0, time.UTC), until)
+	_, until = conditions.check(time.Date(2027, 1, 6, 0, 0, 0, 0, time.UTC), nil, nil)
+	assert.True(t, until.IsZero())
+}
+
+// checkReason is why conditions don't hold at now, for tests that don't
+// care when they stop holding.
+func checkReason(conditions *PolicyConditions, now time.Time) string {
+	reason, _ := conditions.check(now, nil, nil)
+	return reason
+}
+
+const testICalRoster = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;TZID=Australia/Sydney:20261016T090000\r\n" +
+	"DTEND;TZID=Australia/Sydney:20261023T090000\r\n" +
+	"SUMMARY:On call: primary\r\n" +
+	"ATTENDEE;CN=\"Aidan: primary\":mailto:aidan@example.\r\n" +
+	" com\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20261023\r\n" +
+	"SUMMARY:ben@example.com\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestICalRoster(t *testing.T) {
+	roster, err := ParseICalRoster([]byte(testICalRoster))
+	assert.Nil(t, err)
+	assert.Len(t, roster.Shifts, 2)
+
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	assert.Nil(t, err)
+
+	assert.True(t, roster.OnCall([]string{"AIDAN@example.com"}, time.Date(2026, 10, 16, 9, 0, 0, 0, sydney)))
+	assert.False(t, roster.OnCall([]string{"aidan@example.com"}, time.Date(2026, 10, 16, 8, 59, 0, 0, sydney)))
+	assert.False(t, roster.OnCall([]string{"aidan@example.com"}, time.Date(2026, 10, 23, 9, 0, 0, 0, sydney)))
+	assert.True(t, roster.OnCall([]string{"ben@example.com"}, time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC)))
+	assert.False(t, roster.OnCall([]string{"ben@example.com"}, time.Date(2026, 10, 24, 0, 0, 0, 0, time.UTC)))
+
+	_, err = ParseICalRoster([]byte("BEGIN:VEVENT\nDTSTART:20261016T090000Z\nRRULE:FREQ=WEEKLY\nEND:VEVENT\n"))
+	assert.NotNil(t, err)
+}
+
+func TestPolicyAuthorizerOnCall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rosterPath := filepath.Join(dir, "roster.yml")
+	err = ioutil.WriteFile(rosterPath, []byte(`
+Shifts:
+  - Who: [daniel.whyte, AROAIIWP2XR7EN6ONCALL]
+    From: 2026-10-16T09:00:00+11:00
+    To: 2026-10-23T09:00:00+11:00
+`), 0600)
+	assert.Nil(t, err)
+
+	now := time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC)
+	authorizer, err := NewPolicyAuthorizer(&PolicyDocument{Rules: []PolicyRule{
+		{Name: "on call", When: &PolicyConditions{OnCall: rosterPath}},
+	}}, WithPolicyClock(func() time.Time { return now }))
+	assert.Nil(t, err)
+
+	instance := "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"
+	authorize := func(from authorizationLambdaIdentity) *LkpUserCertAuthorizationResponse {
+		resp, err := authorizer.AuthorizeUser(context.Background(), LkpUserCertAuthorizationRequest{From: from, RemoteInstanceArn: instance})
+		assert.Nil(t, err)
+		return resp
+	}
+
+	name := "daniel.whyte"
+	resp := authorize(authorizationLambdaIdentity{Id: "AIDAEXAMPLE", Name: &name, Account: "9876543210", Type: "User"})
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, int64(2 * 86400 + 19 * 3600), *resp.MaxValidityDuration, "certs expire when the shift ends")
+
+	resp = authorize(authorizationLambdaIdentity{Id: "AROAIIWP2XR7EN6ONCALL:anyone", Account: "9876543210", Type: "AssumedRole"})
+	assert.True(t, resp.Authorized)
+
+	// anyone who can assume a role can pick its session name
+	resp = authorize(authorizationLambdaIdentity{Id: "AROAIIWP2XR7EN6EXAMPLE:daniel.whyte", Account: "9876543210", Type: "AssumedRole"})
+	assert.False(t, resp.Authorized)
+
+	now = time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)
+	resp = authorize(authorizationLambdaIdentity{Id: "AIDAEXAMPLE", Name: &name, Account: "9876543210", Type: "User"})
+	assert.False(t, resp.Authorized)
+	assert.Equal(t, "on call: access is only allowed while on call", resp.Message)
+}
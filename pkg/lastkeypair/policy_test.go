@@ -0,0 +1,199 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicyYaml = `
+Rules:
+  - Name: no root
+    Effect: Deny
+    Message: nobody logs in as root
+    Match:
+      SshUsernames: [root]
+
+  - Name: ops
+    Match:
+      Accounts: ["9876543210"]
+      Names: ["*@example.com"]
+      Instances: ["arn:aws:ec2:*:9876543210:instance/*"]
+    Principals: [ops]
+    TargetAddress: 10.0.0.1
+    CertificateOptions:
+      PermitPty: true
+      SourceAddress: 10.0.0.0/8
+    MaxValidityDuration: 1800
+
+  - Name: contractors need a voucher
+    Match:
+      Types: [AssumedRole]
+      MinVouchers: 1
+
+HostRules:
+  - Name: our hosts
+    Match:
+      Accounts: ["9876543210"]
+    ValidityDuration: 86400
+`
+
+func testPolicyAuthorizer(t *testing.T) *PolicyAuthorizer {
+	doc, err := ParsePolicyDocument([]byte(testPolicyYaml))
+	assert.Nil(t, err)
+	authorizer, err := NewPolicyAuthorizer(doc)
+	assert.Nil(t, err)
+	return authorizer
+}
+
+func TestPolicyAuthorizerUserRules(t *testing.T) {
+	authorizer := testPolicyAuthorizer(t)
+	ctx := context.Background()
+	name := "aidan@example.com"
+	instance := "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"
+
+	req := LkpUserCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Name: &name, Id: "AIDAEXAMPLE", Account: "9876543210", Type: "User"},
+		RemoteInstanceArn: instance,
+		SshUsername: "ec2-user",
+	}
+
+	resp, err := authorizer.AuthorizeUser(ctx, req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, []string{"ops"}, resp.Principals)
+	assert.Equal(t, "10.0.0.1", resp.TargetAddress)
+	assert.Equal(t, "10.0.0.0/8", *resp.CertificateOptions.SourceAddress)
+	assert.Equal(t, int64(1800), *resp.MaxValidityDuration)
+
+	root := req
+	root.SshUsername = "root"
+	resp, err = authorizer.AuthorizeUser(ctx, root)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+	assert.Equal(t, "nobody logs in as root", resp.Message)
+
+	// assumed roles have no name, so fall through to the voucher rule
+	role := req
+	role.From = authorizationLambdaIdentity{Id: "AROAEXAMPLE:bob", Account: "9876543210", Type: "AssumedRole"}
+	resp, err = authorizer.AuthorizeUser(ctx, role)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+
+	role.Vouchers = []authorizationLambdaVoucher{{Id: "AIDAEXAMPLE", Account: "9876543210", Type: "User"}}
+	resp, err = authorizer.AuthorizeUser(ctx, role)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Nil(t, resp.Principals)
+}
+
+func TestPolicyAuthorizerHostRules(t *testing.T) {
+	authorizer := testPolicyAuthorizer(t)
+	instance := "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd"
+
+	resp, err := authorizer.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Account: "9876543210", Type: "AssumedRole"},
+		HostInstanceArn: instance,
+	})
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+	assert.Equal(t, []string{instance}, resp.Principals)
+	assert.Equal(t, int64(86400), *resp.ValidityDuration)
+
+	resp, err = authorizer.AuthorizeHost(context.Background(), LkpHostCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Account: "01234567890", Type: "AssumedRole"},
+		HostInstanceArn: instance,
+	})
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+}
+
+func TestPolicyIdsIgnoreRoleSessionNames(t *testing.T) {
+	doc := &PolicyDocument{Rules: []PolicyRule{{Name: "admins", Match: PolicyMatch{Ids: []string{"AROAADMINS*"}}}}}
+	authorizer, err := NewPolicyAuthorizer(doc)
+	assert.Nil(t, err)
+
+	req := LkpUserCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Id: "AROAADMINS:mallory", Account: "9876543210", Type: "AssumedRole"},
+		RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-0123abcd",
+		SshUsername: "ec2-user",
+	}
+	resp, err := authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+
+	// the session name is chosen by whoever assumes the role, so it can't be
+	// matched on, even with a wildcard in the role's part
+	req.From.Id = "AROADEVS:admin-alice"
+	doc.Rules[0].Match.Ids = []string{"*admin*"}
+	resp, err = authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+
+	for _, id := range []string{"*:alice", "AROAX*:admin*"} {
+		_, err = NewPolicyAuthorizer(&PolicyDocument{Rules: []PolicyRule{{Name: "spoofable", Match: PolicyMatch{Ids: []string{id}}}}})
+		assert.NotNil(t, err, id)
+	}
+	_, err = NewPolicyAuthorizer(&PolicyDocument{Groups: map[string]PolicyMatch{"seniors": {Ids: []string{"AROASENIORS:ben"}}}})
+	assert.NotNil(t, err)
+}
+
+func TestParsePolicyDocumentErrors(t *testing.T) {
+	_, err := ParsePolicyDocument([]byte(`{"Rules": [{"Name": "typo", "Match": {"Acounts": ["1"]}}]}`))
+	assert.NotNil(t, err)
+	_, err = ParsePolicyDocument([]byte(`{"Rules": [{"Name": "typo", "Match": {}, "When": {"Windows": [{"From": "09:00", "To": "17:00", "Dayz": ["Mon"]}]}}]}`))
+	assert.Contains(t, err.Error(), "Rules.0.When.Windows.0.Dayz")
+	_, err = ParsePolicyDocument([]byte("Rules:\n- Name: typo\n  Match: {}\n  CertificateOptions: {PermitPTY: false, ForceComand: uptime}\n"))
+	assert.Contains(t, err.Error(), "ForceComand")
+
+	_, err = ParsePolicyDocument([]byte(`{"Rules": [{"Name": "bad", "Effect": "Maybe"}]}`))
+	assert.NotNil(t, err)
+
+	_, err = ParsePolicyDocument([]byte(`{"Rules": [{"Name": "bad", "CertificateOptions": {"SourceAddress": "nope"}}]}`))
+	assert.NotNil(t, err)
+
+	doc, err := ParsePolicyDocument([]byte(`{"Rules": [{"Name": "json works too", "principals": ["ops"]}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ops"}, doc.Rules[0].Principals)
+}
+
+func TestPolicyVoucherRequirements(t *testing.T) {
+	doc, err := ParsePolicyDocument([]byte(`
+Groups:
+  seniors:
+    Names: [alice@example.com, bob@example.com, carol@example.com]
+Rules:
+  - Name: prod needs two seniors
+    Match:
+      Instances: ["*:instance/i-prod*"]
+      Vouchers:
+        - Group: seniors
+          Min: 2
+`))
+	assert.Nil(t, err)
+	authorizer, err := NewPolicyAuthorizer(doc)
+	assert.Nil(t, err)
+
+	senior := func(name string) authorizationLambdaVoucher {
+		return authorizationLambdaVoucher{Name: &name, Id: "AIDA" + name, Account: "9876543210", Type: "User"}
+	}
+	name := "mallory@example.com"
+
+	req := LkpUserCertAuthorizationRequest{
+		From: authorizationLambdaIdentity{Name: &name, Id: "AIDAMALLORY", Account: "9876543210", Type: "User"},
+		RemoteInstanceArn: "arn:aws:ec2:ap-southeast-2:9876543210:instance/i-prod1",
+		Vouchers: []authorizationLambdaVoucher{senior("alice@example.com"), senior("alice@example.com"), senior("dave@example.com")},
+	}
+
+	resp, err := authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Authorized)
+
+	req.Vouchers = append(req.Vouchers, senior("carol@example.com"))
+	resp, err = authorizer.AuthorizeUser(context.Background(), req)
+	assert.Nil(t, err)
+	assert.True(t, resp.Authorized)
+
+	_, err = ParsePolicyDocument([]byte(`{"Rules": [{"Name": "x", "Match": {"Vouchers": [{"Group": "nobody", "Min": 1}]}}]}`))
+	assert.NotNil(t, err)
+}
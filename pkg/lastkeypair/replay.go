@@ -0,0 +1,138 @@
+package lastkeypair
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"encoding/json"
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplayStore remembers the nonces of tokens that have been redeemed, so that
+// an intercepted token can't be used to get a second certificate.
+type ReplayStore interface {
+	// Redeem records nonce as used until expiry. It returns ErrTokenReplayed
+	// if the nonce has already been redeemed and hasn't yet expired.
+	Redeem(ctx context.Context, nonce string, expiry time.Time) error
+}
+
+// DynamoReplayStore uses conditional puts, so concurrent Lambda invocations
+// can't both redeem the same token. The table needs a string hash key named
+// "Nonce". Enabling DynamoDB TTL on the "ExpiresAt" attribute keeps it small.
+type DynamoReplayStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+}
+
+func NewDynamoReplayStore(sess *session.Session, table string) *DynamoReplayStore {
+	return &DynamoReplayStore{client: dynamodb.New(sess), table: table}
+}
+
+func (s *DynamoReplayStore) Redeem(ctx context.Context, nonce string, expiry time.Time) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	_, err := s.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &s.table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"Nonce":     {S: &nonce},
+			"ExpiresAt": {N: aws.String(strconv.FormatInt(expiry.Unix(), 10))},
+		},
+		// TTL deletion is lazy, so expired items may still be in the table
+		ConditionExpression:       aws.String("attribute_not_exists(Nonce) OR ExpiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":now": {N: &now}},
+	})
+
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrTokenReplayed
+	} else if err != nil {
+		return errors.Wrap(err, "recording token nonce in dynamodb")
+	}
+
+	return nil
+}
+
+// MemoryReplayStore only protects a single process, so it's intended for
+// tests and local CAs rather than Lambda.
+type MemoryReplayStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewMemoryReplayStore() *MemoryReplayStore {
+	return &MemoryReplayStore{used: map[string]time.Time{}}
+}
+
+func (s *MemoryReplayStore) Redeem(ctx context.Context, nonce string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return redeemNonce(s.used, nonce, expiry)
+}
+
+// FileReplayStore keeps redeemed nonces in a JSON file. It's safe for use by
+// multiple goroutines, but not by multiple processes.
+type FileReplayStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileReplayStore(path string) *FileReplayStore {
+	return &FileReplayStore{path: path}
+}
+
+func (s *FileReplayStore) Redeem(ctx context.Context, nonce string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := map[string]time.Time{}
+	existing, err := ioutil.ReadFile(s.path)
+	if err == nil {
+		err = json.Unmarshal(existing, &used)
+		if err != nil {
+			return errors.Wrap(err, "decoding replay store file")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading replay store file")
+	}
+
+	err = redeemNonce(used, nonce, expiry)
+	if err != nil {
+		return err
+	}
+
+	serialized, err := json.Marshal(used)
+	if err != nil {
+		return errors.Wrap(err, "encoding replay store file")
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, serialized, 0600)
+	if err != nil {
+		return errors.Wrap(err, "writing replay store file")
+	}
+
+	return errors.Wrap(os.Rename(tmpPath, s.path), "replacing replay store file")
+}
+
+func redeemNonce(used map[string]time.Time, nonce string, expiry time.Time) error {
+	now := time.Now()
+	for n, exp := range used {
+		if exp.Before(now) {
+			delete(used, n)
+		}
+	}
+
+	if _, found := used[nonce]; found {
+		return ErrTokenReplayed
+	}
+
+	used[nonce] = expiry
+	return nil
+}
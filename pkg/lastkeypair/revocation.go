@@ -0,0 +1,188 @@
+package lastkeypair
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Revocation revokes certificates by exactly one of serial, key id (i.e. all
+// of a user's certificates) or public key fingerprint (i.e. a leaked key).
+type Revocation struct {
+	Serial      uint64 `json:",omitempty"`
+	KeyId       string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"` // SHA256:... as printed by ssh-keygen -l
+	RevokedAt   int64
+	Reason      string `json:",omitempty"`
+}
+
+func (r Revocation) Validate() error {
+	set := 0
+	if r.Serial != 0 {
+		set++
+	}
+	if len(r.KeyId) > 0 {
+		set++
+	}
+	if len(r.Fingerprint) > 0 {
+		set++
+		if _, err := parseSha256Fingerprint(r.Fingerprint); err != nil {
+			return err
+		}
+	}
+
+	if set != 1 {
+		return errors.Wrap(ErrBadRequest, "exactly one of serial, key id or fingerprint must be revoked")
+	}
+	return nil
+}
+
+func (r Revocation) id() string {
+	switch {
+	case r.Serial != 0:
+		return fmt.Sprintf("serial:%d", r.Serial)
+	case len(r.KeyId) > 0:
+		return "keyid:" + r.KeyId
+	default:
+		return "fingerprint:" + r.Fingerprint
+	}
+}
+
+func parseSha256Fingerprint(fingerprint string) ([]byte, error) {
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return nil, errors.Wrapf(ErrBadRequest, "fingerprint %q is not a SHA256 fingerprint", fingerprint)
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, "SHA256:"))
+	if err != nil || len(hash) != 32 {
+		return nil, errors.Wrapf(ErrBadRequest, "fingerprint %q is malformed", fingerprint)
+	}
+	return hash, nil
+}
+
+// RevocationStore holds the revocations that are published in the KRL.
+type RevocationStore interface {
+	Revoke(ctx context.Context, revocation Revocation) error
+	Revocations(ctx context.Context) ([]Revocation, error)
+}
+
+// DynamoRevocationStore needs a table with a string hash key named "Id".
+type DynamoRevocationStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+}
+
+func NewDynamoRevocationStore(sess *session.Session, table string) *DynamoRevocationStore {
+	return &DynamoRevocationStore{client: dynamodb.New(sess), table: table}
+}
+
+func (s *DynamoRevocationStore) Revoke(ctx context.Context, revocation Revocation) error {
+	err := revocation.Validate()
+	if err != nil {
+		return err
+	}
+
+	item, err := dynamodbattribute.MarshalMap(revocation)
+	if err != nil {
+		return errors.Wrap(err, "encoding revocation")
+	}
+	id := revocation.id()
+	item["Id"] = &dynamodb.AttributeValue{S: &id}
+
+	_, err = s.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: &s.table, Item: item})
+	return errors.Wrap(err, "recording revocation in dynamodb")
+}
+
+func (s *DynamoRevocationStore) Revocations(ctx context.Context) ([]Revocation, error) {
+	revocations := []Revocation{}
+	var unmarshalErr error
+
+	err := s.client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{TableName: &s.table}, func(page *dynamodb.ScanOutput, last bool) bool {
+		pageRevocations := []Revocation{}
+		unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageRevocations)
+		revocations = append(revocations, pageRevocations...)
+		return unmarshalErr == nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing revocations in dynamodb")
+	} else if unmarshalErr != nil {
+		return nil, errors.Wrap(unmarshalErr, "decoding revocations")
+	}
+
+	return revocations, nil
+}
+
+// FileRevocationStore appends revocations to a JSON-lines file.
+type FileRevocationStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileRevocationStore(path string) *FileRevocationStore {
+	return &FileRevocationStore{path: path}
+}
+
+func (s *FileRevocationStore) Revoke(ctx context.Context, revocation Revocation) error {
+	err := revocation.Validate()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(revocation)
+	if err != nil {
+		return errors.Wrap(err, "encoding revocation")
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening revocation file")
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return errors.Wrap(err, "writing revocation file")
+}
+
+func (s *FileRevocationStore) Revocations(ctx context.Context) ([]Revocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revocations := []Revocation{}
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return revocations, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "opening revocation file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		revocation := Revocation{}
+		err = json.Unmarshal(scanner.Bytes(), &revocation)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding revocation file")
+		}
+		revocations = append(revocations, revocation)
+	}
+
+	return revocations, errors.Wrap(scanner.Err(), "reading revocation file")
+}
@@ -2,7 +2,6 @@ package lastkeypair
 
 import (
 	"github.com/aws/aws-sdk-go/aws/session"
-	"log"
 	"io/ioutil"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"encoding/json"
@@ -10,137 +9,155 @@ import (
 	"github.com/pkg/errors"
 	"fmt"
 	"strings"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"context"
 	"path/filepath"
 	"os"
+	"time"
 )
 
-func sshReqResp(sess *session.Session, lambdaFunc, kmsKeyId, instanceArn, username string, encodedVouchers []string) (UserCertReqJson, UserCertRespJson) {
-	kp, _ := MyKeyPair()
+// ReifiedLogin is a user certificate for a particular instance, along with the
+// files ssh needs to use it.
+type ReifiedLogin struct {
+	client          *Client
+	InstanceArn     string
+	KeyType         KeyType
+	username        string
+	vouchers        []VoucherToken
+	// ValidityDuration is passed through to UserCertRequest
+	ValidityDuration time.Duration `json:"-"`
 
-	ident, err := CallerIdentityUser(sess)
-	if err != nil {
-		log.Panicf("error getting aws user identity: %+v\n", err)
+	Request  *UserCertReqJson
+	Response *UserCertRespJson
+}
+
+func NewReifiedLogin(client *Client, instanceArn, username string, vouchers []VoucherToken) *ReifiedLogin {
+	return &ReifiedLogin{
+		client:      client,
+		InstanceArn: instanceArn,
+		KeyType:     client.KeyType(),
+		username:    username,
+		vouchers:    vouchers,
 	}
+}
 
+// DecodeVoucherTokens decodes vouchers as passed on the command line.
+func DecodeVoucherTokens(encodedVouchers []string) ([]VoucherToken, error) {
 	vouchers := []VoucherToken{}
 	for _, encVoucher := range encodedVouchers {
 		voucher, err := DecodeVoucherToken(encVoucher)
 		if err != nil {
-			log.Panicf("couldn't decode voucher: %+v\n", err)
+			return nil, errors.Wrap(err, "decoding voucher")
 		}
 		vouchers = append(vouchers, *voucher)
 	}
+	return vouchers, nil
+}
 
-	token := CreateToken(sess, TokenParams{
-		FromId: ident.UserId,
-		FromAccount: ident.AccountId,
-		FromName: ident.Username,
-		To: "LastKeypair",
-		Type: ident.Type,
-		RemoteInstanceArn: instanceArn,
-		Vouchers: vouchers,
-		SshUsername: username,
-	}, kmsKeyId)
-
-	req := UserCertReqJson{
-		EventType: "UserCertReq",
-		Token: token,
-		PublicKey: string(kp.PublicKey),
+func (r *ReifiedLogin) userCertRequest() UserCertRequest {
+	return UserCertRequest{
+		InstanceArn: r.InstanceArn,
+		SshUsername: r.username,
+		Vouchers:    r.vouchers,
+		ValidityDuration: r.ValidityDuration,
 	}
+}
 
-	resp := UserCertRespJson{}
-	err = RequestSignedPayload(sess, lambdaFunc, req, &resp)
+func (r *ReifiedLogin) PopulateByInvoke(ctx context.Context) error {
+	req, resp, err := r.client.RequestUserCert(ctx, r.userCertRequest())
 	if err != nil {
-		log.Panicf("err: %s", err.Error())
+		return err
 	}
 
-	return req, resp
-}
+	r.Request = req
+	r.Response = resp
 
-//func SshCommand(sess *session.Session, lambdaFunc, kmsKeyId, InstanceArn, username string, encodedVouchers, args []string) []string {
-//	req, resp := sshReqResp(sess, lambdaFunc, kmsKeyId, InstanceArn, username, encodedVouchers)
-//	return append(sshCommandFromResponse(req, resp), args...)
-//}
+	certPath := r.CertificatePath()
+	ioutil.WriteFile(certPath, []byte(resp.SignedPublicKey), 0644)
+	for _, j := range r.Response.Jumpboxes {
+		ioutil.WriteFile(r.jumpCertificatePath(j), []byte(j.SignedPublicKey), 0644)
+	}
 
-type ReifiedLogin struct {
-	sess            *session.Session
-	lambdaFunc      string
-	kmsKeyId        string
-	InstanceArn     string
-	username        string
-	encodedVouchers []string
-	args            []string
+	if len(resp.TrustedCaKeys) > 0 {
+		err = r.writeKnownHosts(resp.TrustedCaKeys)
+		if err != nil {
+			return err
+		}
+	}
 
-	Request  *UserCertReqJson
-	Response *UserCertRespJson
+	serialized, _ := json.MarshalIndent(r, "", "  ")
+	ioutil.WriteFile(r.Filepath("conn.json"), serialized, 0644)
+	return nil
 }
 
-func NewReifiedLoginWithCmd(cmd *cobra.Command, args []string) *ReifiedLogin {
-	profile := viper.GetString("profile")
-
-	lambdaFunc := viper.GetString("lambda-func")
-	kmsKeyId := viper.GetString("kms-key")
-	instanceArn, _ := cmd.PersistentFlags().GetString("instance-arn")
-	username, _ := cmd.PersistentFlags().GetString("ssh-username")
-	region, _ := cmd.PersistentFlags().GetString("region")
-	vouchers, _ := cmd.PersistentFlags().GetStringSlice("voucher")
-	
-	instanceArnParts := strings.Split(instanceArn, ":")
-	if len(instanceArnParts) > 3 {
-		region = instanceArnParts[3]
+// writeKnownHosts trusts host certificates from every CA key, so that hosts
+// don't need to be re-provisioned when the CA key is rotated. The CA is only
+// trusted for the hosts in this login; lines for other hosts are kept.
+func (r *ReifiedLogin) writeKnownHosts(caKeys []string) error {
+	hosts := []string{r.Request.Token.Params.RemoteInstanceArn}
+	for _, j := range r.Response.Jumpboxes {
+		hosts = append(hosts, j.HostKeyAlias)
 	}
-	sess := ClientAwsSession(profile, region)
 
-	return &ReifiedLogin{
-		sess:            sess,
-		lambdaFunc:      lambdaFunc,
-		kmsKeyId:        kmsKeyId,
-		InstanceArn:     instanceArn,
-		username:        username,
-		encodedVouchers: vouchers,
-		args:            args,
+	replaced := map[string]bool{}
+	for _, host := range hosts {
+		replaced[host] = true
 	}
-}
 
-func (r *ReifiedLogin) PopulateByInvoke() {
-	req, resp := sshReqResp(r.sess, r.lambdaFunc, r.kmsKeyId, r.InstanceArn, r.username, r.encodedVouchers)
-
-	r.Request = &req
-	r.Response = &resp
+	filebuf := ""
+	existing, _ := ioutil.ReadFile(r.KnownHostsPath())
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || replaced[fields[1]] {
+			continue
+		}
+		filebuf = filebuf + line + "\n"
+	}
 
-	certPath := r.CertificatePath()
-	ioutil.WriteFile(certPath, []byte(resp.SignedPublicKey), 0644)
-	for _, j := range r.Response.Jumpboxes {
-		ioutil.WriteFile(j.JumpCertificatePath(), []byte(j.SignedPublicKey), 0644)
+	for _, host := range hosts {
+		for _, key := range caKeys {
+			filebuf = filebuf + fmt.Sprintf("@cert-authority %s %s\n", host, key)
+		}
 	}
 
-	serialized, _ := json.MarshalIndent(r, "", "  ")
-	ioutil.WriteFile(r.Filepath("conn.json"), serialized, 0644)
+	err := ioutil.WriteFile(r.KnownHostsPath(), []byte(filebuf), 0644)
+	return errors.Wrap(err, "writing known hosts")
 }
 
 func (r* ReifiedLogin) Filepath(name string) string {
 	arn := r.InstanceArn
 	arn = strings.Replace(arn, ":", "-", -1)
 	arn = strings.Replace(arn, "/", "-", -1)
-	arnDir := filepath.Join(TmpDir(), arn)
+	arnDir := filepath.Join(r.tmpDir(), arn)
 	os.MkdirAll(arnDir, 0755)
 	return filepath.Join(arnDir, name)
 }
 
-func (j* Jumpbox) JumpboxFilepath() string {
+func (r *ReifiedLogin) jumpboxFilepath(j Jumpbox) string {
 	arn := j.HostKeyAlias
 	arn = strings.Replace(arn, ":", "-", -1)
 	arn = strings.Replace(arn, "/", "-", -1)
-	arnDir := filepath.Join(TmpDir(), arn)
+	arnDir := filepath.Join(r.tmpDir(), arn)
 	os.MkdirAll(arnDir, 0755)
 	return filepath.Join(arnDir)
 }
 
+func (r *ReifiedLogin) tmpDir() string {
+	return filepath.Join(r.client.CacheDir(), "tmp")
+}
+
 func (r *ReifiedLogin) PopulateByRestoreCache() {
-	serialized, _ := ioutil.ReadFile(r.Filepath("conn.json"))
+	serialized, err := ioutil.ReadFile(r.Filepath("conn.json"))
+	if err != nil {
+		return
+	}
+
+	r.KeyType = ""
 	json.Unmarshal(serialized, r)
+
+	if len(r.KeyType) == 0 {
+		// conn.json was written before key types were configurable
+		r.KeyType = KeyTypeRsa4096
+	}
 }
 
 func (r *ReifiedLogin) WriteSshConfig() string {
@@ -148,6 +165,12 @@ func (r *ReifiedLogin) WriteSshConfig() string {
 
 	filebuf := "IgnoreUnknown CertificateFile\n" // CertificateFile was introduced in 7.1
 
+	// ssh records keys it learns in the first file, so the user's own comes first
+	knownHosts := ""
+	if _, err := os.Stat(r.KnownHostsPath()); err == nil {
+		knownHosts = fmt.Sprintf("  UserKnownHostsFile ~/.ssh/known_hosts %s\n", r.KnownHostsPath())
+	}
+
 	for idx, j := range jump {
 		filebuf = filebuf + fmt.Sprintf(`
 Host jump%d
@@ -155,8 +178,8 @@ Host jump%d
   HostKeyAlias %s
   IdentityFile %s
   CertificateFile %s
-  User %s
-`, idx, j.Address, j.HostKeyAlias, r.PrivateKeyPath(), j.JumpCertificatePath(), j.User)
+%s  User %s
+`, idx, j.Address, j.HostKeyAlias, r.PrivateKeyPath(), r.jumpCertificatePath(j), knownHosts, j.User)
 		if idx > 0 {
 			filebuf = filebuf + fmt.Sprintf("  ProxyJump jump%d\n\n", idx-1)
 		}
@@ -167,8 +190,8 @@ Host target
   HostKeyAlias %s
   IdentityFile %s
   CertificateFile %s
-  User %s
-`, r.Request.Token.Params.RemoteInstanceArn, r.PrivateKeyPath(), r.CertificatePath(), r.Request.Token.Params.SshUsername)
+%s  User %s
+`, r.Request.Token.Params.RemoteInstanceArn, r.PrivateKeyPath(), r.CertificatePath(), knownHosts, r.Request.Token.Params.SshUsername)
 
 	if len(r.Response.TargetAddress) > 0 {
 		filebuf = filebuf + fmt.Sprintf("  HostName %s\n", r.Response.TargetAddress)
@@ -185,15 +208,21 @@ Host target
 }
 
 func (r *ReifiedLogin) PrivateKeyPath() string {
-	return filepath.Join(AppDir(), "id_rsa")
+	return filepath.Join(r.client.CacheDir(), r.KeyType.Filename())
 }
 
 func (r *ReifiedLogin) CertificatePath() string {
-	return filepath.Join(AppDir(), "id_rsa-cert.pub")
+	return filepath.Join(r.client.CacheDir(), r.KeyType.Filename() + "-cert.pub")
 }
 
-func (j* Jumpbox) JumpCertificatePath() string {
-	return filepath.Join(j.JumpboxFilepath(), "id_rsa-cert.pub")
+// KnownHostsPath is lkp's own known_hosts file, with @cert-authority lines for
+// the hosts that have been logged into.
+func (r *ReifiedLogin) KnownHostsPath() string {
+	return filepath.Join(r.client.CacheDir(), "ca_known_hosts")
+}
+
+func (r *ReifiedLogin) jumpCertificatePath(j Jumpbox) string {
+	return filepath.Join(r.jumpboxFilepath(j), r.KeyType.Filename() + "-cert.pub")
 }
 
 func lambdaClientForKeyId(sess *session.Session, lambdaArn string) *lambda.Lambda {
@@ -206,7 +235,7 @@ func lambdaClientForKeyId(sess *session.Session, lambdaArn string) *lambda.Lambd
 	return lambda.New(sess)
 }
 
-func RequestSignedPayload(sess *session.Session, lambdaArn string, req interface{}, resp interface{}) error {
+func RequestSignedPayload(ctx context.Context, sess *session.Session, lambdaArn string, req interface{}, resp interface{}) error {
 	ca := lambdaClientForKeyId(sess, lambdaArn)
 
 	reqPayload, err := json.Marshal(&req)
@@ -219,12 +248,12 @@ func RequestSignedPayload(sess *session.Session, lambdaArn string, req interface
 		Payload: reqPayload,
 	}
 
-	lambdaResp, err := ca.Invoke(&input)
+	lambdaResp, err := ca.InvokeWithContext(ctx, &input)
 	if err != nil {
 		return errors.Wrap(err, "invoking CA lambda")
 	}
 	if lambdaResp.FunctionError != nil {
-		return errors.New(fmt.Sprintf("%s: %s", *lambdaResp.FunctionError, string(lambdaResp.Payload)))
+		return functionError(*lambdaResp.FunctionError, lambdaResp.Payload)
 	}
 
 	err = json.Unmarshal(lambdaResp.Payload, resp)
@@ -234,3 +263,18 @@ func RequestSignedPayload(sess *session.Session, lambdaArn string, req interface
 
 	return nil
 }
+
+// functionError turns a Lambda function error payload back into an error. If
+// it came from LambdaHandle then errors.Cause will be the original sentinel.
+func functionError(functionError string, payload []byte) error {
+	lambdaErr := struct {
+		ErrorMessage string `json:"errorMessage"`
+	}{}
+	json.Unmarshal(payload, &lambdaErr)
+
+	if parsed := parseError(lambdaErr.ErrorMessage); parsed != nil {
+		return parsed
+	}
+
+	return errors.New(fmt.Sprintf("%s: %s", functionError, string(payload)))
+}
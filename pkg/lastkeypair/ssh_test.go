@@ -0,0 +1,48 @@
+package lastkeypair
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"strings"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func testReifiedLogin(t *testing.T, dir, instanceArn string, jumpboxes ...Jumpbox) *ReifiedLogin {
+	client := NewClient(WithCacheDir(dir), WithSession(session.Must(session.NewSession())))
+	r := NewReifiedLogin(client, instanceArn, "ec2-user", nil)
+
+	params := testTokenParams()
+	params.RemoteInstanceArn = instanceArn
+	r.Request = &UserCertReqJson{Token: Token{Params: params}}
+	r.Response = &UserCertRespJson{Jumpboxes: jumpboxes}
+	return r
+}
+
+func TestKnownHostsScopedToLogin(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lkp")
+	defer os.RemoveAll(dir)
+
+	first := testReifiedLogin(t, dir, "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-first", Jumpbox{HostKeyAlias: "12.34.56.78"})
+	sshconf, err := ioutil.ReadFile(first.WriteSshConfig())
+	assert.Nil(t, err)
+	assert.NotContains(t, string(sshconf), "UserKnownHostsFile")
+
+	assert.Nil(t, first.writeKnownHosts([]string{"ssh-ed25519 AAAAold", "ssh-ed25519 AAAAnew"}))
+	second := testReifiedLogin(t, dir, "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-second")
+	assert.Nil(t, second.writeKnownHosts([]string{"ssh-ed25519 AAAAnew"}))
+	assert.Nil(t, first.writeKnownHosts([]string{"ssh-ed25519 AAAAnew"}))
+
+	knownHosts, err := ioutil.ReadFile(first.KnownHostsPath())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"@cert-authority arn:aws:ec2:ap-southeast-2:123456789012:instance/i-second ssh-ed25519 AAAAnew",
+		"@cert-authority arn:aws:ec2:ap-southeast-2:123456789012:instance/i-first ssh-ed25519 AAAAnew",
+		"@cert-authority 12.34.56.78 ssh-ed25519 AAAAnew",
+	}, strings.Split(strings.TrimSpace(string(knownHosts)), "\n"))
+
+	sshconf, err = ioutil.ReadFile(first.WriteSshConfig())
+	assert.Nil(t, err)
+	assert.Contains(t, string(sshconf), "UserKnownHostsFile ~/.ssh/known_hosts " + first.KnownHostsPath() + "\n")
+}
@@ -1,10 +1,13 @@
 package lastkeypair
 
-import "fmt"
-
 type Token struct {
 	Params TokenParams
 	Signature []byte
+	ContextVersion int `json:",omitempty"` // absent for tokens issued with the legacy kms context
+	// Expiry is a unix time copied from the payload's NotAfter, which holders
+	// of the token can't otherwise see. It isn't authenticated, so the CA
+	// ignores it.
+	Expiry int64 `json:",omitempty"`
 }
 
 type TokenParams struct {
@@ -28,63 +31,11 @@ type TokenParams struct {
 
 	SshUsername string `json:",omitempty"` // username on remote instance that user wants to access
 	Principals []string `json:",omitempty"` // additional principals to include in cert
-}
-
-func (params *TokenParams) ToKmsContext() map[string]*string {
-	// TODO: i think this is a recipe for problems. see issue #24
-	iterateParams := func(p *TokenParams, cb func(string, *string)) {
-		cb("fromId", &p.FromId)
-		cb("fromAccount", &p.FromAccount)
-		cb("to", &p.To)
-		cb("type", &p.Type)
-
-		if len(p.FromName) > 0 {
-			cb("fromName", &p.FromName)
-		}
-
-		if len(p.HostInstanceArn) > 0 {
-			cb("hostInstanceArn", &p.HostInstanceArn)
-		}
-
-		if len(p.RemoteInstanceArn) > 0 {
-			cb("remoteInstanceArn", &p.RemoteInstanceArn)
-		}
-
-		if len(p.SshUsername) > 0 {
-			cb("sshUsername", &p.SshUsername)
-		}
-
-		if len(p.Vouchee) > 0 {
-			cb("vouchee", &p.Vouchee)
-		}
-
-		if len(p.Context) > 0 {
-			cb("context", &p.Context)
-		}
-	}
-
-	context := make(map[string]*string)
-	iterateParams(params, func(key string, val *string) {
-		context[key] = val
-	})
-
-	if len(params.Vouchers) > 0 {
-		for i, v := range params.Vouchers {
-			keyPrefix := fmt.Sprintf("voucher-%d-", i)
-
-			iterateParams(&v.Params, func(key string, val *string) {
-				context[keyPrefix + key] = val
-			})
-		}
-	}
-
-	if len(params.Principals) > 0 {
-		for i, principal := range params.Principals {
-			principal := principal
-			key := fmt.Sprintf("principal-%d", i)
-			context[key] = &principal
-		}
-	}
 
-	return context
+	// SHA256 fingerprint of the public key to be signed. this binds the token to the
+	// key in the cert request, otherwise anyone who intercepted a request could swap
+	// in their own key. it also means the fingerprint is logged in cloudtrail.
+	PublicKeyFingerprint string `json:",omitempty"`
+	// used instead of PublicKeyFingerprint when a host asks for several keys to be signed at once
+	PublicKeyFingerprints []string `json:",omitempty"`
 }
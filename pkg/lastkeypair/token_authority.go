@@ -0,0 +1,215 @@
+package lastkeypair
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/glassechidna/lastkeypair/pkg/lastkeypair/cli"
+	"github.com/pkg/errors"
+	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"context"
+)
+
+// TokenAuthority issues the tokens that clients use to prove their identity
+// to the CA and verifies them on the CA side. KMS is the production backend,
+// but anything that can bind a payload to a set of TokenParams will do.
+type TokenAuthority interface {
+	// Issue seals payload into a token that is only valid for params.
+	Issue(ctx context.Context, params TokenParams, payload PlaintextPayload) (*Token, error)
+	// Verify checks that token was issued by this authority for its params
+	// and returns the payload sealed inside it.
+	Verify(ctx context.Context, token Token) (*PlaintextPayload, error)
+}
+
+type KmsTokenAuthority struct {
+	sess  *session.Session
+	keyId string
+
+	// AllowLegacyContext accepts tokens issued with the v1 kms context, for
+	// use while clients are being upgraded.
+	AllowLegacyContext bool
+}
+
+// NewKmsTokenAuthority returns a TokenAuthority backed by KMS. When issuing,
+// keyId may be a key id, alias or ARN. When verifying, it must be the ARN of
+// the key that tokens are expected to be encrypted under.
+func NewKmsTokenAuthority(sess *session.Session, keyId string) *KmsTokenAuthority {
+	return &KmsTokenAuthority{sess: sess, keyId: keyId}
+}
+
+func (a *KmsTokenAuthority) Issue(ctx context.Context, params TokenParams, payload PlaintextPayload) (*Token, error) {
+	plaintext, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding payload json")
+	}
+
+	context, err := params.ToKmsContext()
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding kms context")
+	}
+
+	keyArn, err := cli.FullKmsKey(a.sess, a.keyId)
+	if err != nil {
+		return nil, errors.Wrap(err, "determining KMS key ARN from key id/alias")
+	}
+
+	input := &kms.EncryptInput{
+		Plaintext: plaintext,
+		KeyId: &keyArn,
+		EncryptionContext: context,
+	}
+
+	client := kmsClientForKeyId(a.sess, keyArn)
+	response, err := client.EncryptWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypting token payload")
+	}
+
+	return &Token{Params: params, Signature: response.CiphertextBlob, ContextVersion: KmsContextVersion}, nil
+}
+
+func (a *KmsTokenAuthority) Verify(ctx context.Context, token Token) (*PlaintextPayload, error) {
+	if token.ContextVersion < KmsContextVersion && !a.AllowLegacyContext {
+		return nil, errors.Wrap(ErrInvalidToken, "tokens with a legacy kms context are no longer accepted")
+	}
+
+	context, err := token.KmsContext()
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding kms context")
+	}
+
+	input := &kms.DecryptInput{
+		CiphertextBlob: token.Signature,
+		EncryptionContext: context,
+	}
+
+	client := kms.New(a.sess)
+	response, err := client.DecryptWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kms.ErrCodeInvalidCiphertextException {
+		return nil, errors.Wrap(ErrInvalidToken, aerr.Message())
+	} else if err != nil {
+		return nil, errors.Wrap(err, "decrypting token payload")
+	}
+
+	/* We verify that the encryption key used is the one that we expected it to be.
+	   This is very important, as an attacker could submit ciphertext encrypted with
+	   a key they control that grants our Lambda permission to decrypt. Perhaps it
+	   would be worth implementing some kind of alert here?
+	 */
+	if a.keyId != *response.KeyId {
+		return nil, errors.Wrapf(ErrKeyMismatch, "expected %s, got %s", a.keyId, *response.KeyId)
+	}
+
+	payload := PlaintextPayload{}
+	err = json.Unmarshal(response.Plaintext, &payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token json")
+	}
+
+	return &payload, nil
+}
+
+// HmacTokenAuthority is an in-process TokenAuthority for tests and
+// air-gapped environments where KMS isn't available. Anyone holding the
+// key can both issue and verify tokens, so it must be treated as carefully
+// as the CA private key.
+type HmacTokenAuthority struct {
+	key []byte
+
+	// AllowLegacyContext accepts tokens issued with the v1 kms context, for
+	// tools that only inspect tokens. v1 tokens aren't bound to a key.
+	AllowLegacyContext bool
+}
+
+func NewHmacTokenAuthority(key []byte) *HmacTokenAuthority {
+	return &HmacTokenAuthority{key: key}
+}
+
+type hmacTokenSignature struct {
+	Payload []byte
+	Mac     []byte
+}
+
+func (a *HmacTokenAuthority) Issue(ctx context.Context, params TokenParams, payload PlaintextPayload) (*Token, error) {
+	plaintext, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding payload json")
+	}
+
+	token := Token{Params: params, ContextVersion: KmsContextVersion}
+	mac, err := a.mac(token, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Signature, err = json.Marshal(&hmacTokenSignature{
+		Payload: plaintext,
+		Mac:     mac,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding token signature")
+	}
+
+	return &token, nil
+}
+
+func (a *HmacTokenAuthority) Verify(ctx context.Context, token Token) (*PlaintextPayload, error) {
+	if token.ContextVersion < KmsContextVersion && !a.AllowLegacyContext {
+		return nil, errors.Wrap(ErrInvalidToken, "tokens with a legacy kms context are no longer accepted")
+	}
+
+	signature := hmacTokenSignature{}
+	err := json.Unmarshal(token.Signature, &signature)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, "decoding token signature")
+	}
+
+	mac, err := a.mac(token, signature.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(signature.Mac, mac) {
+		return nil, errors.Wrap(ErrInvalidToken, "token signature does not match params")
+	}
+
+	payload := PlaintextPayload{}
+	err = json.Unmarshal(signature.Payload, &payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding token json")
+	}
+
+	return &payload, nil
+}
+
+// PeekTokenPayload returns the payload of a token issued by an
+// HmacTokenAuthority without verifying it, for inspecting tokens offline. KMS
+// payloads are encrypted, so it returns nil for those.
+func PeekTokenPayload(token Token) *PlaintextPayload {
+	signature := hmacTokenSignature{}
+	if json.Unmarshal(token.Signature, &signature) != nil || len(signature.Mac) == 0 {
+		return nil
+	}
+
+	payload := PlaintextPayload{}
+	if json.Unmarshal(signature.Payload, &payload) != nil {
+		return nil
+	}
+	return &payload
+}
+
+// mac authenticates the same key/value pairs that KMS would see as the
+// encryption context, followed by the payload.
+func (a *HmacTokenAuthority) mac(token Token, plaintext []byte) ([]byte, error) {
+	context, err := token.KmsContext()
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding kms context")
+	}
+
+	h := hmac.New(sha256.New, a.key)
+	canonicalKmsContext(h, context)
+	h.Write(plaintext)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,88 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"io/ioutil"
+	"os"
+	"github.com/stretchr/testify/assert"
+	"github.com/pkg/errors"
+)
+
+func TestHmacTokenAuthority(t *testing.T) {
+	authority := testTokenAuthority()
+	token := mustCreateToken(t, authority, testTokenParams())
+	assert.Nil(t, ValidateToken(context.Background(), authority, token, nil))
+
+	tampered := token
+	tampered.Params.SshUsername = "root"
+	_, err := authority.Verify(context.Background(), tampered)
+	assert.NotNil(t, err)
+
+	_, err = NewHmacTokenAuthority([]byte("other")).Verify(context.Background(), token)
+	assert.NotNil(t, err)
+}
+
+func TestHmacTokenAuthorityLegacyContext(t *testing.T) {
+	authority := testTokenAuthority()
+	token := Token{Params: testTokenParams()}
+	plaintext := []byte(`{"NotBefore": 0, "NotAfter": 0}`)
+	mac, err := authority.mac(token, plaintext)
+	assert.Nil(t, err)
+	token.Signature, err = json.Marshal(&hmacTokenSignature{Payload: plaintext, Mac: mac})
+	assert.Nil(t, err)
+
+	_, err = authority.Verify(context.Background(), token)
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err))
+
+	authority.AllowLegacyContext = true
+	_, err = authority.Verify(context.Background(), token)
+	assert.Nil(t, err)
+}
+
+func TestPeekTokenPayload(t *testing.T) {
+	token := mustCreateToken(t, testTokenAuthority(), testTokenParams())
+	payload := PeekTokenPayload(token)
+	assert.NotNil(t, payload)
+	assert.Equal(t, token.Expiry, payload.NotAfter)
+
+	token.Signature = []byte("kms ciphertext")
+	assert.Nil(t, PeekTokenPayload(token))
+}
+
+func TestValidateTokenRejectsReplays(t *testing.T) {
+	authority := testTokenAuthority()
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	replays := NewFileReplayStore(filepath.Join(dir, "replays.json"))
+
+	token := mustCreateToken(t, authority, testTokenParams())
+	assert.Nil(t, ValidateToken(context.Background(), authority, token, replays))
+	assert.Equal(t, ErrTokenReplayed, errors.Cause(ValidateToken(context.Background(), authority, token, replays)))
+
+	other := mustCreateToken(t, authority, testTokenParams())
+	assert.Nil(t, ValidateToken(context.Background(), authority, other, replays))
+}
+
+func TestUserCertReqWithLocalAuthority(t *testing.T) {
+	config := testCaConfig(t)
+	config.ReplayStore = NewMemoryReplayStore()
+
+	params := testTokenParams()
+	kp := testKeyPair(t, &params)
+	other := testKeyPair(t, &TokenParams{})
+
+	_, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, other), config)
+	assert.Equal(t, ErrPublicKeyMismatch, errors.Cause(err))
+
+	resp, err := DoUserCertReq(context.Background(), testUserCertReq(t, params, kp), config)
+	assert.Nil(t, err)
+
+	cert := parseTestCert(t, resp.SignedPublicKey)
+	assert.Equal(t, []string{params.RemoteInstanceArn}, cert.ValidPrincipals)
+	assert.Equal(t, "aidan-AIDAEXAMPLE", cert.KeyId)
+}
@@ -3,17 +3,74 @@ package lastkeypair
 import (
 	"encoding/json"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"log"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"github.com/pkg/errors"
+	"hash/crc32"
 	"io/ioutil"
+	"context"
+	"fmt"
+	"strings"
+	"time"
 )
 
 type VoucherToken Token
 
+const voucherV2Prefix = "lkpv2_"
+
+// voucherV2 is the compact form of a voucher. It only has room for the fields
+// that Vouch sets. Names are short because vouchers get pasted into chat.
+type voucherV2 struct {
+	FromId         string `json:"i"`
+	FromAccount    string `json:"a"`
+	FromName       string `json:"n,omitempty"`
+	To             string `json:"t"`
+	Type           string `json:"y"`
+	Vouchee        string `json:"v"`
+	Scope          string `json:"s"` // the instance ARN, i.e. Params.Context
+	SshUsername    string `json:"u,omitempty"`
+	Expiry         int64  `json:"e"`
+	ContextVersion int    `json:"c,omitempty"`
+	Signature      []byte `json:"g"`
+}
+
+// Encode uses the v2 format: "lkpv2_" followed by unpadded base64url of the
+// deflated JSON of a voucherV2 and the CRC-32 of that, so that truncated
+// vouchers are caught when they're decoded rather than by the CA.
 func (vt *VoucherToken) Encode() string {
+	jsonVoucher, _ := json.Marshal(voucherV2{
+		FromId:         vt.Params.FromId,
+		FromAccount:    vt.Params.FromAccount,
+		FromName:       vt.Params.FromName,
+		To:             vt.Params.To,
+		Type:           vt.Params.Type,
+		Vouchee:        vt.Params.Vouchee,
+		Scope:          vt.Params.Context,
+		SshUsername:    vt.Params.SshUsername,
+		Expiry:         vt.Expiry,
+		ContextVersion: vt.ContextVersion,
+		Signature:      vt.Signature,
+	})
+
+	buf := bytes.Buffer{}
+	fl, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fl.Write(jsonVoucher)
+	fl.Close()
+
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(checksum)
+
+	return voucherV2Prefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// EncodeV1 is the original gzipped JSON token in base32, for lkp versions
+// that can't decode v2 vouchers yet.
+func (vt *VoucherToken) EncodeV1() string {
 	jsonToken, _ := json.Marshal(vt)
 	buf := bytes.Buffer{}
 	gz := gzip.NewWriter(&buf)
@@ -24,7 +81,64 @@ func (vt *VoucherToken) Encode() string {
 	return encoded
 }
 
+// DecodeVoucherToken accepts both v2 and, while lkp versions that only
+// produce it are still around, v1 vouchers.
 func DecodeVoucherToken(encoded string) (*VoucherToken, error) {
+	encoded = strings.TrimSpace(encoded)
+	if strings.HasPrefix(encoded, voucherV2Prefix) {
+		return decodeVoucherV2(strings.TrimPrefix(encoded, voucherV2Prefix))
+	}
+	return decodeVoucherV1(encoded)
+}
+
+func decodeVoucherV2(encoded string) (*VoucherToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding base64 voucher")
+	}
+
+	if len(raw) < 4 {
+		return nil, errors.New("voucher is truncated")
+	}
+
+	compressed, checksum := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(compressed) != binary.BigEndian.Uint32(checksum) {
+		return nil, errors.New("voucher is truncated or corrupt: checksum doesn't match")
+	}
+
+	jsonVoucher, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading deflated voucher")
+	}
+
+	v := voucherV2{}
+	err = json.Unmarshal(jsonVoucher, &v)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading json voucher")
+	}
+
+	if len(v.Scope) == 0 {
+		return nil, errors.New("voucher has no scope")
+	}
+
+	return &VoucherToken{
+		Params: TokenParams{
+			FromId:      v.FromId,
+			FromAccount: v.FromAccount,
+			FromName:    v.FromName,
+			To:          v.To,
+			Type:        v.Type,
+			Vouchee:     v.Vouchee,
+			Context:     v.Scope,
+			SshUsername: v.SshUsername,
+		},
+		Signature:      v.Signature,
+		ContextVersion: v.ContextVersion,
+		Expiry:         v.Expiry,
+	}, nil
+}
+
+func decodeVoucherV1(encoded string) (*VoucherToken, error) {
 	compressed, err := base32.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return nil, errors.Wrap(err, "decoding base32 voucher")
@@ -50,22 +164,137 @@ func DecodeVoucherToken(encoded string) (*VoucherToken, error) {
 	return &token, nil
 }
 
-func Vouch(sess *session.Session, kmsKeyId, to, vouchee, context string) VoucherToken {
-	ident, err := CallerIdentityUser(sess)
+// Vouch creates a voucher for vouchee to log into the instance scope as
+// sshUsername, or as anyone if that's empty. It expires after ttl, or
+// TokenLifetime if ttl is zero.
+func Vouch(ctx context.Context, sess *session.Session, authority TokenAuthority, to, vouchee, scope, sshUsername string, ttl time.Duration) (*VoucherToken, error) {
+	if len(vouchee) == 0 || len(scope) == 0 {
+		return nil, errors.New("vouchers need a vouchee and a scope")
+	}
+
+	if ttl <= 0 {
+		ttl = TokenLifetime
+	}
+
+	ident, err := CallerIdentityUser(ctx, sess)
 	if err != nil {
-		log.Panicf("error getting aws user identity: %+v\n", err)
+		return nil, errors.Wrap(err, "getting aws user identity")
 	}
 
-	token := CreateToken(sess, TokenParams{
+	token, err := CreateTokenWithLifetime(ctx, authority, TokenParams{
 		FromId: ident.UserId,
 		FromAccount: ident.AccountId,
 		FromName: ident.Username,
 		To: to,
 		Type: ident.Type,
 		Vouchee: vouchee,
-		Context: context,
-	}, kmsKeyId)
+		Context: scope,
+		SshUsername: sshUsername,
+	}, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating voucher token")
+	}
 
-	return VoucherToken(token)
+	voucher := VoucherToken(token)
+	return &voucher, nil
 }
 
+// verifyVouchers returns the vouchers in params that vouch for the requester
+// logging into the instance they asked for, at most one per voucher, along
+// with why any others were dropped. Vouchers aren't redeemed against the
+// replay store, so one can be used for several logins while it's valid.
+func (c LambdaConfig) verifyVouchers(ctx context.Context, params TokenParams) ([]VoucherToken, []string, error) {
+	if len(params.Vouchers) == 0 {
+		return nil, nil, nil
+	}
+
+	authority, err := c.tokenAuthority()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verified := []VoucherToken{}
+	rejected := []string{}
+	seen := map[string]bool{}
+
+	for _, voucher := range params.Vouchers {
+		vp := voucher.Params
+		err := c.checkVoucher(ctx, authority, params, voucher)
+
+		key := voucherIdentity(vp.FromAccount, vp.FromId)
+		if err == nil && seen[key] {
+			err = errors.New("duplicate voucher")
+		}
+
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", tokenIdentity(vp), err.Error()))
+			continue
+		}
+
+		seen[key] = true
+		verified = append(verified, voucher)
+	}
+
+	return verified, rejected, nil
+}
+
+// voucherIdentity is who a voucher is from, for telling vouchers apart. The
+// sessions of a role are all the same identity, as whoever assumes the role
+// chooses the session name.
+func voucherIdentity(account, id string) string {
+	return account + "/" + uniqueId(id)
+}
+
+// DefaultMaxVoucherValidity is how long the CA accepts vouchers being valid
+// for, unless LambdaConfig.MaxVoucherValidityDuration says otherwise.
+const DefaultMaxVoucherValidity = 12 * time.Hour
+
+func (c LambdaConfig) maxVoucherValidity() time.Duration {
+	if c.MaxVoucherValidityDuration > 0 {
+		return time.Duration(c.MaxVoucherValidityDuration) * time.Second
+	}
+	return DefaultMaxVoucherValidity
+}
+
+func (c LambdaConfig) checkVoucher(ctx context.Context, authority TokenAuthority, params TokenParams, voucher VoucherToken) error {
+	payload, err := validateToken(ctx, authority, Token(voucher), nil)
+	if err != nil {
+		return err
+	}
+
+	// the payload is signed, unlike the voucher's Expiry
+	validity := time.Duration(payload.NotAfter-payload.NotBefore) * time.Second
+	if max := c.maxVoucherValidity(); validity > max {
+		return errors.Wrapf(ErrInvalidToken, "voucher is valid for %s, longer than the %s allowed", validity, max)
+	}
+
+	vp := voucher.Params
+	if len(c.KmsTokenIdentity) > 0 && vp.To != c.KmsTokenIdentity {
+		return errors.Wrapf(ErrInvalidToken, "voucher was issued to %s, not %s", vp.To, c.KmsTokenIdentity)
+	}
+
+	if voucherIdentity(vp.FromAccount, vp.FromId) == voucherIdentity(params.FromAccount, params.FromId) {
+		return errors.New("users can't vouch for themselves")
+	}
+
+	// a voucher can name a particular session of a role, as 'lkp vouch
+	// request' does, or anyone who assumes it
+	vouchee := false
+	identities := append(requesterIdentities(tokenParamsToAuthLambdaIdentity(params)), params.FromId)
+	for _, identity := range identities {
+		vouchee = vouchee || (len(identity) > 0 && identity == vp.Vouchee)
+	}
+	if !vouchee {
+		return errors.Errorf("voucher is for %q, not the requester", vp.Vouchee)
+	}
+
+	if vp.Context != params.RemoteInstanceArn {
+		return errors.Errorf("voucher is for logging into %q, not %s", vp.Context, params.RemoteInstanceArn)
+	}
+
+	if len(vp.SshUsername) > 0 && vp.SshUsername != params.SshUsername {
+		return errors.Errorf("voucher is for logging in as %q, not %s", vp.SshUsername, params.SshUsername)
+	}
+
+	return nil
+}
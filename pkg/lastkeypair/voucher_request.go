@@ -0,0 +1,208 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const voucherRequestPrefix = "lkpreq_"
+
+// VoucherRequest asks a colleague to vouch for the requester. It isn't
+// signed: the voucher it leads to is only ever accepted from the identity
+// named here, so the worst a forged request can do is get a voucher for
+// someone else.
+type VoucherRequest struct {
+	FromId      string
+	FromAccount string
+	FromName    string `json:",omitempty"`
+	Type        string
+	InstanceArn string
+	SshUsername string `json:",omitempty"`
+	Reason      string
+	Created     time.Time
+}
+
+// Vouchee is how a voucher for this request names the requester.
+func (r *VoucherRequest) Vouchee() string {
+	if len(r.FromName) > 0 {
+		return r.FromName
+	}
+	return r.FromId
+}
+
+func (r *VoucherRequest) Encode() string {
+	jsonReq, _ := json.Marshal(r)
+	buf := bytes.Buffer{}
+	gz := gzip.NewWriter(&buf)
+	gz.Write(jsonReq)
+	gz.Close()
+	return voucherRequestPrefix + base32.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func DecodeVoucherRequest(encoded string) (*VoucherRequest, error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, voucherRequestPrefix) {
+		return nil, errors.Errorf("voucher requests start with %s", voucherRequestPrefix)
+	}
+
+	compressed, err := base32.StdEncoding.DecodeString(strings.TrimPrefix(encoded, voucherRequestPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding base32 voucher request")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating gzip reader for voucher request")
+	}
+
+	jsonReq, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading gzipped voucher request")
+	}
+
+	req := &VoucherRequest{}
+	err = json.Unmarshal(jsonReq, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading json voucher request")
+	}
+
+	return req, nil
+}
+
+// RequestVoucher describes the caller wanting to log into instanceArn, for
+// someone else to approve.
+func (c *Client) RequestVoucher(ctx context.Context, instanceArn, sshUsername, reason string) (*VoucherRequest, error) {
+	ident, err := CallerIdentityUser(ctx, c.sess)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting aws user identity")
+	}
+
+	return &VoucherRequest{
+		FromId:      ident.UserId,
+		FromAccount: ident.AccountId,
+		FromName:    ident.Username,
+		Type:        ident.Type,
+		InstanceArn: instanceArn,
+		SshUsername: sshUsername,
+		Reason:      reason,
+		Created:     time.Now(),
+	}, nil
+}
+
+// ApproveVoucherRequest vouches for the requester of req to log into the
+// instance they asked for, as the user they asked for, for ttl.
+func (c *Client) ApproveVoucherRequest(ctx context.Context, req *VoucherRequest, ttl time.Duration) (*VoucherToken, error) {
+	ident, err := CallerIdentityUser(ctx, c.sess)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting aws user identity")
+	}
+
+	if ident.AccountId == req.FromAccount && ident.UserId == req.FromId {
+		return nil, errors.New("you can't vouch for yourself")
+	}
+
+	return c.Vouch(ctx, req.Vouchee(), req.InstanceArn, req.SshUsername, ttl)
+}
+
+// VoucherInbox holds vouchers that others have given the user, until they
+// expire. It's the vouchers directory of the client's cache dir.
+type VoucherInbox struct {
+	dir string
+}
+
+func NewVoucherInbox(dir string) *VoucherInbox {
+	return &VoucherInbox{dir: dir}
+}
+
+func (c *Client) VoucherInbox() *VoucherInbox {
+	return NewVoucherInbox(filepath.Join(c.CacheDir(), "vouchers"))
+}
+
+func (i *VoucherInbox) Add(voucher *VoucherToken) error {
+	err := os.MkdirAll(i.dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "creating voucher inbox")
+	}
+
+	encoded := voucher.Encode()
+	sum := sha256.Sum256([]byte(encoded))
+	path := filepath.Join(i.dir, hex.EncodeToString(sum[:8])+".voucher")
+	return errors.Wrap(ioutil.WriteFile(path, []byte(encoded), 0600), "writing voucher to inbox")
+}
+
+// For returns the vouchers for logging into instanceArn as sshUsername, and
+// removes any that have expired. v1 vouchers don't say when they expire, so
+// they're assumed to last TokenLifetime from when they were added. Files
+// that can't be read as vouchers are moved aside, so that one bad file
+// doesn't stop every login.
+func (i *VoucherInbox) For(instanceArn, sshUsername string) ([]VoucherToken, error) {
+	return i.find(instanceArn, sshUsername, true)
+}
+
+// Peek is For without touching the inbox: expired and unreadable files are
+// skipped but left where they are.
+func (i *VoucherInbox) Peek(instanceArn, sshUsername string) ([]VoucherToken, error) {
+	return i.find(instanceArn, sshUsername, false)
+}
+
+func (i *VoucherInbox) find(instanceArn, sshUsername string, tidy bool) ([]VoucherToken, error) {
+	paths, err := filepath.Glob(filepath.Join(i.dir, "*.voucher"))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing voucher inbox")
+	}
+
+	vouchers := []VoucherToken{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		voucher, err := readVoucherFile(path)
+		if err != nil {
+			log.Printf("skipping voucher %s: %s", path, err.Error())
+			if tidy {
+				os.Rename(path, path+".bad")
+			}
+			continue
+		}
+
+		expiry := info.ModTime().Add(TokenLifetime)
+		if voucher.Expiry > 0 {
+			expiry = time.Unix(voucher.Expiry, 0)
+		}
+		if time.Now().After(expiry) {
+			if tidy {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		p := voucher.Params
+		if p.Context == instanceArn && (len(p.SshUsername) == 0 || p.SshUsername == sshUsername) {
+			vouchers = append(vouchers, *voucher)
+		}
+	}
+
+	return vouchers, nil
+}
+
+func readVoucherFile(path string) (*VoucherToken, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading voucher from inbox")
+	}
+	return DecodeVoucherToken(string(encoded))
+}
@@ -0,0 +1,279 @@
+package lastkeypair
+
+import (
+	"testing"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyVouchers(t *testing.T) {
+	authority := testTokenAuthority()
+	config := LambdaConfig{KmsTokenIdentity: "LastKeypair", TokenAuthority: authority}
+	params := testTokenParams()
+
+	voucher := func(fromId, vouchee, vouchContext string) VoucherToken {
+		return VoucherToken(mustCreateToken(t, authority, TokenParams{
+			FromId: fromId,
+			FromAccount: params.FromAccount,
+			FromName: fromId + "@example.com",
+			To: "LastKeypair",
+			Type: "User",
+			Vouchee: vouchee,
+			Context: vouchContext,
+		}))
+	}
+
+	forged := voucher("AIDAFORGER", params.FromName, params.RemoteInstanceArn)
+	forged.Params.FromId = "AIDABOSS"
+
+	otherAuthority := VoucherToken(mustCreateToken(t, NewHmacTokenAuthority([]byte("other")), voucher("AIDAEVE", params.FromName, params.RemoteInstanceArn).Params))
+
+	params.Vouchers = []VoucherToken{
+		voucher("AIDABEN", params.FromName, params.RemoteInstanceArn),
+		voucher("AIDABEN", params.FromName, params.RemoteInstanceArn),
+		voucher("AIDADAN", params.FromId, params.RemoteInstanceArn),
+		voucher(params.FromId, params.FromName, params.RemoteInstanceArn),
+		voucher("AIDAMALLORY", "someone-else", params.RemoteInstanceArn),
+		voucher("AIDATRENT", params.FromName, "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-other"),
+		forged,
+		otherAuthority,
+	}
+
+	verified, rejected, err := config.verifyVouchers(context.Background(), params)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 2)
+	assert.Equal(t, "AIDABEN", verified[0].Params.FromId)
+	assert.Equal(t, "AIDADAN", verified[1].Params.FromId)
+	assert.Len(t, rejected, 6)
+	assert.Contains(t, rejected[0], "duplicate")
+	assert.Contains(t, rejected[1], "themselves")
+}
+
+func TestVerifyVouchersFromSessionsOfOneRole(t *testing.T) {
+	authority := testTokenAuthority()
+	config := LambdaConfig{KmsTokenIdentity: "LastKeypair", TokenAuthority: authority}
+
+	params := testTokenParams()
+	params.FromId = "AROAREQUESTER:dan"
+	params.FromName = ""
+	params.Type = "AssumedRole"
+
+	voucher := func(fromId, vouchee string) VoucherToken {
+		return VoucherToken(mustCreateToken(t, authority, TokenParams{
+			FromId: fromId,
+			FromAccount: params.FromAccount,
+			To: "LastKeypair",
+			Type: "AssumedRole",
+			Vouchee: vouchee,
+			Context: params.RemoteInstanceArn,
+		}))
+	}
+
+	params.Vouchers = []VoucherToken{
+		voucher("AROASENIORS:ben", params.FromId),
+		voucher("AROASENIORS:ben-again", params.FromId),
+		voucher("AROAREQUESTER:dan-alt", params.FromId),
+		voucher("AROAOTHER:eve", "dan"),
+		voucher("AROAOTHER:trent", "AROAREQUESTER"),
+	}
+
+	verified, rejected, err := config.verifyVouchers(context.Background(), params)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 2)
+	assert.Equal(t, "AROASENIORS:ben", verified[0].Params.FromId)
+	assert.Equal(t, "AROAOTHER:trent", verified[1].Params.FromId)
+	assert.Len(t, rejected, 3)
+	assert.Contains(t, rejected[0], "duplicate")
+	assert.Contains(t, rejected[1], "themselves")
+	assert.Contains(t, rejected[2], "not the requester", "role session names are chosen by the requester")
+
+	group := PolicyMatch{Ids: []string{"AROASENIORS"}}
+	request := newUserCertAuthorizationRequest(UserCertReqJson{Token: Token{Params: TokenParams{Vouchers: params.Vouchers[:2]}}})
+	assert.Equal(t, 1, countVouchersFrom(request.Vouchers, group))
+}
+
+func TestVerifyVouchersChecksUsername(t *testing.T) {
+	authority := testTokenAuthority()
+	config := LambdaConfig{KmsTokenIdentity: "LastKeypair", TokenAuthority: authority}
+
+	params := testTokenParams()
+	params.SshUsername = "root"
+
+	voucher := func(fromId, sshUsername string) VoucherToken {
+		return VoucherToken(mustCreateToken(t, authority, TokenParams{
+			FromId: fromId,
+			FromAccount: params.FromAccount,
+			To: "LastKeypair",
+			Type: "User",
+			Vouchee: params.FromName,
+			Context: params.RemoteInstanceArn,
+			SshUsername: sshUsername,
+		}))
+	}
+
+	params.Vouchers = []VoucherToken{
+		voucher("AIDABEN", "ec2-user"),
+		voucher("AIDADAN", "root"),
+		voucher("AIDAEVE", ""),
+	}
+
+	verified, rejected, err := config.verifyVouchers(context.Background(), params)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 2)
+	assert.Equal(t, "AIDADAN", verified[0].Params.FromId)
+	assert.Equal(t, "AIDAEVE", verified[1].Params.FromId)
+	assert.Len(t, rejected, 1)
+	assert.Contains(t, rejected[0], `logging in as "ec2-user"`)
+}
+
+func TestVerifyVouchersCapsValidity(t *testing.T) {
+	authority := testTokenAuthority()
+	params := testTokenParams()
+
+	voucher := func(fromId string, lifetime time.Duration) VoucherToken {
+		token, err := CreateTokenWithLifetime(context.Background(), authority, TokenParams{
+			FromId: fromId,
+			FromAccount: params.FromAccount,
+			To: "LastKeypair",
+			Type: "User",
+			Vouchee: params.FromName,
+			Context: params.RemoteInstanceArn,
+		}, lifetime)
+		assert.Nil(t, err)
+		return VoucherToken(token)
+	}
+
+	params.Vouchers = []VoucherToken{
+		voucher("AIDABEN", time.Hour),
+		voucher("AIDADAN", 24*time.Hour),
+	}
+
+	config := LambdaConfig{KmsTokenIdentity: "LastKeypair", TokenAuthority: authority}
+	verified, rejected, err := config.verifyVouchers(context.Background(), params)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 1)
+	assert.Equal(t, "AIDABEN", verified[0].Params.FromId)
+	assert.Len(t, rejected, 1)
+	assert.Contains(t, rejected[0], "longer than the 12h0m0s allowed")
+
+	config.MaxVoucherValidityDuration = 600
+	verified, rejected, err = config.verifyVouchers(context.Background(), params)
+	assert.Nil(t, err)
+	assert.Len(t, verified, 0)
+	assert.Len(t, rejected, 2)
+}
+
+func TestVoucherRequestRoundTrip(t *testing.T) {
+	req := &VoucherRequest{
+		FromId: "AROAEXAMPLE:daniel.whyte@example.com",
+		FromAccount: "123456789012",
+		Type: "AssumedRole",
+		InstanceArn: "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-0123abcd",
+		Reason: "INC-1234: disk full",
+		Created: time.Now().Round(time.Second),
+	}
+
+	decoded, err := DecodeVoucherRequest(req.Encode() + "\n")
+	assert.Nil(t, err)
+	assert.Equal(t, req.Reason, decoded.Reason)
+	assert.True(t, req.Created.Equal(decoded.Created))
+	assert.Equal(t, req.FromId, decoded.Vouchee())
+
+	voucher := VoucherToken(mustCreateToken(t, testTokenAuthority(), testTokenParams()))
+	_, err = DecodeVoucherRequest(voucher.Encode())
+	assert.NotNil(t, err)
+}
+
+func TestVoucherInbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lkp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	authority := testTokenAuthority()
+	inbox := NewVoucherInbox(filepath.Join(dir, "vouchers"))
+	target := "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-0123abcd"
+
+	for _, vouchContext := range []string{target, target, "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-other"} {
+		params := testTokenParams()
+		params.Vouchee, params.Context = "aidan", vouchContext
+		voucher := VoucherToken(mustCreateToken(t, authority, params))
+		assert.Nil(t, inbox.Add(&voucher))
+	}
+
+	vouchers, err := inbox.For(target, "ec2-user")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 2)
+
+	vouchers, err = inbox.For(target, "root")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 0)
+
+	// a corrupt voucher is moved aside rather than breaking every login
+	corrupt := filepath.Join(dir, "vouchers", "corrupt.voucher")
+	assert.Nil(t, ioutil.WriteFile(corrupt, []byte("lkpv2_truncated"), 0600))
+	vouchers, err = inbox.Peek(target, "ec2-user")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 2)
+	_, err = os.Stat(corrupt)
+	assert.Nil(t, err)
+
+	vouchers, err = inbox.For(target, "ec2-user")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 2)
+	_, err = os.Stat(corrupt + ".bad")
+	assert.Nil(t, err)
+
+	// expired vouchers are cleared out
+	params := testTokenParams()
+	params.Vouchee, params.Context = "aidan", target
+	token, err := CreateTokenWithLifetime(context.Background(), authority, params, -time.Minute)
+	assert.Nil(t, err)
+	expired := VoucherToken(token)
+	assert.Nil(t, inbox.Add(&expired))
+
+	vouchers, err = inbox.Peek(target, "ec2-user")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 2)
+	paths, _ := filepath.Glob(filepath.Join(dir, "vouchers", "*.voucher"))
+	assert.Len(t, paths, 4)
+
+	vouchers, err = inbox.For(target, "ec2-user")
+	assert.Nil(t, err)
+	assert.Len(t, vouchers, 2)
+	paths, _ = filepath.Glob(filepath.Join(dir, "vouchers", "*.voucher"))
+	assert.Len(t, paths, 3)
+}
+
+func TestVoucherEncoding(t *testing.T) {
+	authority := testTokenAuthority()
+	params := testTokenParams()
+	params.RemoteInstanceArn = ""
+	params.Vouchee, params.Context = "ben", "arn:aws:ec2:ap-southeast-2:123456789012:instance/i-0123abcd"
+
+	token, err := CreateTokenWithLifetime(context.Background(), authority, params, 10*time.Minute)
+	assert.Nil(t, err)
+	voucher := VoucherToken(token)
+	assert.InDelta(t, time.Now().Add(10*time.Minute).Unix(), voucher.Expiry, 5)
+
+	encoded := voucher.Encode()
+	assert.True(t, strings.HasPrefix(encoded, "lkpv2_"))
+	assert.True(t, len(encoded) < len(voucher.EncodeV1()))
+
+	decoded, err := DecodeVoucherToken(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, voucher, *decoded)
+	assert.Nil(t, ValidateToken(context.Background(), authority, Token(*decoded), nil))
+
+	_, err = DecodeVoucherToken(encoded[:len(encoded)-3])
+	assert.NotNil(t, err)
+
+	// v1 vouchers are still accepted
+	decoded, err = DecodeVoucherToken(voucher.EncodeV1())
+	assert.Nil(t, err)
+	assert.Equal(t, voucher, *decoded)
+}
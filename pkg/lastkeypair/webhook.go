@@ -0,0 +1,63 @@
+package lastkeypair
+
+import (
+	"github.com/pkg/errors"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+const webhookSignatureHeader = "X-Lkp-Signature"
+
+// webhookSignature is "sha256=" followed by the hex HMAC-SHA256 of body, as
+// sent in the X-Lkp-Signature header.
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postJSON POSTs req as JSON, signed if there's a secret, and decodes the
+// response into resp unless it's nil. Non-2xx responses are errors.
+func postJSON(ctx context.Context, client *http.Client, url string, secret []byte, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "encoding webhook request")
+	}
+
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating webhook request")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	if len(secret) > 0 {
+		httpReq.Header.Set(webhookSignatureHeader, webhookSignature(secret, body))
+	}
+
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "posting to webhook")
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading webhook response")
+	}
+
+	if httpResp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook returned status %d", httpResp.StatusCode)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(respBody, resp), "decoding webhook response")
+}